@@ -0,0 +1,276 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package capture records the packets exchanged between a client and broker, and replays them, to assist in
+// diagnosing issues.
+//
+// A Writer is a mqtt.PacketTap that writes each packet to a (rotating) file as a line of JSON holding the
+// direction, timestamp, a summary of the packet, and the raw bytes:
+//
+//	w, err := capture.NewWriter("/var/log/mqtt.capture")
+//	if err != nil { ... }
+//	defer w.Close()
+//	opts.SetPacketTap(w)
+//
+// A capture may be read with ReadFiles and replayed against a client with a Peer (which takes the place of the
+// broker); this allows issues to be reproduced deterministically in tests.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	DefaultMaxSize    = 10 * 1024 * 1024 // Default Writer.MaxSize
+	DefaultMaxBackups = 5                // Default Writer.MaxBackups
+)
+
+// Values of Record.Direction
+const (
+	Inbound  = "inbound"  // Received by the client
+	Outbound = "outbound" // Sent by the client
+)
+
+// Record is a single captured packet
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`  // Inbound or Outbound
+	Type      string    `json:"type"` // e.g. "PUBLISH" (see packets.PacketNames)
+	MessageID uint16    `json:"id,omitempty"`
+	Qos       byte      `json:"qos,omitempty"`
+	Topic     string    `json:"topic,omitempty"` // PUBLISH only
+	Size      int       `json:"size"`
+	Raw       []byte    `json:"raw"`             // The encoded packet
+	Error     string    `json:"error,omitempty"` // Set if Raw could not be decoded
+}
+
+// NewRecord creates a Record from a packet passed to a mqtt.PacketTap
+func NewRecord(dir mqtt.TapDirection, at time.Time, raw []byte) Record {
+	r := Record{
+		Time:      at,
+		Direction: dir.String(),
+		Size:      len(raw),
+		Raw:       bytes.Clone(raw),
+	}
+	if len(raw) > 0 {
+		r.Type = packets.PacketNames[raw[0]>>4]
+	}
+	cp, err := r.Packet()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	d := cp.Details()
+	r.MessageID, r.Qos = d.MessageID, d.Qos
+	if p, ok := cp.(*packets.PublishPacket); ok {
+		r.Topic = p.TopicName
+	}
+	return r
+}
+
+// Packet decodes the raw bytes
+func (r Record) Packet() (packets.ControlPacket, error) {
+	return packets.ReadPacket(bytes.NewReader(r.Raw))
+}
+
+// Writer is a mqtt.PacketTap that writes records to a file, rotating it when it reaches MaxSize. Rotated files
+// are renamed with a numeric suffix (path.1 being the most recent) and the oldest removed once there are more than
+// MaxBackups.
+type Writer struct {
+	// The fields below may be changed prior to use
+	MaxSize    int64       // Size at which the file is rotated (0 = no rotation)
+	MaxBackups int         // Number of rotated files retained
+	OnError    func(error) // Called if a record cannot be written (optional)
+
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// NewWriter creates a Writer that appends to the file at path
+func NewWriter(path string) (*Writer, error) {
+	w := &Writer{MaxSize: DefaultMaxSize, MaxBackups: DefaultMaxBackups, path: path}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// TapPacket implements mqtt.PacketTap
+func (w *Writer) TapPacket(dir mqtt.TapDirection, at time.Time, raw []byte) {
+	if err := w.Write(NewRecord(dir, at, raw)); err != nil && w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+// Write appends r to the file (records are buffered; call Flush or Close to ensure they are written)
+func (w *Writer) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.MaxSize {
+		if err = w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// Flush writes any buffered records to the file
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	return w.w.Flush()
+}
+
+// Close flushes and closes the file; any records subsequently passed to TapPacket are dropped
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+// open opens the file (w.mu must be held or the Writer not yet in use)
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.w, w.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+// close flushes and closes the file (w.mu must be held)
+func (w *Writer) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f, w.w = nil, nil
+	return err
+}
+
+// rotate renames the current file and opens a new one (w.mu must be held)
+func (w *Writer) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if w.MaxBackups <= 0 {
+		if err := os.Remove(w.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return w.open()
+	}
+	_ = os.Remove(backupName(w.path, w.MaxBackups))
+	for i := w.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(w.path, i), backupName(w.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, backupName(w.path, 1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// backupName returns the name of the nth rotated file
+func backupName(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// Files returns the capture file at path, along with any rotated files, oldest first
+func Files(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backupName(path, i)); err != nil {
+			break
+		}
+		files = append([]string{backupName(path, i)}, files...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+// Read reads the records written to r
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<30)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return records, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, s.Err()
+}
+
+// ReadFiles reads the records from the files specified (in order). Use Files to obtain the files for a rotated
+// capture.
+func ReadFiles(files ...string) ([]Record, error) {
+	var records []Record
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return records, err
+		}
+		r, err := Read(f)
+		f.Close()
+		records = append(records, r...)
+		if err != nil {
+			return records, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return records, nil
+}
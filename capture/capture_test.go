@@ -0,0 +1,219 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// record creates a Record holding cp
+func record(t *testing.T, dir mqtt.TapDirection, cp packets.ControlPacket) Record {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := cp.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return NewRecord(dir, time.Now(), buf.Bytes())
+}
+
+func TestNewRecord(t *testing.T) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Qos = 1
+	pub.MessageID = 5
+	pub.Payload = []byte("hello")
+	r := record(t, mqtt.TapOutbound, pub)
+	if r.Direction != Outbound || r.Type != "PUBLISH" || r.Topic != "a/b" || r.MessageID != 5 || r.Qos != 1 || r.Size != len(r.Raw) || r.Error != "" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if cp, err := r.Packet(); err != nil || cp.String() != pub.String() {
+		t.Fatalf("Packet returned %v, %v", cp, err)
+	}
+
+	r = NewRecord(mqtt.TapInbound, time.Now(), []byte{0x30, 10, 0})
+	if r.Direction != Inbound || r.Type != "PUBLISH" || r.Error == "" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+}
+
+func TestWriterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture")
+	w, err := NewWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	line := record(t, mqtt.TapInbound, ack)
+	w.MaxSize = 500 // Around 4 records per file
+	w.MaxBackups = 2
+	for i := range 40 {
+		ack.MessageID = uint16(i)
+		if err = w.Write(record(t, mqtt.TapInbound, ack)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w.TapPacket(mqtt.TapInbound, line.Time, line.Raw) // Dropped
+
+	files := Files(path)
+	if len(files) != 3 || files[0] != path+".2" || files[2] != path {
+		t.Fatalf("unexpected files %v", files)
+	}
+	records, err := ReadFiles(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 4 || len(records) > 20 || records[len(records)-1].MessageID != 39 {
+		t.Fatalf("unexpected records (%d) %+v", len(records), records)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].MessageID != records[i-1].MessageID+1 {
+			t.Fatalf("records out of order: %+v", records)
+		}
+	}
+}
+
+// runPeer starts a Peer replaying records, returning the address to connect to and a channel that will receive
+// the result of Serve
+func runPeer(t *testing.T, records []Record) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		p := NewPeer(records)
+		p.Timeout = 5 * time.Second
+		result <- p.Serve(conn)
+	}()
+	return "tcp://" + l.Addr().String(), result
+}
+
+// runClient connects to addr, subscribes and, upon receipt of a message, publishes a reply
+func runClient(t *testing.T, addr string, tap mqtt.PacketTap, peerDone <-chan error) {
+	t.Helper()
+	o := mqtt.NewClientOptions().AddBroker(addr).SetAutoReconnect(false)
+	if tap != nil {
+		o.SetPacketTap(tap)
+	}
+	c := mqtt.NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	handled := make(chan struct{})
+	c.Subscribe("a/#", 1, func(c mqtt.Client, m mqtt.Message) {
+		c.Publish("reply", 1, false, append(m.Payload(), '!')).Wait()
+		close(handled)
+	})
+	select {
+	case <-handled:
+	case err := <-peerDone:
+		t.Fatalf("peer finished early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not handled")
+	}
+	if err := <-peerDone; err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	c.Disconnect(250)
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.Topics, sub.Qoss, sub.MessageID = []string{"a/#"}, []byte{1}, 100
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.ReturnCodes, suback.MessageID = []byte{1}, 100
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID, pub.Payload = "a/b", 1, 7, []byte("hello")
+	reply := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	reply.TopicName, reply.Qos, reply.MessageID, reply.Payload = "reply", 1, 200, []byte("hello!")
+	replyAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	replyAck.MessageID = 200
+	pubAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pubAck.MessageID = 7
+	script := []Record{
+		record(t, mqtt.TapOutbound, sub),
+		record(t, mqtt.TapInbound, suback),
+		record(t, mqtt.TapInbound, pub),
+		record(t, mqtt.TapOutbound, reply),
+		record(t, mqtt.TapInbound, replyAck),
+		record(t, mqtt.TapOutbound, pubAck),
+	}
+
+	// Run the script, capturing the packets exchanged
+	path := filepath.Join(t.TempDir(), "capture")
+	w, err := NewWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, done := runPeer(t, script)
+	runClient(t, addr, w, done)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	captured, err := ReadFiles(Files(path)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captured) != len(script)+3 || captured[0].Type != "CONNECT" || captured[1].Type != "CONNACK" ||
+		captured[len(captured)-1].Type != "DISCONNECT" {
+		t.Fatalf("unexpected capture %+v", captured)
+	}
+	for i, r := range script {
+		if c := captured[i+2]; c.Direction != r.Direction || c.Type != r.Type || c.Error != "" {
+			t.Fatalf("record %d: expected %s %s, got %+v", i, r.Direction, r.Type, c)
+		}
+	}
+
+	// Replaying the capture should reproduce the same exchange (the DISCONNECT is omitted as runClient waits for
+	// the replay to complete before disconnecting, and the Peer performs the handshake itself)
+	addr, done = runPeer(t, captured[:len(captured)-1])
+	runClient(t, addr, nil, done)
+}
+
+func TestReplayMismatch(t *testing.T) {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.Topics, sub.Qoss, sub.MessageID = []string{"other"}, []byte{1}, 1
+	addr, done := runPeer(t, []Record{record(t, mqtt.TapOutbound, sub)})
+
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(addr).SetAutoReconnect(false))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	c.Subscribe("a/#", 1, nil)
+	var me *MismatchError
+	if err := <-done; !errors.As(err, &me) || me.Index != 0 {
+		t.Fatalf("expected MismatchError, got %v", err)
+	}
+}
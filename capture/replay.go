@@ -0,0 +1,247 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// DefaultTimeout is the default Peer.Timeout
+const DefaultTimeout = 10 * time.Second
+
+var (
+	ErrTimeout   = errors.New("timeout waiting for packet from client")
+	ErrNoConnect = errors.New("first packet from client was not CONNECT")
+)
+
+// MismatchError is returned by Peer.Serve when a packet sent by the client does not match the capture
+type MismatchError struct {
+	Index    int    // Index of the record expected
+	Expected Record // The record expected
+	Got      packets.ControlPacket
+	Reason   string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("record %d: expected %s, got %v: %s", e.Index, e.Expected.Type, e.Got, e.Reason)
+}
+
+// Peer takes the place of the broker, replaying a capture to a client. Inbound records (those the client received)
+// are sent to the client, whilst for each outbound record the Peer waits for the client to send a matching packet
+// before proceeding; this ensures that the sequence of events is the same each time the capture is replayed.
+//
+// Keepalive packets are not replayed (they depend upon timing); the Peer responds to any PINGREQ received. Nor are
+// the CONNECT and CONNACK records; the Peer performs the handshake itself (see Serve).
+// Message IDs chosen by the client may differ from those captured; IDs in the acknowledgements the Peer sends are
+// translated to match those the client used.
+type Peer struct {
+	// The fields below may be changed prior to use
+	Records        []Record
+	Timeout        time.Duration // Maximum time to wait for each packet from the client
+	Delay          bool          // Reproduce the delays between the records captured
+	SessionPresent bool          // Value of the session present flag in the CONNACK sent
+
+	// Compare, if not nil, is used to determine whether a packet received matches that expected (returning
+	// a non-nil error if not). The default (see Matches) compares the packet types and, for PUBLISH,
+	// SUBSCRIBE and UNSUBSCRIBE, the topics, QoS, retain flag and payload.
+	Compare func(expected, got packets.ControlPacket) error
+}
+
+// NewPeer creates a Peer that will replay records
+func NewPeer(records []Record) *Peer {
+	return &Peer{Records: records, Timeout: DefaultTimeout}
+}
+
+// Serve replays the capture over conn. A CONNECT is expected from the client (and a CONNACK, with the session present
+// flag set from SessionPresent, sent in response) before the remaining records are replayed. Serve returns once all records have been replayed
+// (nil) or an error (e.g. a *MismatchError) occurs; conn is not closed.
+func (p *Peer) Serve(conn net.Conn) error {
+	reader := packets.NewReader(conn)
+	var wMu sync.Mutex
+	write := func(cp packets.ControlPacket) error {
+		wMu.Lock()
+		defer wMu.Unlock()
+		return cp.Write(conn)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(p.timeout()))
+	cp, err := reader.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if _, ok := cp.(*packets.ConnectPacket); !ok {
+		return ErrNoConnect
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ca.SessionPresent = p.SessionPresent
+	if err = write(ca); err != nil {
+		return err
+	}
+
+	// Packets from the client are read in a separate goroutine so that PINGREQs can be answered at any time
+	received := make(chan packets.ControlPacket)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			cp, err := reader.ReadPacket()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if _, ok := cp.(*packets.PingreqPacket); ok {
+				if err = write(packets.NewControlPacket(packets.Pingresp)); err != nil {
+					readErr <- err
+					return
+				}
+				continue
+			}
+			select {
+			case received <- cp:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ids := make(map[uint16]uint16) // Message IDs captured -> used by client
+	var last time.Time
+	for i, rec := range p.Records {
+		switch rec.Type {
+		case packets.PacketNames[packets.Pingreq], packets.PacketNames[packets.Pingresp],
+			packets.PacketNames[packets.Connect], packets.PacketNames[packets.Connack]:
+			continue
+		}
+		expected, err := rec.Packet()
+		if err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+		if p.Delay && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		switch rec.Direction {
+		case Inbound:
+			translateID(expected, ids)
+			if err = write(expected); err != nil {
+				return err
+			}
+		case Outbound:
+			var got packets.ControlPacket
+			select {
+			case got = <-received:
+			case err = <-readErr:
+				return err
+			case <-time.After(p.timeout()):
+				return fmt.Errorf("record %d (%s): %w", i, rec.Type, ErrTimeout)
+			}
+			if err = p.compare(expected, got); err != nil {
+				return &MismatchError{Index: i, Expected: rec, Got: got, Reason: err.Error()}
+			}
+			if id := expected.Details().MessageID; id != 0 {
+				ids[id] = got.Details().MessageID
+			}
+		default:
+			return fmt.Errorf("record %d: unknown direction %q", i, rec.Direction)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (p *Peer) compare(expected, got packets.ControlPacket) error {
+	if p.Compare != nil {
+		return p.Compare(expected, got)
+	}
+	return Matches(expected, got)
+}
+
+// Matches is the default Peer.Compare; it checks that got is of the same type as expected and, for PUBLISH,
+// SUBSCRIBE and UNSUBSCRIBE, has the same topics, QoS, retain flag and payload. Message IDs are not compared.
+func Matches(expected, got packets.ControlPacket) error {
+	switch e := expected.(type) {
+	case *packets.PublishPacket:
+		g, ok := got.(*packets.PublishPacket)
+		switch {
+		case !ok:
+		case e.TopicName != g.TopicName:
+			return fmt.Errorf("topic %q != %q", g.TopicName, e.TopicName)
+		case e.Qos != g.Qos || e.Retain != g.Retain:
+			return fmt.Errorf("qos/retain %d/%t != %d/%t", g.Qos, g.Retain, e.Qos, e.Retain)
+		case !bytes.Equal(e.Payload, g.Payload):
+			return errors.New("payload differs")
+		default:
+			return nil
+		}
+	case *packets.SubscribePacket:
+		if g, ok := got.(*packets.SubscribePacket); ok {
+			if fmt.Sprint(e.Topics, e.Qoss) != fmt.Sprint(g.Topics, g.Qoss) {
+				return fmt.Errorf("subscriptions %v %v != %v %v", g.Topics, g.Qoss, e.Topics, e.Qoss)
+			}
+			return nil
+		}
+	case *packets.UnsubscribePacket:
+		if g, ok := got.(*packets.UnsubscribePacket); ok {
+			if fmt.Sprint(e.Topics) != fmt.Sprint(g.Topics) {
+				return fmt.Errorf("topics %v != %v", g.Topics, e.Topics)
+			}
+			return nil
+		}
+	default:
+		if reflect.TypeOf(expected) == reflect.TypeOf(got) {
+			return nil
+		}
+	}
+	return fmt.Errorf("packet type %T != %T", got, expected)
+}
+
+// translateID replaces the message ID in acknowledgements of packets sent by the client with the ID the client used
+func translateID(cp packets.ControlPacket, ids map[uint16]uint16) {
+	switch p := cp.(type) {
+	case *packets.PubackPacket:
+		p.MessageID = lookupID(ids, p.MessageID)
+	case *packets.PubrecPacket:
+		p.MessageID = lookupID(ids, p.MessageID)
+	case *packets.PubcompPacket:
+		p.MessageID = lookupID(ids, p.MessageID)
+	case *packets.SubackPacket:
+		p.MessageID = lookupID(ids, p.MessageID)
+	case *packets.UnsubackPacket:
+		p.MessageID = lookupID(ids, p.MessageID)
+	}
+}
+
+func lookupID(ids map[uint16]uint16, id uint16) uint16 {
+	if mapped, ok := ids[id]; ok {
+		return mapped
+	}
+	return id
+}
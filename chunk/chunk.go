@@ -0,0 +1,148 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package chunk splits large payloads into a sequence of smaller messages (for brokers that limit the packet
+// size) and reassembles them on receipt.
+//
+// A Sender publishes the content of an io.Reader to a topic as numbered chunks, each carrying a SHA-256 hash of
+// its data; the final chunk also carries the chunk count and a hash of the complete payload. If a transfer is
+// interrupted it can be resumed from the point of failure (see Sender.Resume).
+//
+// On the receiving side a Receiver wraps the handler passed to Subscribe/AddRoute; chunks are buffered (they may
+// arrive in any order) and, once all have been received and verified, the handler is called once with a Message
+// holding the complete payload. Messages that are not chunks are passed to the handler unchanged, so chunked and
+// normal publishers can share a topic.
+//
+//	s := chunk.NewSender(client)
+//	f, _ := os.Open("firmware.bin")
+//	transfer, err := s.Send(ctx, "devices/1/firmware", f)
+//
+//	r := chunk.NewReceiver()
+//	client.Subscribe("devices/+/firmware", 1, r.Handler(func(c mqtt.Client, m mqtt.Message) { ... }))
+package chunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// ID identifies a transfer
+type ID [16]byte
+
+func (id ID) String() string { return hex.EncodeToString(id[:]) }
+
+// Progress is passed to progress callbacks
+type Progress struct {
+	ID     ID
+	Topic  string
+	Chunks int   // Number of chunks sent/received so far
+	Bytes  int64 // Number of payload bytes sent/received so far
+	Total  int64 // Total payload size (-1 if not known)
+	Done   bool  // True once the transfer is complete
+}
+
+var (
+	ErrMalformed  = errors.New("malformed chunk")
+	ErrHash       = errors.New("chunk hash mismatch")
+	ErrIncomplete = errors.New("transfer incomplete")
+	ErrTooLarge   = errors.New("transfer exceeds maximum size")
+	ErrTooMany    = errors.New("transfer exceeds maximum number of chunks")
+	ErrBufferFull = errors.New("chunks buffered exceed maximum")
+)
+
+// Wire format (all integers big endian):
+//
+//	magic       4 bytes   0x00 'M' 'Q' 'C'
+//	version     1 byte    (1)
+//	flags       1 byte    flagFinal is set on the last chunk
+//	id          16 bytes
+//	seq         4 bytes   chunk number (from 0)
+//	size        8 bytes   total payload size (-1 if unknown when sent)
+//	hash        32 bytes  SHA-256 of the data in this chunk
+//	count       4 bytes   final chunk only: number of chunks in the transfer
+//	total hash  32 bytes  final chunk only: SHA-256 of the complete payload
+//	data        remaining bytes
+
+var magic = []byte{0x00, 'M', 'Q', 'C'}
+
+const (
+	version     = 1
+	flagFinal   = 0x01
+	headerLen   = 4 + 1 + 1 + 16 + 4 + 8 + sha256.Size
+	trailerLen  = 4 + sha256.Size // additional header on the final chunk
+	maxOverhead = headerLen + trailerLen
+)
+
+// header is a decoded chunk header
+type header struct {
+	final     bool
+	id        ID
+	seq       uint32
+	size      int64
+	hash      [sha256.Size]byte
+	count     uint32
+	totalHash [sha256.Size]byte
+}
+
+// IsChunk reports whether payload appears to be a chunk
+func IsChunk(payload []byte) bool {
+	return len(payload) >= headerLen && bytes.Equal(payload[:len(magic)], magic)
+}
+
+// encode returns the chunk holding data
+func encode(h *header, data []byte) []byte {
+	b := make([]byte, 0, maxOverhead+len(data))
+	b = append(b, magic...)
+	var flags byte
+	if h.final {
+		flags |= flagFinal
+	}
+	b = append(b, version, flags)
+	b = append(b, h.id[:]...)
+	b = binary.BigEndian.AppendUint32(b, h.seq)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.size))
+	b = append(b, h.hash[:]...)
+	if h.final {
+		b = binary.BigEndian.AppendUint32(b, h.count)
+		b = append(b, h.totalHash[:]...)
+	}
+	return append(b, data...)
+}
+
+// decode parses a chunk and verifies the hash of its data
+func decode(b []byte) (*header, []byte, error) {
+	if !IsChunk(b) || b[4] != version {
+		return nil, nil, ErrMalformed
+	}
+	h := &header{final: b[5]&flagFinal != 0}
+	copy(h.id[:], b[6:22])
+	h.seq = binary.BigEndian.Uint32(b[22:26])
+	h.size = int64(binary.BigEndian.Uint64(b[26:34]))
+	copy(h.hash[:], b[34:headerLen])
+	b = b[headerLen:]
+	if h.final {
+		if len(b) < trailerLen {
+			return nil, nil, ErrMalformed
+		}
+		h.count = binary.BigEndian.Uint32(b)
+		copy(h.totalHash[:], b[4:trailerLen])
+		b = b[trailerLen:]
+	}
+	if sha256.Sum256(b) != h.hash {
+		return nil, nil, ErrHash
+	}
+	return h, b, nil
+}
@@ -0,0 +1,219 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is a token that has already completed
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (t doneToken) Error() error                   { return t.err }
+
+// testMessage implements mqtt.Message
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+func (m *testMessage) Ack()            {}
+
+// testClient records published messages; Publish fails once failAfter messages have been published (if > 0)
+type testClient struct {
+	mqtt.Client
+	published [][]byte
+	failAfter int
+}
+
+func (c *testClient) Publish(_ string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	if c.failAfter > 0 && len(c.published) >= c.failAfter {
+		return doneToken{err: mqtt.ErrNotConnected}
+	}
+	c.published = append(c.published, payload.([]byte))
+	return doneToken{}
+}
+
+// collector gathers messages passed to a handler
+type collector struct {
+	mu   sync.Mutex
+	msgs []mqtt.Message
+	errs []error
+}
+
+func (c *collector) handler(_ mqtt.Client, m mqtt.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, m)
+}
+
+func (c *collector) onError(_ string, _ ID, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func deliver(h mqtt.MessageHandler, payloads [][]byte) {
+	for _, p := range payloads {
+		h(nil, &testMessage{topic: "t", payload: p})
+	}
+}
+
+func Test_SendReceive(t *testing.T) {
+	payload := make([]byte, 10000)
+	rand.Read(payload)
+
+	for _, size := range []int{0, 1, 1000, 10000} {
+		c := &testClient{}
+		s := NewSender(c)
+		s.ChunkSize = 1000
+		var progress []Progress
+		s.OnProgress = func(p Progress) { progress = append(progress, p) }
+		tr, err := s.SendBytes(context.Background(), "t", payload[:size])
+		if err != nil || !tr.Done {
+			t.Fatalf("%d: unexpected result %+v: %v", size, tr, err)
+		}
+		expected := max(1, (size+999)/1000)
+		if len(c.published) != expected || len(progress) != expected || !progress[expected-1].Done {
+			t.Fatalf("%d: expected %d chunks, got %d", size, expected, len(c.published))
+		}
+
+		// Deliver out of order with duplicates
+		chunks := append(append([][]byte{}, c.published...), c.published...)
+		mrand.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+		var col collector
+		r := NewReceiver()
+		r.OnError = col.onError
+		h := r.Handler(col.handler)
+		deliver(h, chunks)
+		h(nil, &testMessage{topic: "t", payload: []byte("not chunked")})
+		if len(col.msgs) != 2 || len(col.errs) != 0 {
+			t.Fatalf("%d: expected 2 messages, got %d (errors %v)", size, len(col.msgs), col.errs)
+		}
+		m, ok := col.msgs[0].(*Message)
+		if !ok || !bytes.Equal(m.Payload(), payload[:size]) || m.TransferID() != tr.ID {
+			t.Fatalf("%d: payload not reassembled", size)
+		}
+		if string(col.msgs[1].Payload()) != "not chunked" {
+			t.Fatalf("%d: unexpected message %q", size, col.msgs[1].Payload())
+		}
+	}
+}
+
+func Test_Resume(t *testing.T) {
+	payload := make([]byte, 5500)
+	rand.Read(payload)
+	c := &testClient{failAfter: 2}
+	s := NewSender(c)
+	s.ChunkSize = 1000
+	tr, err := s.Send(context.Background(), "t", bytes.NewReader(payload))
+	if !errors.Is(err, mqtt.ErrNotConnected) || tr.Next != 2 || tr.Offset != 2000 || tr.Done {
+		t.Fatalf("unexpected result %+v: %v", tr, err)
+	}
+
+	var col collector
+	h := NewReceiver().Handler(col.handler)
+	deliver(h, c.published)
+
+	c.failAfter = 0
+	r := bytes.NewReader(payload)
+	r.Seek(tr.Offset, io.SeekStart)
+	if err = s.Resume(context.Background(), tr, r); err != nil || !tr.Done {
+		t.Fatalf("unexpected result %+v: %v", tr, err)
+	}
+	deliver(h, c.published[2:])
+	if len(col.msgs) != 1 || !bytes.Equal(col.msgs[0].Payload(), payload) {
+		t.Fatalf("payload not reassembled after resume")
+	}
+}
+
+func Test_Errors(t *testing.T) {
+	c := &testClient{}
+	s := NewSender(c)
+	s.ChunkSize = 100
+	if _, err := s.SendBytes(context.Background(), "t", make([]byte, 350)); err != nil {
+		t.Fatal(err)
+	}
+
+	var col collector
+	r := &Receiver{Timeout: 20 * time.Millisecond, MaxSize: 1000, OnError: col.onError}
+	h := r.Handler(col.handler)
+
+	// Corrupt chunk
+	bad := bytes.Clone(c.published[0])
+	bad[len(bad)-1] ^= 1
+	deliver(h, [][]byte{bad})
+	// Incomplete transfer
+	deliver(h, c.published[:3])
+	time.Sleep(100 * time.Millisecond)
+
+	// Too large
+	r = &Receiver{MaxSize: 200, OnError: col.onError}
+	deliver(r.Handler(col.handler), c.published)
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if len(col.msgs) != 0 || len(col.errs) != 3 || !errors.Is(col.errs[0], ErrHash) ||
+		!errors.Is(col.errs[1], ErrIncomplete) || !errors.Is(col.errs[2], ErrTooLarge) {
+		t.Fatalf("unexpected errors %v (%d messages)", col.errs, len(col.msgs))
+	}
+}
+
+func Test_Limits(t *testing.T) {
+	c := &testClient{}
+	s := NewSender(c)
+	s.ChunkSize = 100
+	for range 3 {
+		if _, err := s.SendBytes(context.Background(), "t", make([]byte, 350)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, d := c.published[0:4], c.published[4:8], c.published[8:12]
+
+	// Too many chunks
+	var col collector
+	r := &Receiver{MaxChunks: 3, OnError: col.onError}
+	deliver(r.Handler(col.handler), a)
+	if len(col.msgs) != 0 || len(col.errs) != 1 || !errors.Is(col.errs[0], ErrTooMany) {
+		t.Fatalf("unexpected errors %v (%d messages)", col.errs, len(col.msgs))
+	}
+
+	// Too much buffered across transfers; space is released when transfers complete or are rejected
+	col = collector{}
+	r = &Receiver{MaxBytes: 500, OnError: col.onError}
+	h := r.Handler(col.handler)
+	deliver(h, a[:3])
+	deliver(h, b)
+	deliver(h, a[3:])
+	deliver(h, d)
+	if len(col.msgs) != 2 || len(col.errs) != 1 || !errors.Is(col.errs[0], ErrBufferFull) {
+		t.Fatalf("unexpected errors %v (%d messages)", col.errs, len(col.msgs))
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package chunk
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	DefaultTimeout   = time.Minute // Default Receiver.Timeout
+	DefaultMaxSize   = 256 << 20   // Default Receiver.MaxSize
+	DefaultMaxChunks = 1 << 16     // Default Receiver.MaxChunks
+	DefaultMaxBytes  = 512 << 20   // Default Receiver.MaxBytes
+)
+
+// Receiver reassembles chunked payloads (see Handler)
+type Receiver struct {
+	// The fields below should not be changed once the Receiver is in use
+	Timeout    time.Duration                        // Incomplete transfers are discarded if no chunk is received for this long
+	MaxSize    int64                                // Transfers larger than this are discarded
+	MaxChunks  int                                  // Transfers with more chunks than this are discarded
+	MaxBytes   int64                                // Limit on the data buffered for all incomplete transfers (per Handler)
+	OnProgress func(Progress)                       // If not nil, called when each chunk is received
+	OnError    func(topic string, id ID, err error) // If not nil, called when a chunk or transfer is discarded
+}
+
+// NewReceiver creates a Receiver with the default settings
+func NewReceiver() *Receiver {
+	return &Receiver{Timeout: DefaultTimeout, MaxSize: DefaultMaxSize, MaxChunks: DefaultMaxChunks, MaxBytes: DefaultMaxBytes}
+}
+
+// Message is passed to the handler when a transfer completes; its Payload is the complete, verified, payload. The
+// other properties (QoS etc.) are those of the final chunk.
+type Message struct {
+	mqtt.Message
+	payload []byte
+	id      ID
+}
+
+// Payload returns the reassembled payload
+func (m *Message) Payload() []byte { return m.payload }
+
+// Unwrap returns the message as received (allowing mqtt.Params etc. to access it)
+func (m *Message) Unwrap() mqtt.Message { return m.Message }
+
+// TransferID returns the ID of the transfer
+func (m *Message) TransferID() ID { return m.id }
+
+// Handler returns a MessageHandler (for use with Subscribe, AddRoute etc.) that reassembles chunks and calls h with
+// each complete payload. Messages that are not chunks are passed to h unchanged. Each call to Handler returns a
+// handler with its own state, so should be used for a single subscription.
+//
+// Chunks are acknowledged once buffered; the transfer is kept until Timeout expires with no chunk received, so a
+// sender has this long to Resume an interrupted transfer. Chunks that are received more than once (e.g. due to
+// QoS 1 redelivery or a resumed transfer) are ignored. As the sender is not trusted, a transfer is discarded if it
+// exceeds MaxSize or MaxChunks, or if buffering a chunk would take the data held for all incomplete transfers over
+// MaxBytes.
+func (r *Receiver) Handler(h mqtt.MessageHandler) mqtt.MessageHandler {
+	a := &assembler{r: r, h: h, transfers: make(map[ID]*transfer), done: make(map[ID]time.Time)}
+	return a.handle
+}
+
+// transfer holds the chunks received for an incomplete transfer
+type transfer struct {
+	topic  string
+	chunks map[uint32][]byte
+	bytes  int64
+	size   int64
+	final  *header
+	timer  *time.Timer
+}
+
+// assembler holds the state for a handler returned by Receiver.Handler
+type assembler struct {
+	r *Receiver
+	h mqtt.MessageHandler
+
+	mu        sync.Mutex
+	transfers map[ID]*transfer
+	buffered  int64            // Bytes held for all transfers
+	done      map[ID]time.Time // Recently completed/rejected transfers (so further chunks can be ignored)
+}
+
+// handle processes a received message
+func (a *assembler) handle(client mqtt.Client, msg mqtt.Message) {
+	if !IsChunk(msg.Payload()) {
+		a.h(client, msg)
+		return
+	}
+	hdr, data, err := decode(msg.Payload())
+	if err != nil {
+		a.error(msg.Topic(), ID{}, err)
+		return
+	}
+	payload, progress, err := a.add(msg.Topic(), hdr, data)
+	if err != nil {
+		a.error(msg.Topic(), hdr.id, err)
+		return
+	}
+	if progress != nil && a.r.OnProgress != nil {
+		a.r.OnProgress(*progress)
+	}
+	if payload == nil {
+		msg.Ack() // Only the final chunk is passed to the handler (so acknowledgement may be deferred)
+		return
+	}
+	a.h(client, &Message{Message: msg, payload: payload, id: hdr.id})
+}
+
+// add stores a chunk; if the transfer is complete the payload is returned
+func (a *assembler) add(topic string, hdr *header, data []byte) ([]byte, *Progress, error) {
+	timeout := a.r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	maxSize := a.r.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	maxChunks := a.r.MaxChunks
+	if maxChunks <= 0 {
+		maxChunks = DefaultMaxChunks
+	}
+	maxBytes := a.r.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, exp := range a.done {
+		if now.After(exp) {
+			delete(a.done, id)
+		}
+	}
+	if _, ok := a.done[hdr.id]; ok {
+		return nil, nil, nil // Chunk from a completed (or rejected) transfer
+	}
+	t, ok := a.transfers[hdr.id]
+	if !ok {
+		t = &transfer{topic: topic, chunks: make(map[uint32][]byte), size: hdr.size}
+		id := hdr.id
+		t.timer = time.AfterFunc(timeout, func() { a.expire(id, t) })
+		a.transfers[hdr.id] = t
+	}
+	if _, dup := t.chunks[hdr.seq]; dup {
+		return nil, nil, nil
+	}
+	t.timer.Reset(timeout)
+	reject := func(err error) ([]byte, *Progress, error) {
+		a.discard(hdr.id, t)
+		a.done[hdr.id] = now.Add(timeout) // Ignore any further chunks
+		return nil, nil, err
+	}
+	switch {
+	case t.bytes+int64(len(data)) > maxSize || t.size > maxSize:
+		return reject(fmt.Errorf("%w (%d bytes)", ErrTooLarge, maxSize))
+	case hdr.seq >= uint32(maxChunks) || hdr.final && hdr.count > uint32(maxChunks):
+		return reject(fmt.Errorf("%w (%d)", ErrTooMany, maxChunks))
+	case a.buffered+int64(len(data)) > maxBytes:
+		return reject(fmt.Errorf("%w (%d bytes)", ErrBufferFull, maxBytes))
+	}
+	t.chunks[hdr.seq] = append([]byte(nil), data...) // The message payload may not be retained
+	t.bytes += int64(len(data))
+	a.buffered += int64(len(data))
+	if hdr.final {
+		t.final = hdr
+	}
+	p := &Progress{ID: hdr.id, Topic: t.topic, Chunks: len(t.chunks), Bytes: t.bytes, Total: t.size}
+	if t.final == nil || uint32(len(t.chunks)) < t.final.count {
+		return nil, p, nil
+	}
+
+	// All chunks have been received
+	a.discard(hdr.id, t)
+	a.done[hdr.id] = now.Add(timeout)
+	payload := make([]byte, 0, t.bytes)
+	for i := uint32(0); i < t.final.count; i++ {
+		c, ok := t.chunks[i]
+		if !ok {
+			return nil, nil, ErrMalformed // More chunks than the final chunk claims
+		}
+		payload = append(payload, c...)
+	}
+	if sha256.Sum256(payload) != t.final.totalHash {
+		return nil, nil, ErrHash
+	}
+	p.Done, p.Total = true, int64(len(payload))
+	return payload, p, nil
+}
+
+// discard removes a transfer (a.mu must be held)
+func (a *assembler) discard(id ID, t *transfer) {
+	t.timer.Stop()
+	delete(a.transfers, id)
+	a.buffered -= t.bytes
+}
+
+// expire is called when no chunk has been received for Timeout
+func (a *assembler) expire(id ID, t *transfer) {
+	a.mu.Lock()
+	if a.transfers[id] != t {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.transfers, id)
+	a.buffered -= t.bytes
+	a.mu.Unlock()
+	a.error(t.topic, id, fmt.Errorf("%w: received %d chunks (%d bytes)", ErrIncomplete, len(t.chunks), t.bytes))
+}
+
+// error reports an error via OnError (if set)
+func (a *assembler) error(topic string, id ID, err error) {
+	if a.r.OnError != nil {
+		a.r.OnError(topic, id, err)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultChunkSize is the default Sender.ChunkSize; each chunk adds up to 106 bytes of header
+const DefaultChunkSize = 64 * 1024
+
+// Transfer holds the state of a transfer; if Send fails it can be passed to Resume to continue from the first chunk
+// that was not sent. All fields are exported so the state may be persisted (e.g. as JSON).
+type Transfer struct {
+	ID        ID
+	Topic     string
+	Size      int64  // Total payload size (-1 if unknown)
+	Next      uint32 // The next chunk to send
+	Offset    int64  // Number of payload bytes sent
+	HashState []byte // State of the payload hash after Offset bytes
+	Done      bool   // True once all chunks have been sent
+}
+
+// Sender publishes payloads as chunks
+type Sender struct {
+	// The fields below may be changed prior to sending
+	ChunkSize  int            // Maximum payload bytes in each chunk
+	QoS        byte           // QoS used when publishing chunks (defaults to 1)
+	OnProgress func(Progress) // If not nil, called after each chunk is published
+
+	client mqtt.Client
+}
+
+// NewSender creates a Sender that publishes via client (which must be connected)
+func NewSender(client mqtt.Client) *Sender {
+	return &Sender{ChunkSize: DefaultChunkSize, QoS: 1, client: client}
+}
+
+// Send publishes the content of r (until EOF) to topic. Chunks are published in order, waiting for each publish
+// to complete before sending the next. The returned Transfer is never nil; if an error is returned it can be
+// passed to Resume.
+func (s *Sender) Send(ctx context.Context, topic string, r io.Reader) (*Transfer, error) {
+	t := &Transfer{Topic: topic, Size: -1}
+	if _, err := rand.Read(t.ID[:]); err != nil {
+		return t, err
+	}
+	if l, ok := r.(interface{ Len() int }); ok {
+		t.Size = int64(l.Len())
+	}
+	return t, s.send(ctx, t, r, sha256.New())
+}
+
+// SendBytes publishes b to topic (see Send)
+func (s *Sender) SendBytes(ctx context.Context, topic string, b []byte) (*Transfer, error) {
+	return s.Send(ctx, topic, bytes.NewReader(b))
+}
+
+// Resume continues a transfer that was interrupted; r must supply the remainder of the payload (i.e. be
+// positioned at t.Offset). t is updated as chunks are sent. The receiver will only complete the transfer if
+// Resume is called before its Timeout expires.
+func (s *Sender) Resume(ctx context.Context, t *Transfer, r io.Reader) error {
+	if t.Done {
+		return nil
+	}
+	h := sha256.New()
+	if len(t.HashState) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(t.HashState); err != nil {
+			return fmt.Errorf("invalid transfer state: %w", err)
+		}
+	}
+	return s.send(ctx, t, r, h)
+}
+
+// send publishes chunks from r, updating t as it goes
+func (s *Sender) send(ctx context.Context, t *Transfer, r io.Reader, h hash.Hash) error {
+	size := s.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	// Reading one chunk ahead allows the last chunk to be identified
+	cur, next := make([]byte, size), make([]byte, size)
+	n, err := readChunk(r, cur)
+	if err != nil {
+		return err
+	}
+	for {
+		var m int
+		if n == size {
+			if m, err = readChunk(r, next); err != nil {
+				return err
+			}
+		}
+		data := cur[:n]
+		hdr := header{final: m == 0, id: t.ID, seq: t.Next, size: t.Size, hash: sha256.Sum256(data)}
+		h.Write(data)
+		if hdr.final {
+			hdr.count = t.Next + 1
+			copy(hdr.totalHash[:], h.Sum(nil))
+		}
+		if err = waitToken(ctx, s.client.Publish(t.Topic, s.QoS, false, encode(&hdr, data))); err != nil {
+			return err // t is unchanged so the chunk will be resent by Resume
+		}
+		t.Next++
+		t.Offset += int64(n)
+		if t.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			return err
+		}
+		t.Done = hdr.final
+		if s.OnProgress != nil {
+			s.OnProgress(Progress{ID: t.ID, Topic: t.Topic, Chunks: int(t.Next), Bytes: t.Offset, Total: t.Size, Done: t.Done})
+		}
+		if t.Done {
+			return nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+// readChunk fills buf from r returning the number of bytes read (which will only be less than len(buf) at EOF)
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// waitToken waits for the token to complete (or ctx to be done)
+func waitToken(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -27,8 +27,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,6 +64,9 @@ import (
 // and then supplying a ClientOptions type.
 // Implementations of Client must be safe for concurrent use by multiple
 // goroutines
+//
+// The Client returned by NewClient also implements StateWatcher, SubscriptionLister,
+// RouteLister and RateLimitReporter (use a type assertion to access these).
 type Client interface {
 	// IsConnected returns a bool signifying whether
 	// the client is connected or not.
@@ -78,11 +83,18 @@ type Client interface {
 	// completed. Disconnect can be safely called regardless of connection status.
 	Disconnect(quiesce uint)
 	// Publish will publish a message with the specified QoS and content
-	// to the specified topic.
+	// to the specified topic. The payload may be a string, []byte, bytes.Buffer or *PooledPayload.
 	// Returns a token to track delivery of the message to the broker
 	Publish(topic string, qos byte, retained bool, payload interface{}) Token
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler.
+	// If the broker rejects the subscription the token will return a *SubscriptionError
+	// (and the route for the topic will be removed).
+	// If route patterns are enabled (see SetRoutePatterns) the topic may contain named parameters, e.g.
+	// "devices/{id}/telemetry/{rest...}", in which case the parameter values are available to the handler via Params.
+	// Routes are keyed by the full filter, so a shared subscription (e.g. "$share/g/a") and a normal subscription to
+	// the same filter ("a") have separate handlers; as the broker sends a copy of a matching message for each
+	// subscription, and each handler is called for every copy, both handlers will see such messages twice.
 	//
 	// If options.OrderMatters is true (the default) then callback must not block or
 	// call functions within this package that may block (e.g. Publish) other than in
@@ -91,7 +103,8 @@ type Client interface {
 	Subscribe(topic string, qos byte, callback MessageHandler) Token
 	// SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 	// be executed when a message is published on one of the topics provided, or nil for the
-	// default handler.
+	// default handler. If the broker rejects any of the subscriptions the token will return an
+	// error wrapping a *SubscriptionError for each (use errors.As/errors.Is to check).
 	//
 	// If options.OrderMatters is true (the default) then callback must not block or
 	// call functions within this package that may block (e.g. Publish) other than in
@@ -117,6 +130,13 @@ type Client interface {
 	OptionsReader() ClientOptionsReader
 }
 
+var (
+	_ StateWatcher       = (*client)(nil)
+	_ SubscriptionLister = (*client)(nil)
+	_ RouteLister        = (*client)(nil)
+	_ RateLimitReporter  = (*client)(nil)
+)
+
 // client implements the Client interface
 // clients are safe for concurrent use by multiple
 // goroutines
@@ -125,10 +145,16 @@ type client struct {
 	lastReceived    atomic.Value // time.Time - the last time a packet was successfully received from network
 	pingOutstanding int32        // set to 1 if a ping has been sent but response not ret received
 
-	status connectionStatus // see constants in status.go for values
+	status        connectionStatus // see constants in status.go for values
+	stateNotifier stateNotifier    // delivers status changes to WatchState
+	lostCause     atomic.Value     // *error - reported by whichever call to internalConnLost handles the loss (see gracefulReconnect)
 
 	messageIds // effectively a map from message id to token completor
 
+	subscriptions subscriptionRegistry // subscriptions requested by the user
+	outbound      PublishFunc          // publish wrapped in any outbound middleware
+	rateLimiter   *rateLimiter         // nil if no rate limits are set
+
 	obound    chan *PacketAndToken // outgoing publish packet
 	oboundP   chan *PacketAndToken // outgoing 'priority' packet (anything other than publish)
 	msgRouter *router              // routes topics to handlers
@@ -136,8 +162,10 @@ type client struct {
 	options   ClientOptions
 	optionsMu sync.Mutex // Protects the options in a few limited cases where needed for testing
 
-	conn   net.Conn   // the network connection, must only be set with connMu locked (only used when starting/stopping workers)
-	connMu sync.Mutex // mutex for the connection (again only used in two functions)
+	conn           net.Conn   // the network connection, must only be set with connMu locked (only used when starting/stopping workers)
+	connMu         sync.Mutex // mutex for the connection (again only used in two functions)
+	connGeneration uint64     // incremented for each connection (connMu must be held); see MessageMetadata
+	connBroker     *url.URL   // broker connected to (connMu must be held)
 
 	stop         chan struct{}  // Closed to request that workers stop
 	workers      sync.WaitGroup // used to wait for workers to complete (ping, keepalive, errwatch, resume)
@@ -173,10 +201,17 @@ func NewClient(o *ClientOptions) Client {
 	c.persist = c.options.Store
 	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor), logger: c.logger}
 	c.msgRouter = newRouter(c.logger)
+	c.msgRouter.patterns = c.options.RoutePatterns
+	if len(c.options.InboundMiddleware) > 0 {
+		c.msgRouter.setMiddleware(c.wrapInbound)
+	}
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
 	c.obound = make(chan *PacketAndToken)
 	c.oboundP = make(chan *PacketAndToken)
 	c.backoff = newBackoffController()
+	c.status.onChange = c.stateNotifier.changed
+	c.outbound = buildOutbound(c.publish, c.options.OutboundMiddleware)
+	c.rateLimiter = newRateLimiter(&c.options)
 	return c
 }
 
@@ -189,6 +224,9 @@ func NewClient(o *ClientOptions) Client {
 // a new go routine.
 // callback must be safe for concurrent use by multiple goroutines.
 func (c *client) AddRoute(topic string, callback MessageHandler) {
+	if _, _, err := c.msgRouter.parsePattern(topic); err != nil {
+		c.logger.Warn("invalid route pattern; treated as a topic filter", slog.String("topic", topic), slog.String("component", string(CLI)))
+	}
 	if callback != nil {
 		c.msgRouter.addRoute(topic, callback)
 	}
@@ -235,6 +273,7 @@ func (c *client) Connect() Token {
 	t := newToken(packets.Connect).(*ConnectToken)
 	c.logger.Debug("Connect()", slog.String("component", string(CLI)))
 
+	c.stateNotifier.setCause(nil)
 	connectionUp, err := c.status.Connecting()
 	if err != nil {
 		if err == errAlreadyConnectedOrReconnecting && c.options.AutoReconnect {
@@ -259,6 +298,7 @@ func (c *client) Connect() Token {
 	go func() {
 		if len(c.options.Servers) == 0 {
 			t.setError(fmt.Errorf("no servers defined to connect to"))
+			c.stateNotifier.setCause(t.Error())
 			if err := connectionUp(false); err != nil {
 				c.logger.Error(err.Error(), slog.String("component", string(CLI)))
 			}
@@ -292,11 +332,16 @@ func (c *client) Connect() Token {
 			c.persist.Close()
 			t.returnCode = rc
 			t.setError(err)
+			c.stateNotifier.setCause(err)
 			if err := connectionUp(false); err != nil {
 				c.logger.Error("Connect() failed", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 			}
 			return
 		}
+		var resubs []*subscriptionEntry // Captured now so subscriptions made in OnConnect are not duplicated
+		if c.options.AutoResubscribe && !t.sessionPresent {
+			resubs = c.subscriptions.entries()
+		}
 		inboundFromStore := make(chan packets.ControlPacket)           // there may be some inbound comms packets in the store that are awaiting processing
 		if c.startCommsWorkers(conn, connectionUp, inboundFromStore) { // note that this takes care of updating the status (to connected or disconnected)
 			// Take care of any messages in the store
@@ -305,6 +350,9 @@ func (c *client) Connect() Token {
 			} else {
 				c.persist.Reset()
 			}
+			if len(resubs) > 0 {
+				c.startWorker(func(stop <-chan struct{}) { c.resubscribe(resubs, stop) })
+			}
 		} else { // Note: With the new status subsystem this should only happen if Disconnect called simultaneously with the above
 			c.logger.Info("Connect() called but connection established in another goroutine", slog.String("component", string(CLI)))
 		}
@@ -322,8 +370,9 @@ func (c *client) reconnect(connectionUp connCompletedFn) {
 	c.logger.Debug("enter reconnect", slog.String("component", string(CLI)))
 
 	var (
-		initSleep = 1 * time.Second
-		conn      net.Conn
+		initSleep      = 1 * time.Second
+		conn           net.Conn
+		sessionPresent bool
 	)
 
 	// If the reason of connection lost is same as the before one, sleep timer is set before attempting connection is started.
@@ -338,7 +387,7 @@ func (c *client) reconnect(connectionUp connCompletedFn) {
 			c.options.OnReconnecting(c, &c.options)
 		}
 		var err error
-		conn, _, _, err = c.attemptConnection(true, attemptCount)
+		conn, _, sessionPresent, err = c.attemptConnection(true, attemptCount)
 		if err == nil {
 			break
 		}
@@ -355,9 +404,16 @@ func (c *client) reconnect(connectionUp connCompletedFn) {
 		}
 	}
 
+	var resubs []*subscriptionEntry // Captured now so subscriptions made in OnConnect are not duplicated
+	if c.options.AutoResubscribe && !sessionPresent {
+		resubs = c.subscriptions.entries()
+	}
 	inboundFromStore := make(chan packets.ControlPacket)           // there may be some inbound comms packets in the store that are awaiting processing
 	if c.startCommsWorkers(conn, connectionUp, inboundFromStore) { // note that this takes care of updating the status (to connected or disconnected)
 		c.resume(c.options.ResumeSubs, inboundFromStore)
+		if len(resubs) > 0 {
+			c.startWorker(func(stop <-chan struct{}) { c.resubscribe(resubs, stop) })
+		}
 	}
 	close(inboundFromStore)
 }
@@ -389,12 +445,21 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 	for _, broker := range brokers {
 		cm := newConnectMsgFromOptions(&c.options, broker)
 		c.logger.Debug("about to write new connect msg", slog.String("component", string(CLI)))
+		c.stateNotifier.setBroker(broker)
 	CONN:
 		tlsCfg := c.options.TLSConfig
+		if c.options.TLSReloader != nil {
+			tlsCfg = c.options.TLSReloader.TLSConfig(tlsCfg)
+		}
+		if c.options.TLSVerifier != nil {
+			tlsCfg = c.options.TLSVerifier.TLSConfig(tlsCfg)
+		}
+		tlsProfile := c.options.brokerTLSProfile(broker)
+		tlsCfg = tlsProfile.apply(tlsCfg)
 		if c.options.OnConnectAttempt != nil {
 			c.logger.Debug("using custom onConnectAttempt handler", slog.String("component", string(CLI)))
 
-			tlsCfg = c.options.OnConnectAttempt(broker, c.options.TLSConfig)
+			tlsCfg = c.options.OnConnectAttempt(broker, tlsCfg)
 		}
 		if c.options.OnConnectionNotification != nil {
 			c.options.OnConnectionNotification(c, ConnectionNotificationBroker{broker})
@@ -409,7 +474,14 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 		if c.options.CustomOpenConnectionFn != nil {
 			conn, err = c.options.CustomOpenConnectionFn(broker, c.options)
 		} else {
-			conn, err = openConnection(broker, tlsCfg, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, dialer)
+			var proxyDial dialContextFunc
+			if proxyDial, err = c.options.brokerProxyDialer(broker, dialer); err == nil {
+				var alpn []string
+				if tlsProfile != nil {
+					alpn = tlsProfile.ALPN
+				}
+				conn, err = openConnection(broker, tlsCfg, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, dialer, proxyDial, alpn)
+			}
 		}
 		if err != nil {
 			c.logger.Error("Failed to connect to broker", slog.String("error", err.Error()), slog.String("component", string(CLI)))
@@ -421,6 +493,9 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 			continue
 		}
 		c.logger.Debug("socket connected to broker", slog.String("component", string(CLI)))
+		if tap := c.options.PacketTap; tap != nil {
+			conn = newTapConn(conn, tap) // Installed before the handshake so CONNECT/CONNACK are captured
+		}
 
 		// Now we perform the MQTT connection handshake ensuring that it does not exceed the timeout
 		if err := conn.SetDeadline(connDeadline); err != nil {
@@ -482,6 +557,7 @@ func (c *client) Disconnect(quiesce uint) {
 	done := make(chan struct{}) // Simplest way to ensure quiesce is always honoured
 	go func() {
 		defer close(done)
+		c.stateNotifier.setCause(ErrDisconnectRequested)
 		disDone, err := c.status.Disconnecting()
 		if err != nil {
 			// Status has been set to disconnecting, but we had to wait for something else to complete
@@ -555,7 +631,14 @@ func (c *client) internalConnLost(whyConnLost error) {
 	// (including after sending a DisconnectPacket) as such we only do cleanup etc if the
 	// routines were actually running and are not being disconnected at users request
 	c.logger.Debug("internalConnLost called", slog.String("component", string(CLI)))
-	disDone, err := c.status.ConnectionLost(c.options.AutoReconnect && c.status.ConnectionStatus() > connecting)
+	// The cause is recorded with the status lock held, and only by the call that handles the loss, so a concurrent
+	// call (e.g. the broker closing the connection following gracefulReconnect) cannot replace it
+	disDone, err := c.status.connectionLost(c.options.AutoReconnect && c.status.ConnectionStatus() > connecting, func() {
+		if p, _ := c.lostCause.Swap((*error)(nil)).(*error); p != nil {
+			whyConnLost = *p
+		}
+		c.stateNotifier.setCause(whyConnLost)
+	})
 	if err != nil {
 		if err == errConnLossWhileDisconnecting || err == errAlreadyHandlingConnectionLoss {
 			return // Loss of connection is expected or already being handled
@@ -612,6 +695,32 @@ func (c *client) internalConnLost(whyConnLost error) {
 	}()
 }
 
+// stopChan returns the channel that will be closed when the current connection is closed (nil if not connected)
+func (c *client) stopChan() <-chan struct{} {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.stop
+}
+
+// startWorker runs f in a new goroutine tracked by c.workers (so stopCommsWorkers waits for it to exit), passing the
+// channel that is closed when the connection is closed. Returns false (and does not run f) if not connected.
+func (c *client) startWorker(f func(stop <-chan struct{})) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil { // stopCommsWorkers may already be waiting for the workers
+		return false
+	}
+	c.workers.Add(1)
+	go func(stop <-chan struct{}) {
+		defer c.workers.Done()
+		f(stop)
+	}(c.stop)
+	return true
+}
+
 // startCommsWorkers is called when the connection is up.
 // It starts off the routines needed to process incoming and outgoing messages.
 // Returns true if the comms workers were started (i.e. successful connection)
@@ -629,6 +738,8 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		return false
 	}
 	c.conn = conn // Store the connection
+	c.connGeneration++
+	c.connBroker = c.stateNotifier.currentBroker()
 
 	c.stop = make(chan struct{})
 	if c.options.KeepAlive != 0 {
@@ -638,6 +749,10 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		c.workers.Add(1)
 		go keepalive(c, conn)
 	}
+	if r := c.options.TLSReloader; r != nil && r.RenewBefore > 0 && c.options.AutoReconnect {
+		c.workers.Add(1)
+		go tlsRenewal(c, r)
+	}
 
 	// matchAndDispatch will process messages received from the network. It may generate acknowledgements
 	// It will complete when incomingPubChan is closed and will close ackOut prior to exiting
@@ -793,6 +908,11 @@ func (c *client) stopCommsWorkers() chan struct{} {
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return c.outbound(topic, qos, retained, payload)
+}
+
+// publish implements Publish (it is called after any outbound middleware)
+func (c *client) publish(topic string, qos byte, retained bool, payload interface{}) Token {
 	token := newToken(packets.Publish).(*PublishToken)
 	c.logger.Debug("enter Publish", slog.String("component", string(CLI)))
 	switch {
@@ -815,11 +935,21 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		pub.Payload = p
 	case bytes.Buffer:
 		pub.Payload = p.Bytes()
+	case *PooledPayload:
+		pub.Payload = p.Bytes()
+		token.pooled = p
 	default:
 		token.setError(fmt.Errorf("unknown payload type"))
 		return token
 	}
 
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.wait(topic, len(pub.Payload), c.options.WriteTimeout, c.stopChan()); err != nil {
+			token.setError(err)
+			return token
+		}
+	}
+
 	if pub.Qos != 0 && pub.MessageID == 0 {
 		mID := c.getID(token)
 		if mID == 0 {
@@ -883,24 +1013,22 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if err := validateTopicAndQos(topic, qos); err != nil {
+	filter, _, err := c.msgRouter.parsePattern(topic)
+	if err == nil {
+		err = validateTopicAndQos(filter, qos)
+	}
+	if err != nil {
 		token.setError(err)
 		return token
 	}
-	sub.Topics = append(sub.Topics, topic)
+	sub.Topics = append(sub.Topics, filter)
 	sub.Qoss = append(sub.Qoss, qos)
 
-	if strings.HasPrefix(topic, "$share/") {
-		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
-	}
-
-	topic = strings.TrimPrefix(topic, "$queue/")
-
 	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+		c.msgRouter.addRoute(topic, callback) // The route retains any shared subscription prefix
 	}
 
-	token.subs = append(token.subs, topic)
+	token.subs = append(token.subs, filter)
 
 	if sub.MessageID == 0 {
 		mID := c.getID(token)
@@ -916,6 +1044,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 	if c.options.ResumeSubs { // Only persist if we need this to resume subs after a disconnection
 		persistOutbound(c.persist, sub, c.logger)
 	}
+	c.trackSubscribe(token, sub.Topics, sub.Qoss, callback != nil)
 	switch c.status.ConnectionStatus() {
 	case connecting:
 		c.logger.Debug("storing subscribe message (connecting)", slog.String("topic", topic), slog.String("component", string(CLI)))
@@ -967,7 +1096,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
+	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters, c.msgRouter.parsePattern); err != nil {
 		token.setError(err)
 		return token
 	}
@@ -992,6 +1121,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 	if c.options.ResumeSubs { // Only persist if we need this to resume subs after a disconnection
 		persistOutbound(c.persist, sub, c.logger)
 	}
+	c.trackSubscribe(token, sub.Topics, sub.Qoss, callback != nil)
 	switch c.status.ConnectionStatus() {
 	case connecting:
 		c.logger.Debug("storing subscribe message (connecting)", slog.String("topics", strings.Join(sub.Topics, ",")), slog.String("component", string(CLI)))
@@ -1200,7 +1330,10 @@ func (c *client) Unsubscribe(topics ...string) Token {
 	}
 	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
 	unsub.Topics = make([]string, len(topics))
-	copy(unsub.Topics, topics)
+	for i, topic := range topics {
+		unsub.Topics[i] = c.msgRouter.routeFilter(topic)
+	}
+	c.subscriptions.remove(unsub.Topics...)
 
 	if unsub.MessageID == 0 {
 		mID := c.getID(token)
@@ -1283,9 +1416,21 @@ func (c *client) persistOutbound(m packets.ControlPacket) {
 
 // persistInbound adds the packet to the inbound store
 func (c *client) persistInbound(m packets.ControlPacket) {
+	if p, ok := m.(*packets.PublishPacket); ok && c.options.PooledPayloads && p.Qos > 0 {
+		m = p.Copy() // The payload may be released (returned to the pool) before the packet is removed from the store
+	}
 	persistInbound(c.persist, m, c.logger)
 }
 
+// newReader creates the reader used to read packets from the connection
+func (c *client) newReader(r io.Reader) *packets.Reader {
+	reader := packets.NewReader(r)
+	reader.PooledPayloads = c.options.PooledPayloads
+	reader.MaxPacketSize = c.options.MaxInboundPacketSize
+	reader.Strict = c.options.StrictProtocol
+	return reader
+}
+
 // pingRespReceived will be called by the network routines when a ping response is received
 func (c *client) pingRespReceived() {
 	atomic.StoreInt32(&c.pingOutstanding, 0)
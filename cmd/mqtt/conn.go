@@ -0,0 +1,218 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	errUsage = errors.New("invalid usage")
+	errFlags = fmt.Errorf("%w (flags)", errUsage) // flag package has already reported the problem
+)
+
+// usageError returns an error indicating that the command line is invalid
+func usageError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, args...))
+}
+
+// parseFlags parses args, returning errFlags (or flag.ErrHelp) on failure
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errFlags
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected argument %q", fs.Arg(0))
+	}
+	return nil
+}
+
+// connFlags holds the flags common to all commands that determine how the connection is established
+type connFlags struct {
+	broker         string
+	clientID       string
+	username       string
+	password       string
+	clean          bool
+	keepAlive      time.Duration
+	connectTimeout time.Duration
+
+	caFile     string
+	certFile   string
+	keyFile    string
+	insecure   bool
+	serverName string
+
+	willTopic   string
+	willPayload string
+	willQoS     int
+	willRetain  bool
+
+	debug bool
+}
+
+// register adds the connection flags to fs
+func (c *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.broker, "broker", "tcp://127.0.0.1:1883", "broker URL (schemes: tcp, ssl, tls, ws, wss, unix)")
+	fs.StringVar(&c.clientID, "id", "", "client ID (default: mqtt- followed by random characters)")
+	fs.StringVar(&c.username, "username", "", "username")
+	fs.StringVar(&c.password, "password", "", "password (default: $MQTT_PASSWORD)")
+	fs.BoolVar(&c.clean, "clean", true, "start a clean session (use -clean=false to resume a persistent session)")
+	fs.DurationVar(&c.keepAlive, "keepalive", 30*time.Second, "keepalive interval")
+	fs.DurationVar(&c.connectTimeout, "connect-timeout", 10*time.Second, "time to wait for the connection to be established")
+
+	fs.StringVar(&c.caFile, "cafile", "", "PEM file holding the CA certificates used to verify the broker (default: system roots)")
+	fs.StringVar(&c.certFile, "cert", "", "PEM file holding the client certificate (mutual TLS)")
+	fs.StringVar(&c.keyFile, "key", "", "PEM file holding the client private key (mutual TLS)")
+	fs.BoolVar(&c.insecure, "insecure", false, "do not verify the broker certificate")
+	fs.StringVar(&c.serverName, "servername", "", "server name used to verify the broker certificate (default: host from -broker)")
+
+	fs.StringVar(&c.willTopic, "will-topic", "", "topic of the will message (no will if empty)")
+	fs.StringVar(&c.willPayload, "will-payload", "", "payload of the will message")
+	fs.IntVar(&c.willQoS, "will-qos", 0, "QoS of the will message")
+	fs.BoolVar(&c.willRetain, "will-retain", false, "retain the will message")
+
+	fs.BoolVar(&c.debug, "debug", false, "log client debug information to stderr")
+}
+
+// options returns the client options specified by the flags
+func (c *connFlags) options() (*mqtt.ClientOptions, error) {
+	u, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, usageError("invalid -broker: %v", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "unix", "ssl", "tls", "tcps", "mqtts", "mqtt+ssl", "ws", "wss":
+	default:
+		return nil, usageError("unsupported -broker scheme %q", u.Scheme)
+	}
+	if err = checkQoS("will-qos", c.willQoS); err != nil {
+		return nil, err
+	}
+
+	o := mqtt.NewClientOptions().
+		AddBroker(c.broker).
+		SetClientID(c.clientID).
+		SetCleanSession(c.clean).
+		SetKeepAlive(c.keepAlive).
+		SetConnectTimeout(c.connectTimeout).
+		SetAutoReconnect(true)
+	if o.ClientID == "" {
+		b := make([]byte, 6)
+		_, _ = rand.Read(b)
+		o.SetClientID("mqtt-" + hex.EncodeToString(b))
+	}
+	if c.username != "" {
+		o.SetUsername(c.username)
+	}
+	if password := c.password; password != "" || os.Getenv("MQTT_PASSWORD") != "" {
+		if password == "" {
+			password = os.Getenv("MQTT_PASSWORD")
+		}
+		o.SetPassword(password)
+	}
+	if c.willTopic != "" {
+		o.SetWill(c.willTopic, c.willPayload, byte(c.willQoS), c.willRetain)
+	}
+	if c.debug {
+		o.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		o.SetTLSConfig(tlsConfig)
+	}
+	return o, nil
+}
+
+// tlsConfig returns the TLS configuration specified by the flags (nil if the defaults are suitable)
+func (c *connFlags) tlsConfig() (*tls.Config, error) {
+	if c.caFile == "" && c.certFile == "" && c.keyFile == "" && !c.insecure && c.serverName == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: c.insecure,
+		ServerName:         c.serverName,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.caFile)
+		}
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return nil, usageError("-cert and -key must be used together")
+	}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// connect establishes a connection using the options o
+func connect(o *mqtt.ClientOptions, timeout time.Duration) (mqtt.Client, error) {
+	client := mqtt.NewClient(o)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout + time.Second) { // ConnectTimeout applies to each stage so allow some leeway
+		return nil, fmt.Errorf("connecting to %s: %w", strings.Join(brokers(o), ","), errTimeout)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", strings.Join(brokers(o), ","), err)
+	}
+	return client, nil
+}
+
+func brokers(o *mqtt.ClientOptions) []string {
+	var s []string
+	for _, u := range o.Servers {
+		s = append(s, u.Redacted())
+	}
+	return s
+}
+
+// checkQoS returns an error if qos is not valid
+func checkQoS(flagName string, qos int) error {
+	if qos < 0 || qos > 2 {
+		return usageError("-%s must be 0, 1 or 2", flagName)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// formatFlags holds the flags that determine how received messages are output
+type formatFlags struct {
+	format   string
+	template string
+}
+
+// register adds the output flags to fs
+func (f *formatFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.format, "format", "raw", "output format: raw (payload only), json, hex (payload only) or template")
+	fs.StringVar(&f.template, "template", "",
+		"Go text/template used when -format is template, e.g. '{{.Topic}}: {{.Payload}}'; fields are Topic, Payload, "+
+			"QoS, Retained, Duplicate, MessageID and Time, and functions hex, base64 and json are available "+
+			"(setting -template implies -format template)")
+}
+
+// formatter writes a message to an io.Writer
+type formatter func(w io.Writer, m mqtt.Message) error
+
+// formatter returns a formatter for the output format specified by the flags
+func (f *formatFlags) formatter() (formatter, error) {
+	format := f.format
+	if f.template != "" && format == "raw" {
+		format = "template"
+	}
+	switch format {
+	case "raw":
+		return writeRaw, nil
+	case "hex":
+		return writeHex, nil
+	case "json":
+		return writeJSON, nil
+	case "template":
+		if f.template == "" {
+			return nil, usageError("-template is required when -format is template")
+		}
+		tmpl, err := template.New("output").Funcs(template.FuncMap{
+			"hex":    func(s string) string { return hex.EncodeToString([]byte(s)) },
+			"base64": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+			"json": func(v any) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(f.template)
+		if err != nil {
+			return nil, usageError("invalid -template: %v", err)
+		}
+		return func(w io.Writer, m mqtt.Message) error {
+			var sb strings.Builder
+			if err := tmpl.Execute(&sb, newMessageView(m)); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(sb.String(), "\n") {
+				sb.WriteByte('\n')
+			}
+			_, err := io.WriteString(w, sb.String())
+			return err
+		}, nil
+	default:
+		return nil, usageError("unknown -format %q", f.format)
+	}
+}
+
+// messageView is the data passed to the output template
+type messageView struct {
+	Topic     string
+	Payload   string
+	QoS       byte
+	Retained  bool
+	Duplicate bool
+	MessageID uint16
+	Time      time.Time // When the message was received
+}
+
+func newMessageView(m mqtt.Message) messageView {
+	v := messageView{
+		Topic:     m.Topic(),
+		Payload:   string(m.Payload()),
+		QoS:       m.Qos(),
+		Retained:  m.Retained(),
+		Duplicate: m.Duplicate(),
+		MessageID: m.MessageID(),
+		Time:      time.Now(),
+	}
+	if md := mqtt.Metadata(m); md != nil && !md.ReceivedAt.IsZero() {
+		v.Time = md.ReceivedAt
+	}
+	return v
+}
+
+func writeRaw(w io.Writer, m mqtt.Message) error {
+	if _, err := w.Write(m.Payload()); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func writeHex(w io.Writer, m mqtt.Message) error {
+	_, err := io.WriteString(w, hex.EncodeToString(m.Payload())+"\n")
+	return err
+}
+
+// jsonMessage is the output of the json format; the payload is output as a string if it is valid UTF-8 and
+// base64 encoded otherwise
+type jsonMessage struct {
+	Topic         string    `json:"topic"`
+	QoS           byte      `json:"qos"`
+	Retained      bool      `json:"retained"`
+	Duplicate     bool      `json:"duplicate,omitempty"`
+	MessageID     uint16    `json:"message_id,omitempty"`
+	Time          time.Time `json:"time"`
+	Payload       *string   `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payload_base64,omitempty"`
+}
+
+func writeJSON(w io.Writer, m mqtt.Message) error {
+	v := newMessageView(m)
+	jm := jsonMessage{
+		Topic:     v.Topic,
+		QoS:       v.QoS,
+		Retained:  v.Retained,
+		Duplicate: v.Duplicate,
+		MessageID: v.MessageID,
+		Time:      v.Time,
+	}
+	if utf8.Valid(m.Payload()) {
+		jm.Payload = &v.Payload
+	} else {
+		jm.PayloadBase64 = m.Payload()
+	}
+	b, err := json.Marshal(jm)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,94 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testMessage implements mqtt.Message (and provides metadata so the time output is predictable)
+type testMessage struct {
+	mqtt.Message
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	id       uint16
+}
+
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) MessageID() uint16 { return m.id }
+func (m *testMessage) Metadata() *mqtt.MessageMetadata {
+	return &mqtt.MessageMetadata{ReceivedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func Test_Formatters(t *testing.T) {
+	text := &testMessage{topic: "a/b", payload: []byte(`{"v":1}`), qos: 1, retained: true, id: 7}
+	binary := &testMessage{topic: "a/c", payload: []byte{0xff, 0x00, 0x01}}
+	tests := []struct {
+		name     string
+		flags    formatFlags
+		msg      mqtt.Message
+		expected string
+	}{
+		{"raw", formatFlags{format: "raw"}, text, "{\"v\":1}\n"},
+		{"hex", formatFlags{format: "hex"}, binary, "ff0001\n"},
+		{"json", formatFlags{format: "json"}, text,
+			`{"topic":"a/b","qos":1,"retained":true,"message_id":7,"time":"2024-01-02T03:04:05Z","payload":"{\"v\":1}"}` + "\n"},
+		{"json binary", formatFlags{format: "json"}, binary,
+			`{"topic":"a/c","qos":0,"retained":false,"time":"2024-01-02T03:04:05Z","payload_base64":"/wAB"}` + "\n"},
+		{"template", formatFlags{format: "template", template: "{{.Topic}} {{.QoS}} {{.Retained}} {{.MessageID}}"}, text,
+			"a/b 1 true 7\n"},
+		{"template implied", formatFlags{format: "raw", template: "{{.Topic}}: {{.Payload}}\n"}, text,
+			"a/b: {\"v\":1}\n"},
+		{"template ignored", formatFlags{format: "hex", template: "{{.Topic}}"}, binary, "ff0001\n"},
+		{"template funcs", formatFlags{format: "template", template: "{{hex .Payload}} {{base64 .Payload}} {{json .Topic}}"},
+			binary, "ff0001 /wAB \"a/c\"\n"},
+		{"template time", formatFlags{format: "raw", template: "{{.Time.Unix}}"}, text, "1704164645\n"},
+	}
+	for _, tt := range tests {
+		f, err := tt.flags.formatter()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		var sb strings.Builder
+		if err = f(&sb, tt.msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if sb.String() != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, sb.String())
+		}
+	}
+}
+
+func Test_FormatterErrors(t *testing.T) {
+	for _, f := range []formatFlags{
+		{format: "xml"},
+		{format: "template"},
+		{format: "template", template: "{{.Topic"},
+	} {
+		if _, err := f.formatter(); !errors.Is(err, errUsage) {
+			t.Errorf("%+v: expected usage error, got %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Command mqtt is a command line MQTT client with three subcommands:
+//
+//	mqtt pub -t topic [-m message | -f file | -l] ...   publish messages
+//	mqtt sub -t filter [-t filter...] [-format ...] ...  subscribe and print the messages received
+//	mqtt rr  -t topic -resp topic [-m message] ...      publish a request and print the response
+//
+// All subcommands accept the connection flags (e.g. -broker ssl://host:8883 -cafile ca.pem -cert c.pem -key k.pem
+// for mutual TLS, or -broker wss://host/mqtt for websockets); run "mqtt <subcommand> -h" for details.
+//
+// The exit status is 0 on success, 1 on error, 2 for invalid usage and 3 if a timeout expired before the
+// expected messages (see -count) or response were received.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitTimeout = 3
+)
+
+// errTimeout is returned by a subcommand when -timeout expires before it completed
+var errTimeout = errors.New("timeout")
+
+var commands = map[string]struct {
+	run     func(args []string) error
+	summary string
+}{
+	"pub": {runPub, "publish messages"},
+	"sub": {runSub, "subscribe to topics and print the messages received"},
+	"rr":  {runRR, "publish a request and wait for the response"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mqtt <command> [flags]\n\ncommands:\n")
+	for _, name := range []string{"pub", "sub", "rr"} {
+		fmt.Fprintf(os.Stderr, "  %-4s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'mqtt <command> -h' for the flags accepted by a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] == "-h" || os.Args[1] == "-help" || os.Args[1] == "help" {
+			usage()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "mqtt: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	err := cmd.run(os.Args[2:])
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errFlags): // Already reported by the flag package
+		os.Exit(exitUsage)
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "mqtt %s: %v\n", os.Args[1], err)
+		os.Exit(exitUsage)
+	case errors.Is(err, errTimeout):
+		fmt.Fprintf(os.Stderr, "mqtt %s: %v\n", os.Args[1], err)
+		os.Exit(exitTimeout)
+	default:
+		fmt.Fprintf(os.Stderr, "mqtt %s: %v\n", os.Args[1], err)
+		os.Exit(exitError)
+	}
+}
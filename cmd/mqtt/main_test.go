@@ -0,0 +1,84 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_parseFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		err  error
+	}{
+		{"none", nil, nil},
+		{"flags", []string{"-t", "a/b", "-q", "1"}, nil},
+		{"help", []string{"-h"}, flag.ErrHelp},
+		{"unknown flag", []string{"-x"}, errFlags},
+		{"bad value", []string{"-q", "one"}, errFlags},
+		{"argument", []string{"-t", "a/b", "extra"}, errUsage},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.String("t", "", "")
+		fs.Int("q", 0, "")
+		if err := parseFlags(fs, tt.args); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+// Test_Validation checks that invalid command lines are rejected before any attempt is made to connect
+func Test_Validation(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func([]string) error
+		args []string
+		msg  string
+	}{
+		{"pub topic", runPub, []string{"-m", "x"}, "-t is required"},
+		{"pub qos", runPub, []string{"-t", "a", "-m", "x", "-q", "3"}, "-q must be 0, 1 or 2"},
+		{"pub sources", runPub, []string{"-t", "a", "-m", "x", "-f", "file"}, "only one of -m, -f and -l"},
+		{"pub lines", runPub, []string{"-t", "a", "-m", "x", "-l"}, "only one of -m, -f and -l"},
+		{"pub repeat", runPub, []string{"-t", "a", "-m", "x", "-n", "0"}, "-n must be at least 1"},
+		{"pub scheme", runPub, []string{"-t", "a", "-m", "x", "-broker", "http://host"}, "unsupported -broker scheme"},
+		{"pub will qos", runPub, []string{"-t", "a", "-m", "x", "-will-qos", "-1"}, "-will-qos must be 0, 1 or 2"},
+		{"pub argument", runPub, []string{"-t", "a", "x"}, "unexpected argument"},
+		{"sub topic", runSub, nil, "-t is required"},
+		{"sub qos", runSub, []string{"-t", "a", "-q", "-1"}, "-q must be 0, 1 or 2"},
+		{"sub count", runSub, []string{"-t", "a", "-count", "-1"}, "must not be negative"},
+		{"sub timeout", runSub, []string{"-t", "a", "-timeout", "-1s"}, "must not be negative"},
+		{"sub format", runSub, []string{"-t", "a", "-format", "xml"}, "unknown -format"},
+		{"sub template", runSub, []string{"-t", "a", "-template", "{{.Topic"}, "invalid -template"},
+		{"sub scheme", runSub, []string{"-t", "a", "-broker", "ftp://host"}, "unsupported -broker scheme"},
+		{"rr topic", runRR, []string{"-resp", "r"}, "-t is required"},
+		{"rr resp", runRR, []string{"-t", "a"}, "-resp is required unless -rpc"},
+		{"rr sources", runRR, []string{"-t", "a", "-rpc", "-m", "x", "-f", "file"}, "only one of -m and -f"},
+		{"rr timeout", runRR, []string{"-t", "a", "-rpc", "-timeout", "0s"}, "-timeout must be positive"},
+		{"rr qos", runRR, []string{"-t", "a", "-rpc", "-q", "5"}, "-q must be 0, 1 or 2"},
+		{"rr format", runRR, []string{"-t", "a", "-rpc", "-format", "template"}, "-template is required"},
+	}
+	for _, tt := range tests {
+		err := tt.run(tt.args)
+		if !errors.Is(err, errUsage) || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: expected usage error containing %q, got %v", tt.name, tt.msg, err)
+		}
+	}
+}
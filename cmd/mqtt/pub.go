@@ -0,0 +1,155 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runPub implements the pub command
+func runPub(args []string) error {
+	var (
+		conn     connFlags
+		topic    string
+		qos      int
+		retain   bool
+		message  string
+		file     string
+		lines    bool
+		repeat   int
+		interval time.Duration
+		timeout  time.Duration
+	)
+	fs := flag.NewFlagSet("mqtt pub", flag.ContinueOnError)
+	conn.register(fs)
+	fs.StringVar(&topic, "t", "", "topic to publish to (required)")
+	fs.IntVar(&qos, "q", 0, "QoS of the messages published")
+	fs.BoolVar(&retain, "r", false, "retain the messages published")
+	fs.StringVar(&message, "m", "", "message to publish")
+	fs.StringVar(&file, "f", "", "publish the contents of this file (- for stdin) as a single message")
+	fs.BoolVar(&lines, "l", false, "publish each line read from stdin as a separate message")
+	fs.IntVar(&repeat, "n", 1, "number of times to publish the message (-m or -f)")
+	fs.DurationVar(&interval, "interval", 0, "delay between messages")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "time to wait for each message to be delivered")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mqtt pub -t topic [-m message | -f file | -l] [flags]\n\n"+
+			"With none of -m, -f and -l the whole of stdin is published as a single message.\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if topic == "" {
+		return usageError("-t is required")
+	}
+	if err := checkQoS("q", qos); err != nil {
+		return err
+	}
+	sources := 0
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "m" || f.Name == "f" || f.Name == "l" {
+			sources++
+		}
+	})
+	if sources > 1 {
+		return usageError("only one of -m, -f and -l may be used")
+	}
+	if repeat < 1 {
+		return usageError("-n must be at least 1")
+	}
+
+	// Read the payload before connecting so that problems are reported promptly
+	var payload []byte
+	switch {
+	case lines:
+	case file == "-" || (file == "" && sources == 0):
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		payload = b
+	case file != "":
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		payload = b
+	default:
+		payload = []byte(message)
+	}
+
+	o, err := conn.options()
+	if err != nil {
+		return err
+	}
+	client, err := connect(o, conn.connectTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	p := publisher{client: client, topic: topic, qos: byte(qos), retain: retain, interval: interval, timeout: timeout}
+	if lines {
+		s := bufio.NewScanner(os.Stdin)
+		s.Buffer(nil, 256*1024*1024) // MQTT permits payloads up to 256MB
+		for s.Scan() {
+			if err = p.publish(s.Bytes()); err != nil {
+				return err
+			}
+		}
+		return s.Err()
+	}
+	for range repeat {
+		if err = p.publish(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publisher publishes messages, waiting for each to be delivered
+type publisher struct {
+	client   mqtt.Client
+	topic    string
+	qos      byte
+	retain   bool
+	interval time.Duration
+	timeout  time.Duration
+
+	sent int
+}
+
+// publish publishes payload, waiting for the interval to elapse first (unless this is the first message)
+func (p *publisher) publish(payload []byte) error {
+	if p.sent > 0 && p.interval > 0 {
+		time.Sleep(p.interval)
+	}
+	p.sent++
+	t := p.client.Publish(p.topic, p.qos, p.retain, payload)
+	if !t.WaitTimeout(p.timeout) {
+		return fmt.Errorf("publishing message %d: %w", p.sent, errTimeout)
+	}
+	if err := t.Error(); err != nil {
+		return fmt.Errorf("publishing message %d: %w", p.sent, err)
+	}
+	return nil
+}
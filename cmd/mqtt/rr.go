@@ -0,0 +1,179 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/rpc"
+)
+
+// runRR implements the rr (request/response) command
+func runRR(args []string) error {
+	var (
+		conn      connFlags
+		out       formatFlags
+		topic     string
+		respTopic string
+		message   string
+		file      string
+		qos       int
+		useRPC    bool
+		timeout   time.Duration
+	)
+	fs := flag.NewFlagSet("mqtt rr", flag.ContinueOnError)
+	conn.register(fs)
+	out.register(fs)
+	fs.StringVar(&topic, "t", "", "topic the request is published to (required)")
+	fs.StringVar(&respTopic, "resp", "", "topic the response is expected on (required unless -rpc is used)")
+	fs.StringVar(&message, "m", "", "request payload")
+	fs.StringVar(&file, "f", "", "read the request payload from this file (- for stdin)")
+	fs.IntVar(&qos, "q", 1, "QoS of the request and response subscription")
+	fs.BoolVar(&useRPC, "rpc", false, "wrap the request in an envelope carrying the response topic and correlation data "+
+		"(for use with the rpc package Server)")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "time to wait for the response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mqtt rr -t topic (-resp topic | -rpc) [-m message | -f file] [flags]\n\n"+
+			"Without -rpc the payload is published as is and the first message received on -resp is output.\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch {
+	case topic == "":
+		return usageError("-t is required")
+	case respTopic == "" && !useRPC:
+		return usageError("-resp is required unless -rpc is used")
+	case message != "" && file != "":
+		return usageError("only one of -m and -f may be used")
+	case timeout <= 0:
+		return usageError("-timeout must be positive")
+	}
+	if err := checkQoS("q", qos); err != nil {
+		return err
+	}
+	format, err := out.formatter()
+	if err != nil {
+		return err
+	}
+	payload := []byte(message)
+	if file == "-" {
+		payload, err = io.ReadAll(os.Stdin)
+	} else if file != "" {
+		payload, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	o, err := conn.options()
+	if err != nil {
+		return err
+	}
+	client, err := connect(o, conn.connectTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var resp mqtt.Message
+	if useRPC {
+		resp, err = callRPC(ctx, client, topic, respTopic, byte(qos), payload)
+	} else {
+		resp, err = request(ctx, client, topic, respTopic, byte(qos), payload)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("waiting for response: %w", errTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return format(os.Stdout, resp)
+}
+
+// request subscribes to respTopic, publishes payload to topic and returns the first message received on respTopic
+func request(ctx context.Context, client mqtt.Client, topic, respTopic string, qos byte, payload []byte) (mqtt.Message, error) {
+	received := make(chan mqtt.Message, 1)
+	t := client.Subscribe(respTopic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case received <- m:
+		default:
+		}
+	})
+	if err := waitToken(ctx, t); err != nil {
+		return nil, fmt.Errorf("subscribing to %q: %w", respTopic, err)
+	}
+	defer client.Unsubscribe(respTopic)
+
+	if err := waitToken(ctx, client.Publish(topic, qos, false, payload)); err != nil {
+		return nil, fmt.Errorf("publishing request: %w", err)
+	}
+	select {
+	case m := <-received:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// callRPC sends the request using an rpc.Requester, returning the response as a message
+func callRPC(ctx context.Context, client mqtt.Client, topic, respTopic string, qos byte, payload []byte) (mqtt.Message, error) {
+	r := rpc.NewRequester(client)
+	if respTopic != "" {
+		r.ReplyTopic = respTopic
+	}
+	r.QoS = qos
+	defer r.Close()
+	b, err := r.Call(ctx, topic, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcResponse{topic: r.ReplyTopic, qos: qos, payload: b}, nil
+}
+
+// waitToken waits for t to complete or ctx to be done
+func waitToken(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rpcResponse is a mqtt.Message holding the payload of an rpc response (which is unwrapped from its envelope)
+type rpcResponse struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+func (r *rpcResponse) Duplicate() bool   { return false }
+func (r *rpcResponse) Qos() byte         { return r.qos }
+func (r *rpcResponse) Retained() bool    { return false }
+func (r *rpcResponse) Topic() string     { return r.topic }
+func (r *rpcResponse) MessageID() uint16 { return 0 }
+func (r *rpcResponse) Payload() []byte   { return r.payload }
+func (r *rpcResponse) Ack()              {}
@@ -0,0 +1,176 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stringsFlag is a flag.Value that may be specified multiple times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// runSub implements the sub command
+func runSub(args []string) error {
+	var (
+		conn     connFlags
+		out      formatFlags
+		filters  stringsFlag
+		qos      int
+		count    int
+		timeout  time.Duration
+		noRetain bool
+	)
+	fs := flag.NewFlagSet("mqtt sub", flag.ContinueOnError)
+	conn.register(fs)
+	out.register(fs)
+	fs.Var(&filters, "t", "topic filter to subscribe to (required; may be repeated)")
+	fs.IntVar(&qos, "q", 0, "maximum QoS of the messages received")
+	fs.IntVar(&count, "count", 0, "exit after this many messages have been received (0 = no limit)")
+	fs.DurationVar(&timeout, "timeout", 0, "exit after this period (with status 3 if -count messages were not received)")
+	fs.BoolVar(&noRetain, "no-retained", false, "ignore retained messages")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mqtt sub -t filter [-t filter...] [flags]\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if len(filters) == 0 {
+		return usageError("-t is required")
+	}
+	if err := checkQoS("q", qos); err != nil {
+		return err
+	}
+	if count < 0 || timeout < 0 {
+		return usageError("-count and -timeout must not be negative")
+	}
+	format, err := out.formatter()
+	if err != nil {
+		return err
+	}
+
+	o, err := conn.options()
+	if err != nil {
+		return err
+	}
+
+	// Messages are output by a single goroutine (the handler is called sequentially as ordered routing is the
+	// default, but the mutex protects against that changing).
+	w := bufio.NewWriter(os.Stdout)
+	var (
+		mu       sync.Mutex
+		received int
+		outErr   error
+	)
+	done := make(chan struct{})
+	handler := func(_ mqtt.Client, m mqtt.Message) {
+		if noRetain && m.Retained() {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if (count > 0 && received >= count) || outErr != nil {
+			return
+		}
+		received++
+		if err := format(w, m); err != nil {
+			outErr = err
+		} else if err = w.Flush(); err != nil {
+			outErr = err
+		}
+		if outErr != nil || received == count {
+			close(done)
+		}
+	}
+
+	// Subscribing in OnConnect ensures that subscriptions are restored following a reconnection (unless the
+	// session was resumed)
+	subscribed := make(chan error, 1)
+	subs := make(map[string]byte, len(filters))
+	for _, f := range filters {
+		subs[f] = byte(qos)
+	}
+	o.SetOnConnectHandler(func(c mqtt.Client) {
+		t := c.SubscribeMultiple(subs, handler)
+		t.Wait()
+		err := t.Error()
+		if err == nil {
+			for filter, code := range t.(*mqtt.SubscribeToken).Result() {
+				if code == 0x80 {
+					err = fmt.Errorf("subscription to %q rejected by broker", filter)
+					break
+				}
+			}
+		}
+		select {
+		case subscribed <- err:
+		default:
+		}
+	})
+
+	client, err := connect(o, conn.connectTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+	select {
+	case err = <-subscribed:
+		if err != nil {
+			return fmt.Errorf("subscribing: %w", err)
+		}
+	case <-time.After(conn.connectTimeout):
+		return fmt.Errorf("subscribing: %w", errTimeout)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-done:
+		mu.Lock()
+		defer mu.Unlock()
+		return outErr
+	case <-sig:
+		return nil
+	case <-expired:
+		mu.Lock()
+		defer mu.Unlock()
+		if count > 0 && received < count {
+			return fmt.Errorf("received %d of %d messages: %w", received, count, errTimeout)
+		}
+		return nil
+	}
+}
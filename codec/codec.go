@@ -0,0 +1,95 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package codec provides additional payload codecs for use with mqtt.PublishTyped and mqtt.SubscribeTyped.
+//
+// This package is a separate module (github.com/eclipse/paho.mqtt.golang/codec) so that the libraries it depends
+// upon are only required by applications that use it; it requires v1.6.0 or later of the client (which introduced
+// mqtt.Codec). To use a codec for all typed messages:
+//
+//	opts.SetPayloadCodec(codec.CBOR{})
+//
+// or for specific topics:
+//
+//	opts.SetTopicCodec("sensors/#", codec.Protobuf{})
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	_ mqtt.Codec = Protobuf{}
+	_ mqtt.Codec = CBOR{}
+	_ mqtt.Codec = MsgPack{}
+)
+
+// ErrNotProtoMessage is returned by Protobuf when the value is not a proto.Message
+var ErrNotProtoMessage = errors.New("value does not implement proto.Message")
+
+// Protobuf encodes payloads using protocol buffers (binary wire format). Values must implement proto.Message; when
+// decoding, the target may be a message (e.g. *pb.Msg) or a pointer to a nil message pointer (as is the case with
+// SubscribeTyped[*pb.Msg]) in which case a new message is allocated.
+type Protobuf struct{}
+
+func (Protobuf) Name() string { return "protobuf" }
+
+func (Protobuf) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	return proto.Marshal(m)
+}
+
+func (Protobuf) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	// v may be a **Msg; allocate the message if needed
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Pointer {
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	elem := rv.Elem()
+	if elem.IsNil() {
+		elem.Set(reflect.New(elem.Type().Elem()))
+	}
+	m, ok := elem.Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// CBOR encodes payloads using CBOR (RFC 8949)
+type CBOR struct{}
+
+func (CBOR) Name() string                       { return "cbor" }
+func (CBOR) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (CBOR) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+// MsgPack encodes payloads using MessagePack
+type MsgPack struct{}
+
+func (MsgPack) Name() string                       { return "msgpack" }
+func (MsgPack) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (MsgPack) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
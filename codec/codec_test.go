@@ -0,0 +1,76 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package codec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type reading struct {
+	Sensor string  `cbor:"sensor" msgpack:"sensor"`
+	Value  float64 `cbor:"value" msgpack:"value"`
+}
+
+func Test_RoundTrip(t *testing.T) {
+	in := reading{Sensor: "temp", Value: 21.5}
+	for _, c := range []mqtt.Codec{CBOR{}, MsgPack{}} {
+		b, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		var out reading
+		if err = c.Unmarshal(b, &out); err != nil {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("%s: expected %+v, got %+v", c.Name(), in, out)
+		}
+		if err = c.Unmarshal([]byte{0xff, 0x00}, &out); err == nil {
+			t.Fatalf("%s: expected error decoding garbage", c.Name())
+		}
+	}
+}
+
+func Test_Protobuf(t *testing.T) {
+	var c Protobuf
+	b, err := c.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode into an existing message
+	var m wrapperspb.StringValue
+	if err = c.Unmarshal(b, &m); err != nil || m.GetValue() != "hello" {
+		t.Fatalf("unexpected result %q: %v", m.GetValue(), err)
+	}
+	// Decode into a nil message pointer (as SubscribeTyped[*wrapperspb.StringValue] would)
+	var p *wrapperspb.StringValue
+	if err = c.Unmarshal(b, &p); err != nil || p.GetValue() != "hello" {
+		t.Fatalf("unexpected result %q: %v", p.GetValue(), err)
+	}
+
+	if _, err = c.Marshal("not a message"); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("expected ErrNotProtoMessage, got %v", err)
+	}
+	var s string
+	if err = c.Unmarshal(b, &s); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("expected ErrNotProtoMessage, got %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+module github.com/eclipse/paho.mqtt.golang/codec
+
+go 1.24.0
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.6.0 // first release with mqtt.Codec
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+)
+
+// The codecs are developed alongside the client. This replace only applies when building within this repository
+// (it is ignored by modules depending on the codecs), so the client must be tagged (v1.6.0) before the codec module.
+replace github.com/eclipse/paho.mqtt.golang => ../
@@ -0,0 +1,313 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package compression provides transparent payload compression (gzip, zstd or snappy) implemented as client
+// middleware.
+//
+// Compressed payloads begin with a header (magic bytes, a format version, the algorithm and the decompressed length)
+// so subscribers can handle a mix of compressed and uncompressed messages on the same topic (payloads without the
+// header are delivered unchanged).
+// Typical use:
+//
+//	c := compression.New(compression.Zstd).SetTopicPolicy("logs/#", compression.Policy{Algorithm: compression.None})
+//	opts.UseOutbound(c.Outbound).UseInbound(c.Inbound)
+//
+// Note that the header could, in theory, be the start of an uncompressed binary payload; it begins with a zero byte
+// so will not collide with text (e.g. JSON) payloads, and a payload is only decompressed if the version is one this
+// package produces. Decompression fails (rather than delivering something else) unless the result has the length
+// given in the header.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Algorithm identifies a compression algorithm; the value is written to the payload header
+type Algorithm byte
+
+const (
+	None   Algorithm = 0
+	Gzip   Algorithm = 1
+	Zstd   Algorithm = 2
+	Snappy Algorithm = 3
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(a))
+}
+
+// magic is the start of the header on compressed payloads; it is followed by the version, a single Algorithm byte
+// and the decompressed length (uint32, big endian)
+var magic = []byte{0x00, 'M', 'Q', 'Z'}
+
+// headerVersion identifies the header format; payloads with any other version are not treated as compressed
+const headerVersion = 1
+
+// HeaderLen is the length of the header added to compressed payloads
+const HeaderLen = 10
+
+// DefaultMinSize is the default Policy.MinSize; smaller payloads rarely benefit from compression
+const DefaultMinSize = 256
+
+// DefaultMaxDecompressedSize is the default Compressor.MaxDecompressedSize
+const DefaultMaxDecompressedSize = 64 << 20
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown compression algorithm")
+	ErrTooLarge         = errors.New("decompressed payload exceeds maximum size")
+	ErrLength           = errors.New("decompressed payload length does not match header")
+)
+
+// Policy determines how payloads are compressed
+type Policy struct {
+	Algorithm Algorithm
+	MinSize   int // Payloads smaller than this are sent uncompressed
+}
+
+// topicPolicy associates a topic filter with a policy
+type topicPolicy struct {
+	filter string
+	policy Policy
+}
+
+// Compressor compresses outbound payloads and decompresses inbound ones. Payloads are only sent compressed if
+// that makes them smaller.
+type Compressor struct {
+	// The fields below should not be changed once the Compressor is in use
+	Default             Policy                        // Used for topics with no matching topic policy
+	MaxDecompressedSize int                           // Messages that would decompress to more than this are dropped
+	OnError             func(topic string, err error) // If not nil, called when an inbound message cannot be decompressed
+
+	topics []topicPolicy
+
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+}
+
+// New creates a Compressor that uses algorithm for payloads of at least DefaultMinSize bytes
+func New(algorithm Algorithm) *Compressor {
+	return &Compressor{
+		Default:             Policy{Algorithm: algorithm, MinSize: DefaultMinSize},
+		MaxDecompressedSize: DefaultMaxDecompressedSize,
+	}
+}
+
+// SetTopicPolicy sets the policy used for topics matching filter (overriding Default). Where multiple filters
+// match a topic the first added takes precedence.
+func (c *Compressor) SetTopicPolicy(filter string, p Policy) *Compressor {
+	c.topics = append(c.topics, topicPolicy{filter: filter, policy: p})
+	return c
+}
+
+// PolicyFor returns the policy that will be used when publishing to topic
+func (c *Compressor) PolicyFor(topic string) Policy {
+	for _, tp := range c.topics {
+		if mqtt.TopicMatches(tp.filter, topic) {
+			return tp.policy
+		}
+	}
+	return c.Default
+}
+
+// Outbound is middleware (see mqtt.ClientOptions.UseOutbound) that compresses payloads in accordance with the
+// policy for the topic
+func (c *Compressor) Outbound(next mqtt.PublishFunc) mqtt.PublishFunc {
+	return func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		p := c.PolicyFor(topic)
+		if p.Algorithm == None {
+			return next(topic, qos, retained, payload)
+		}
+		var data []byte
+		switch v := payload.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		case bytes.Buffer:
+			data = v.Bytes()
+		case *mqtt.PooledPayload:
+			data = v.Bytes()
+		default:
+			return next(topic, qos, retained, payload) // Let the client report the error
+		}
+		if len(data) < p.MinSize {
+			return next(topic, qos, retained, payload)
+		}
+		compressed, err := c.Compress(p.Algorithm, data)
+		if err != nil || len(compressed) >= len(data) {
+			return next(topic, qos, retained, payload) // Not worth compressing (or cannot be)
+		}
+		return next(topic, qos, retained, compressed)
+	}
+}
+
+// Inbound is middleware (see mqtt.ClientOptions.UseInbound) that decompresses payloads before they reach the
+// handler. Payloads without a compression header are passed through unchanged; those that cannot be
+// decompressed are reported to OnError and dropped (the message is still acknowledged).
+func (c *Compressor) Inbound(next mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if !IsCompressed(msg.Payload()) {
+			next(client, msg)
+			return
+		}
+		data, err := c.Decompress(msg.Payload())
+		if err != nil {
+			if c.OnError != nil {
+				c.OnError(msg.Topic(), err)
+			}
+			return
+		}
+		next(client, &message{Message: msg, payload: data})
+	}
+}
+
+// IsCompressed reports whether payload begins with a compression header
+func IsCompressed(payload []byte) bool {
+	return len(payload) >= HeaderLen && bytes.Equal(payload[:len(magic)], magic) && payload[len(magic)] == headerVersion
+}
+
+// Compress returns data compressed with algorithm, preceded by the header
+func (c *Compressor) Compress(algorithm Algorithm, data []byte) ([]byte, error) {
+	if uint64(len(data)) > math.MaxUint32 {
+		return nil, ErrTooLarge
+	}
+	out := make([]byte, HeaderLen, HeaderLen+len(data)/2)
+	copy(out, magic)
+	out[len(magic)] = headerVersion
+	out[len(magic)+1] = byte(algorithm)
+	binary.BigEndian.PutUint32(out[len(magic)+2:], uint32(len(data)))
+	switch algorithm {
+	case Gzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		if err := c.initZstd(); err != nil {
+			return nil, err
+		}
+		return c.zstdEnc.EncodeAll(data, out), nil
+	case Snappy:
+		return append(out, snappy.Encode(nil, data)...), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+}
+
+// Decompress decompresses a payload produced by Compress. If the payload has no header it is returned unchanged.
+func (c *Compressor) Decompress(payload []byte) ([]byte, error) {
+	if !IsCompressed(payload) {
+		return payload, nil
+	}
+	algorithm, data := Algorithm(payload[len(magic)+1]), payload[HeaderLen:]
+	size := int64(binary.BigEndian.Uint32(payload[len(magic)+2:]))
+	max := c.MaxDecompressedSize
+	if max <= 0 {
+		max = DefaultMaxDecompressedSize
+	}
+	if size > int64(max) {
+		return nil, ErrTooLarge
+	}
+	var out []byte
+	var err error
+	switch algorithm {
+	case None:
+		out = data
+	case Gzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		out, err = io.ReadAll(io.LimitReader(r, size+1))
+	case Zstd:
+		if err = c.initZstd(); err != nil {
+			return nil, err
+		}
+		out, err = c.zstdDec.DecodeAll(data, make([]byte, 0, size))
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+	case Snappy:
+		var n int
+		if n, err = snappy.DecodedLen(data); err != nil {
+			return nil, err
+		}
+		if int64(n) != size {
+			return nil, ErrLength
+		}
+		out, err = snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) != size {
+		return nil, ErrLength
+	}
+	return out, nil
+}
+
+// initZstd creates the (concurrency safe) zstd encoder and decoder on first use
+func (c *Compressor) initZstd() error {
+	c.zstdOnce.Do(func() {
+		max := c.MaxDecompressedSize
+		if max <= 0 {
+			max = DefaultMaxDecompressedSize
+		}
+		if c.zstdEnc, c.zstdErr = zstd.NewWriter(nil); c.zstdErr != nil {
+			return
+		}
+		c.zstdDec, c.zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)), zstd.WithDecoderConcurrency(0))
+	})
+	return c.zstdErr
+}
+
+// message replaces the payload of a received message
+type message struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m *message) Payload() []byte { return m.payload }
+
+// Unwrap returns the message as received (allowing mqtt.Params etc. to access it)
+func (m *message) Unwrap() mqtt.Message { return m.Message }
@@ -0,0 +1,166 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is a token that has already completed
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+// testMessage implements mqtt.Message
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+
+var telemetry = []byte(strings.Repeat(`{"sensor":"temp","value":21.5,"unit":"C"},`, 100))
+
+func Test_RoundTrip(t *testing.T) {
+	c := New(Gzip)
+	for _, a := range []Algorithm{Gzip, Zstd, Snappy} {
+		b, err := c.Compress(a, telemetry)
+		if err != nil {
+			t.Fatalf("%s: %v", a, err)
+		}
+		if !IsCompressed(b) || len(b) >= len(telemetry) {
+			t.Fatalf("%s: payload not compressed (%d bytes)", a, len(b))
+		}
+		out, err := c.Decompress(b)
+		if err != nil || !bytes.Equal(out, telemetry) {
+			t.Fatalf("%s: round trip failed: %v", a, err)
+		}
+
+		// Limit on decompressed size
+		small := &Compressor{MaxDecompressedSize: 100}
+		if _, err = small.Decompress(b); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("%s: expected ErrTooLarge, got %v", a, err)
+		}
+	}
+	if out, err := c.Decompress([]byte("plain")); err != nil || string(out) != "plain" {
+		t.Fatalf("expected uncompressed payload to pass through, got %q, %v", out, err)
+	}
+	if _, err := c.Decompress(header(9, 2)); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("expected ErrUnknownAlgorithm, got %v", err)
+	}
+}
+
+// header returns a compression header for algorithm, declaring the decompressed size
+func header(algorithm Algorithm, size uint32) []byte {
+	return binary.BigEndian.AppendUint32(append(append([]byte{}, magic...), headerVersion, byte(algorithm)), size)
+}
+
+func Test_Header(t *testing.T) {
+	c := New(Gzip)
+	b, err := c.Compress(Snappy, telemetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+		out     []byte
+	}{
+		{"valid", b, nil, telemetry},
+		{"none", append(header(None, 5), "plain"...), nil, []byte("plain")},
+		{"none length", append(header(None, 4), "plain"...), ErrLength, nil},
+		{"length", append(header(Snappy, uint32(len(telemetry)+1)), b[HeaderLen:]...), ErrLength, nil},
+		{"declared too large", append(header(Snappy, DefaultMaxDecompressedSize+1), b[HeaderLen:]...), ErrTooLarge, nil},
+		{"other version", append(append([]byte{}, magic...), 2, 1, 0, 0, 0, 1, 0), nil, append(append([]byte{}, magic...), 2, 1, 0, 0, 0, 1, 0)},
+		{"short", append([]byte{}, magic...), nil, append([]byte{}, magic...)},
+	}
+	for _, tt := range tests {
+		out, err := c.Decompress(tt.payload)
+		if !errors.Is(err, tt.err) || !bytes.Equal(out, tt.out) {
+			t.Errorf("%s: expected %q, %v got %q, %v", tt.name, tt.out, tt.err, out, err)
+		}
+	}
+	for _, a := range []Algorithm{Gzip, Zstd} {
+		b, _ := c.Compress(a, telemetry)
+		binary.BigEndian.PutUint32(b[len(magic)+2:], uint32(len(telemetry)-1))
+		if _, err := c.Decompress(b); !errors.Is(err, ErrLength) {
+			t.Errorf("%s: expected ErrLength, got %v", a, err)
+		}
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	var sent []byte
+	publish := func(_ string, _ byte, _ bool, payload interface{}) mqtt.Token {
+		switch p := payload.(type) {
+		case []byte:
+			sent = p
+		case string:
+			sent = []byte(p)
+		}
+		return doneToken{}
+	}
+	c := New(Zstd).SetTopicPolicy("raw/#", Policy{Algorithm: None})
+	out := c.Outbound(publish)
+
+	noise := make([]byte, 1024)
+	rand.Read(noise)
+	tests := []struct {
+		name       string
+		topic      string
+		payload    interface{}
+		compressed bool
+	}{
+		{"large", "telemetry", telemetry, true},
+		{"string", "telemetry", string(telemetry), true},
+		{"small", "telemetry", `{"a":1}`, false},
+		{"incompressible", "telemetry", noise, false},
+		{"policy", "raw/data", telemetry, false},
+	}
+	var errs []error
+	c.OnError = func(_ string, err error) { errs = append(errs, err) }
+	in := c.Inbound(func(_ mqtt.Client, m mqtt.Message) { sent = m.Payload() })
+	for _, tt := range tests {
+		out(tt.topic, 1, false, tt.payload)
+		if IsCompressed(sent) != tt.compressed {
+			t.Fatalf("%s: expected compressed=%v", tt.name, tt.compressed)
+		}
+		in(nil, &testMessage{topic: tt.topic, payload: sent})
+		if IsCompressed(sent) {
+			t.Fatalf("%s: handler received compressed payload", tt.name)
+		}
+	}
+
+	// Corrupt payloads are dropped
+	sent = nil
+	bad := append(header(Gzip, 100), 1, 2, 3)
+	in(nil, &testMessage{topic: "telemetry", payload: bad})
+	if sent != nil || len(errs) != 1 {
+		t.Fatalf("expected corrupt payload to be dropped and reported (errors %v)", errs)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultDispatchQueueSize is the default number of messages queued for each dispatch worker
+const DefaultDispatchQueueSize = 64
+
+// SetDispatchWorkers enables dispatch via a fixed pool of n worker goroutines (0, the default, disables the pool;
+// messages are then dispatched as determined by SetOrderMatters, which is ignored when the pool is enabled).
+//
+// Each message is assigned to a worker based upon its key (see SetDispatchKeyFunc; by default the topic) so
+// messages with the same key are handled in the order received, whilst those with different keys may be handled
+// in parallel. When the queue for a worker is full (see SetDispatchQueueSize) reading from the network is paused
+// until space becomes available; this applies backpressure to the broker.
+//
+// Handlers may block (and call Publish etc.) but doing so will delay the handling of other messages assigned to the
+// same worker.
+func (o *ClientOptions) SetDispatchWorkers(n int) *ClientOptions {
+	o.DispatchWorkers = n
+	return o
+}
+
+// SetDispatchQueueSize sets the number of messages that may be queued for each dispatch worker (see
+// SetDispatchWorkers)
+func (o *ClientOptions) SetDispatchQueueSize(n int) *ClientOptions {
+	o.DispatchQueueSize = n
+	return o
+}
+
+// SetDispatchKeyFunc sets the function used to determine the ordering key for a message when dispatching via a
+// worker pool (see SetDispatchWorkers). Messages with the same key are handled in order. By default the key is the
+// topic; return a constant to process all messages in order, or a value from the payload to order by device etc.
+func (o *ClientOptions) SetDispatchKeyFunc(f func(Message) string) *ClientOptions {
+	o.DispatchKeyFunc = f
+	return o
+}
+
+// dispatchJob is a message (held by the handlerGroup) and the handlers that it is to be passed to
+type dispatchJob struct {
+	handlers []MessageHandler
+	g        *handlerGroup
+}
+
+// workerPool calls handlers using a fixed number of goroutines, with each key assigned to a single worker
+type workerPool struct {
+	client *client
+	key    func(Message) string
+	queues []chan dispatchJob
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts the workers
+func newWorkerPool(c *client) *workerPool {
+	size := c.options.DispatchQueueSize
+	if size <= 0 {
+		size = DefaultDispatchQueueSize
+	}
+	p := &workerPool{client: c, key: c.options.DispatchKeyFunc, queues: make([]chan dispatchJob, c.options.DispatchWorkers)}
+	if p.key == nil {
+		p.key = Message.Topic
+	}
+	for i := range p.queues {
+		q := make(chan dispatchJob, size)
+		p.queues[i] = q
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range q {
+				for _, h := range job.handlers {
+					p.client.callHandler(h, job.g)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the message for the worker responsible for its key; this blocks if that worker's queue is full
+func (p *workerPool) dispatch(handlers []MessageHandler, g *handlerGroup) {
+	h := fnv.New32a()
+	h.Write([]byte(p.key(g.m)))
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- dispatchJob{handlers: handlers, g: g}
+}
+
+// stop waits for all queued messages to be handled and the workers to exit
+func (p *workerPool) stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
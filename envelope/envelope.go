@@ -0,0 +1,482 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package envelope provides end-to-end encryption and signing of message payloads, so that payloads cannot be
+// read or altered by the broker (or anyone else between publisher and subscriber).
+//
+// Payloads are encrypted using AES-GCM or XChaCha20-Poly1305 with a key selected by topic and, optionally, signed
+// using Ed25519 or HMAC-SHA256. Each envelope carries the ID of the key used (allowing keys to be rotated) and the
+// time it was sealed; messages older than MaxAge, or that have already been received, are rejected. The topic is
+// authenticated so a sealed payload cannot be replayed on a different topic, and a key is only accepted on the
+// topics it was added for.
+//
+// Note that, with the default MaxAge, retained messages and messages queued by the broker while the subscriber was
+// offline are rejected once they are more than five minutes old; increase MaxAge (or disable the check) where
+// these are expected.
+//
+// A Sealer is added to the client as middleware:
+//
+//	s := envelope.New().
+//		SetTopicKey("plant/#", envelope.Key{ID: "2024-06", Cipher: envelope.AESGCM, Secret: key}).
+//		SignWithEd25519("device-1", privateKey).
+//		TrustEd25519("device-1", publicKey)
+//	opts.UseOutbound(s.Outbound).UseInbound(s.Inbound)
+//
+// Messages that fail validation are passed to OnReject and never reach the handler.
+package envelope
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Cipher identifies the AEAD used to encrypt the payload
+type Cipher byte
+
+const (
+	AESGCM            Cipher = 1 // AES-GCM; the key must be 16, 24 or 32 bytes
+	XChaCha20Poly1305 Cipher = 2 // XChaCha20-Poly1305; the key must be 32 bytes
+)
+
+func (c Cipher) String() string {
+	switch c {
+	case AESGCM:
+		return "AES-GCM"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// SignatureAlgorithm identifies the algorithm used to sign the envelope
+type SignatureAlgorithm byte
+
+const (
+	Unsigned   SignatureAlgorithm = 0
+	Ed25519    SignatureAlgorithm = 1
+	HMACSHA256 SignatureAlgorithm = 2
+)
+
+func (a SignatureAlgorithm) String() string {
+	switch a {
+	case Unsigned:
+		return "unsigned"
+	case Ed25519:
+		return "Ed25519"
+	case HMACSHA256:
+		return "HMAC-SHA256"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(a))
+}
+
+// DefaultMaxAge is the default Sealer.MaxAge
+const DefaultMaxAge = 5 * time.Minute
+
+var (
+	ErrNotSealed         = errors.New("payload is not sealed")
+	ErrMalformed         = errors.New("malformed envelope")
+	ErrNoKey             = errors.New("no encryption key for topic")
+	ErrUnknownKey        = errors.New("unknown key ID")
+	ErrKeyNotForTopic    = errors.New("key is not permitted for topic")
+	ErrUnknownCipher     = errors.New("unknown cipher")
+	ErrDecrypt           = errors.New("message authentication failed")
+	ErrSignatureRequired = errors.New("message is not signed")
+	ErrBadSignature      = errors.New("invalid signature")
+	ErrExpired           = errors.New("message timestamp outside of permitted window")
+	ErrReplay            = errors.New("message has already been received")
+)
+
+// Key is a symmetric encryption key
+type Key struct {
+	ID     string // Identifies the key (max 255 bytes); included in each envelope
+	Cipher Cipher
+	Secret []byte
+}
+
+// Info describes a successfully opened envelope
+type Info struct {
+	KeyID    string             // ID of the encryption key
+	Signer   string             // ID of the signing key ("" if unsigned)
+	SignedBy SignatureAlgorithm // Algorithm used to sign the message
+	Time     time.Time          // Time the message was sealed
+}
+
+// topicKey associates a topic filter with a key used for messages published to matching topics
+type topicKey struct {
+	filter string
+	key    Key
+}
+
+// verifier checks signatures from a single signing key
+type verifier struct {
+	alg    SignatureAlgorithm
+	public ed25519.PublicKey
+	secret []byte
+}
+
+// Sealer encrypts (and signs) outbound payloads and decrypts (and verifies) inbound ones
+type Sealer struct {
+	// The fields below should not be changed once the Sealer is in use
+	RequireSignature bool                          // Reject unsigned messages
+	AllowPlaintext   bool                          // Deliver inbound messages that are not sealed (rejected by default)
+	MaxAge           time.Duration                 // Reject messages sealed more than MaxAge ago (or in the future); <0 disables (see package doc)
+	OnReject         func(topic string, err error) // If not nil, called when an inbound message is rejected
+
+	topicKeys   []topicKey // used to encrypt
+	decryptKeys []topicKey // used to decrypt
+
+	signAlg    SignatureAlgorithm
+	signerID   string
+	signKey    ed25519.PrivateKey
+	signSecret []byte
+	verifiers  map[string]verifier
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	seen    map[string]uint64 // nonces received (and the mqtt.MessageMetadata.Delivery they were received in)
+	expires expiryHeap        // when entries in seen may be forgotten (earliest first)
+}
+
+// New creates a Sealer; at least one key must be added (see SetTopicKey)
+func New() *Sealer {
+	return &Sealer{
+		MaxAge:    DefaultMaxAge,
+		verifiers: make(map[string]verifier),
+		now:       time.Now,
+		seen:      make(map[string]uint64),
+	}
+}
+
+// SetTopicKey sets the key used to encrypt messages published to topics matching filter (the key is also added
+// with AddKey). Where multiple filters match the topic the first added takes precedence. To rotate keys add the
+// new key here (on publishers) and with AddKey (on subscribers) leaving the old key available to subscribers
+// until all messages using it have been received.
+func (s *Sealer) SetTopicKey(filter string, k Key) *Sealer {
+	s.topicKeys = append(s.topicKeys, topicKey{filter: filter, key: k})
+	return s.AddKey(filter, k)
+}
+
+// AddKey makes a key available for decrypting messages received on topics matching filter; messages sealed with
+// the key that arrive on any other topic are rejected
+func (s *Sealer) AddKey(filter string, k Key) *Sealer {
+	s.decryptKeys = append(s.decryptKeys, topicKey{filter: filter, key: k})
+	return s
+}
+
+// SignWithEd25519 signs outbound messages with priv (keyID identifies the key to subscribers)
+func (s *Sealer) SignWithEd25519(keyID string, priv ed25519.PrivateKey) *Sealer {
+	s.signAlg, s.signerID, s.signKey, s.signSecret = Ed25519, keyID, priv, nil
+	return s
+}
+
+// SignWithHMAC signs outbound messages using HMAC-SHA256; the key is also trusted (see TrustHMAC)
+func (s *Sealer) SignWithHMAC(keyID string, secret []byte) *Sealer {
+	s.signAlg, s.signerID, s.signKey, s.signSecret = HMACSHA256, keyID, nil, secret
+	return s.TrustHMAC(keyID, secret)
+}
+
+// TrustEd25519 accepts messages signed by the private key matching pub
+func (s *Sealer) TrustEd25519(keyID string, pub ed25519.PublicKey) *Sealer {
+	s.verifiers[keyID] = verifier{alg: Ed25519, public: pub}
+	return s
+}
+
+// TrustHMAC accepts messages signed using HMAC-SHA256 with secret
+func (s *Sealer) TrustHMAC(keyID string, secret []byte) *Sealer {
+	s.verifiers[keyID] = verifier{alg: HMACSHA256, secret: secret}
+	return s
+}
+
+// keyFor returns the encryption key for topic
+func (s *Sealer) keyFor(topic string) (Key, error) {
+	for _, tk := range s.topicKeys {
+		if mqtt.TopicMatches(tk.filter, topic) {
+			return tk.key, nil
+		}
+	}
+	return Key{}, fmt.Errorf("%w %q", ErrNoKey, topic)
+}
+
+// decryptKey returns the key with the given ID, checking that it may be used on topic
+func (s *Sealer) decryptKey(topic, id string) (Key, error) {
+	known := false
+	for _, tk := range s.decryptKeys {
+		if tk.key.ID != id {
+			continue
+		}
+		if mqtt.TopicMatches(tk.filter, topic) {
+			return tk.key, nil
+		}
+		known = true
+	}
+	if known {
+		return Key{}, fmt.Errorf("%w: %q on %q", ErrKeyNotForTopic, id, topic)
+	}
+	return Key{}, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+}
+
+// newAEAD creates the AEAD for k
+func newAEAD(k Key) (cipher.AEAD, error) {
+	switch k.Cipher {
+	case AESGCM:
+		b, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(k.Secret)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCipher, k.Cipher)
+}
+
+// Seal encrypts (and signs) payload for publication on topic
+func (s *Sealer) Seal(topic string, payload []byte) ([]byte, error) {
+	k, err := s.keyFor(topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.ID) > 255 || len(s.signerID) > 255 {
+		return nil, errors.New("key ID too long")
+	}
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, err
+	}
+	env := sealed{
+		cipher:   k.Cipher,
+		sigAlg:   s.signAlg,
+		time:     s.now(),
+		keyID:    k.ID,
+		signerID: s.signerID,
+		nonce:    make([]byte, aead.NonceSize()),
+	}
+	if _, err = rand.Read(env.nonce); err != nil {
+		return nil, err
+	}
+	b := env.appendHeader(make([]byte, 0, 64+len(payload)+aead.Overhead()+ed25519.SignatureSize))
+	ct := aead.Seal(nil, env.nonce, payload, additionalData(b, topic))
+	b = appendCiphertext(b, ct)
+	switch s.signAlg {
+	case Ed25519:
+		b = append(b, ed25519.Sign(s.signKey, signedData(b, topic))...)
+	case HMACSHA256:
+		b = append(b, hmacSum(s.signSecret, signedData(b, topic))...)
+	}
+	return b, nil
+}
+
+// Open validates and decrypts a payload produced by Seal that was received on topic
+func (s *Sealer) Open(topic string, payload []byte) ([]byte, *Info, error) {
+	return s.open(topic, payload, 0)
+}
+
+// open implements Open; delivery identifies the receipt of the message (0 if unknown). A payload opened more than
+// once as part of the same delivery (e.g. because it matched multiple routes) is not considered to be a replay.
+func (s *Sealer) open(topic string, payload []byte, delivery uint64) ([]byte, *Info, error) {
+	env, err := decode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Check the signature before doing anything else with the content
+	switch env.sigAlg {
+	case Unsigned:
+		if s.RequireSignature {
+			return nil, nil, ErrSignatureRequired
+		}
+		if len(env.signature) != 0 {
+			return nil, nil, ErrMalformed
+		}
+	case Ed25519, HMACSHA256:
+		v, ok := s.verifiers[env.signerID]
+		if !ok || v.alg != env.sigAlg {
+			return nil, nil, fmt.Errorf("%w: signer %q", ErrUnknownKey, env.signerID)
+		}
+		data := signedData(env.signed, topic)
+		if v.alg == Ed25519 && !ed25519.Verify(v.public, data, env.signature) ||
+			v.alg == HMACSHA256 && !hmac.Equal(hmacSum(v.secret, data), env.signature) {
+			return nil, nil, ErrBadSignature
+		}
+	default:
+		return nil, nil, ErrMalformed
+	}
+
+	k, err := s.decryptKey(topic, env.keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k.Cipher != env.cipher {
+		return nil, nil, ErrDecrypt
+	}
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(env.nonce) != aead.NonceSize() {
+		return nil, nil, ErrMalformed
+	}
+	plain, err := aead.Open(nil, env.nonce, env.ciphertext, additionalData(env.header, topic))
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+	// The timestamp is authenticated so can now be trusted
+	if err = s.checkFresh(env, delivery); err != nil {
+		return nil, nil, err
+	}
+	return plain, &Info{KeyID: env.keyID, Signer: env.signerID, SignedBy: env.sigAlg, Time: env.time}, nil
+}
+
+// checkFresh rejects messages outside of the MaxAge window and those that have been seen before in a different
+// delivery
+func (s *Sealer) checkFresh(env *sealed, delivery uint64) error {
+	if s.MaxAge < 0 {
+		return nil
+	}
+	now := s.now()
+	if d := now.Sub(env.time); d > s.MaxAge || d < -s.MaxAge {
+		return ErrExpired
+	}
+	id := env.keyID + "/" + string(env.nonce)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.expires) > 0 && now.After(s.expires[0].at) { // Messages older than MaxAge would be rejected anyway
+		delete(s.seen, heap.Pop(&s.expires).(expiry).id)
+	}
+	if d, ok := s.seen[id]; ok {
+		if delivery == 0 || d != delivery {
+			return ErrReplay
+		}
+		return nil
+	}
+	s.seen[id] = delivery
+	heap.Push(&s.expires, expiry{id: id, at: env.time.Add(s.MaxAge)})
+	return nil
+}
+
+// expiry records when a nonce may be forgotten
+type expiry struct {
+	id string
+	at time.Time
+}
+
+// expiryHeap is a container/heap of expiries ordered by time
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// additionalData returns the data authenticated by the AEAD
+func additionalData(header []byte, topic string) []byte {
+	return append(header[:len(header):len(header)], topic...)
+}
+
+// signedData returns the data covered by the signature
+func signedData(b []byte, topic string) []byte {
+	return append(b[:len(b):len(b)], topic...)
+}
+
+func hmacSum(secret, data []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// Outbound is middleware (see mqtt.ClientOptions.UseOutbound) that seals payloads before they are published. If
+// a payload cannot be sealed (e.g. there is no key for the topic) nothing is published and the token will hold
+// the error.
+func (s *Sealer) Outbound(next mqtt.PublishFunc) mqtt.PublishFunc {
+	return func(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+		var data []byte
+		switch v := payload.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		case bytes.Buffer:
+			data = v.Bytes()
+		case *mqtt.PooledPayload:
+			data = v.Bytes()
+		default:
+			return next(topic, qos, retained, payload) // Let the client report the error
+		}
+		b, err := s.Seal(topic, data)
+		if err != nil {
+			return mqtt.ErrorToken(fmt.Errorf("failed to seal payload: %w", err))
+		}
+		return next(topic, qos, retained, b)
+	}
+}
+
+// Inbound is middleware (see mqtt.ClientOptions.UseInbound) that opens sealed payloads before they reach the
+// handler. Messages that cannot be opened (or are not sealed, unless AllowPlaintext is set) are passed to
+// OnReject and dropped (the message is still acknowledged). The replay check uses the message metadata (see
+// mqtt.Metadata) so that each route matching the message, and each retry of a handler, receives it.
+func (s *Sealer) Inbound(next mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if s.AllowPlaintext && !IsSealed(msg.Payload()) {
+			next(client, msg)
+			return
+		}
+		var delivery uint64
+		if md := mqtt.Metadata(msg); md != nil {
+			delivery = md.Delivery
+		}
+		plain, info, err := s.open(msg.Topic(), msg.Payload(), delivery)
+		if err != nil {
+			if s.OnReject != nil {
+				s.OnReject(msg.Topic(), err)
+			}
+			return
+		}
+		next(client, &Message{Message: msg, payload: plain, info: info})
+	}
+}
+
+// Message is passed to handlers by Inbound; it holds the decrypted payload
+type Message struct {
+	mqtt.Message
+	payload []byte
+	info    *Info
+}
+
+// Payload returns the decrypted payload
+func (m *Message) Payload() []byte { return m.payload }
+
+// Unwrap returns the message as received (allowing mqtt.Params etc. to access it)
+func (m *Message) Unwrap() mqtt.Message { return m.Message }
+
+// Envelope returns details of the envelope the payload was received in
+func (m *Message) Envelope() *Info { return m.info }
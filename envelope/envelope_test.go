@@ -0,0 +1,276 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package envelope
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testMessage implements mqtt.Message
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+
+var (
+	key16 = bytes.Repeat([]byte{1}, 16)
+	key32 = bytes.Repeat([]byte{2}, 32)
+)
+
+func Test_SealOpen(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		s    *Sealer
+	}{
+		{"aes unsigned", New().SetTopicKey("#", Key{ID: "k1", Cipher: AESGCM, Secret: key16})},
+		{"xchacha hmac", New().SetTopicKey("#", Key{ID: "k2", Cipher: XChaCha20Poly1305, Secret: key32}).
+			SignWithHMAC("h", []byte("secret"))},
+		{"aes ed25519", New().SetTopicKey("#", Key{ID: "k3", Cipher: AESGCM, Secret: key32}).
+			SignWithEd25519("e", priv).TrustEd25519("e", pub)},
+	}
+	for _, tt := range tests {
+		b, err := tt.s.Seal("a/b", []byte("secret payload"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if bytes.Contains(b, []byte("secret payload")) {
+			t.Fatalf("%s: payload not encrypted", tt.name)
+		}
+		if _, _, err = tt.s.Open("a/c", b); err == nil {
+			t.Fatalf("%s: expected error opening on a different topic", tt.name)
+		}
+		plain, info, err := tt.s.Open("a/b", b)
+		if err != nil || string(plain) != "secret payload" {
+			t.Fatalf("%s: unexpected result %q: %v", tt.name, plain, err)
+		}
+		if info.KeyID == "" || info.SignedBy != tt.s.signAlg {
+			t.Fatalf("%s: unexpected info %+v", tt.name, info)
+		}
+		if _, _, err = tt.s.Open("a/b", b); !errors.Is(err, ErrReplay) {
+			t.Fatalf("%s: expected ErrReplay, got %v", tt.name, err)
+		}
+
+		// Any modification must be detected
+		for i := len(magic) + 1; i < len(b); i++ {
+			tampered := bytes.Clone(b)
+			tampered[i] ^= 0x01
+			if _, _, err = tt.s.Open("a/b", tampered); err == nil {
+				t.Fatalf("%s: tampering with byte %d not detected", tt.name, i)
+			}
+		}
+	}
+}
+
+func Test_KeysAndAge(t *testing.T) {
+	now := time.Now()
+	pub := New().SetTopicKey("a/#", Key{ID: "old", Cipher: AESGCM, Secret: key16})
+	sub := New().AddKey("a/#", Key{ID: "old", Cipher: AESGCM, Secret: key16})
+	sub.now = func() time.Time { return now }
+
+	if _, err := pub.Seal("b", nil); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+	old, err := pub.Seal("a/1", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the key; the subscriber retains the old one
+	pub = New().SetTopicKey("a/#", Key{ID: "new", Cipher: AESGCM, Secret: key32})
+	rotated, err := pub.Seal("a/1", []byte("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = sub.Open("a/1", rotated); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	sub.AddKey("a/#", Key{ID: "new", Cipher: AESGCM, Secret: key32})
+	for _, b := range [][]byte{old, rotated} {
+		if _, _, err = sub.Open("a/1", b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// A key is only accepted on the topics it was added for
+	other := New().SetTopicKey("b/#", Key{ID: "b", Cipher: AESGCM, Secret: key16})
+	sub.AddKey("b/#", Key{ID: "b", Cipher: AESGCM, Secret: key16})
+	b, err := other.Seal("a/1", []byte("z"))
+	if err == nil {
+		t.Fatalf("expected error sealing with no key for topic")
+	}
+	other.SetTopicKey("a/#", Key{ID: "b", Cipher: AESGCM, Secret: key16}) // Publisher misconfigured
+	if b, err = other.Seal("a/1", []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = sub.Open("a/1", b); !errors.Is(err, ErrKeyNotForTopic) {
+		t.Fatalf("expected ErrKeyNotForTopic, got %v", err)
+	}
+
+	// Nonces are forgotten once they have expired
+	later := now.Add(DefaultMaxAge / 2)
+	pub.now = func() time.Time { return later }
+	fresh, err := pub.Seal("a/1", []byte("w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.now = func() time.Time { return later }
+	if _, _, err = sub.Open("a/1", fresh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sub.seen) != 3 || len(sub.expires) != 3 {
+		t.Fatalf("expected 3 nonces, got %d/%d", len(sub.seen), len(sub.expires))
+	}
+	pub.now = func() time.Time { return now.Add(DefaultMaxAge + time.Second) }
+	if fresh, err = pub.Seal("a/1", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	sub.now = pub.now
+	if _, _, err = sub.Open("a/1", fresh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sub.seen) != 2 || len(sub.expires) != 2 {
+		t.Fatalf("expected expired nonces to be forgotten, got %d/%d", len(sub.seen), len(sub.expires))
+	}
+	pub.now = time.Now
+
+	sub.now = func() time.Time { return now.Add(DefaultMaxAge + time.Second) }
+	if b, _ := pub.Seal("a/1", nil); b != nil {
+		if _, _, err = sub.Open("a/1", b); !errors.Is(err, ErrExpired) {
+			t.Fatalf("expected ErrExpired, got %v", err)
+		}
+	}
+
+	sub.RequireSignature = true
+	if _, _, err = sub.Open("a/1", rotated); !errors.Is(err, ErrSignatureRequired) {
+		t.Fatalf("expected ErrSignatureRequired, got %v", err)
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	s := New().SetTopicKey("#", Key{ID: "k", Cipher: XChaCha20Poly1305, Secret: key32})
+	var rejected []error
+	s.OnReject = func(_ string, err error) { rejected = append(rejected, err) }
+
+	var sent []byte
+	publish := s.Outbound(func(_ string, _ byte, _ bool, payload interface{}) mqtt.Token {
+		sent = payload.([]byte)
+		return mqtt.ErrorToken(nil)
+	})
+	var received mqtt.Message
+	handler := s.Inbound(func(_ mqtt.Client, m mqtt.Message) { received = m })
+
+	publish("t", 1, false, "hello")
+	if !IsSealed(sent) {
+		t.Fatalf("payload not sealed")
+	}
+	handler(nil, &testMessage{topic: "t", payload: sent})
+	if m, ok := received.(*Message); !ok || string(m.Payload()) != "hello" || m.Envelope().KeyID != "k" {
+		t.Fatalf("unexpected message %+v", received)
+	}
+
+	received = nil
+	handler(nil, &testMessage{topic: "t", payload: []byte("plain")})
+	if received != nil || len(rejected) != 1 || !errors.Is(rejected[0], ErrNotSealed) {
+		t.Fatalf("expected plaintext to be rejected (got %v)", rejected)
+	}
+	s.AllowPlaintext = true
+	handler(nil, &testMessage{topic: "t", payload: []byte("plain")})
+	if received == nil {
+		t.Fatalf("expected plaintext to be delivered")
+	}
+}
+
+// deliveredMessage emulates a message received by the client (the metadata identifies the delivery)
+type deliveredMessage struct {
+	testMessage
+	delivery uint64
+}
+
+func (m *deliveredMessage) Metadata() *mqtt.MessageMetadata {
+	return &mqtt.MessageMetadata{Delivery: m.delivery}
+}
+
+// routedMessage emulates the wrapper the client passes to the handler of each matching route
+type routedMessage struct{ mqtt.Message }
+
+func (m routedMessage) Unwrap() mqtt.Message { return m.Message }
+
+func Test_MiddlewareMultipleRoutes(t *testing.T) {
+	s := New().SetTopicKey("#", Key{ID: "k", Cipher: XChaCha20Poly1305, Secret: key32})
+	var rejected []error
+	s.OnReject = func(_ string, err error) { rejected = append(rejected, err) }
+	b, err := s.Seal("a/b", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	route1 := s.Inbound(func(_ mqtt.Client, m mqtt.Message) { received = append(received, "1:"+string(m.Payload())) })
+	route2 := s.Inbound(func(_ mqtt.Client, m mqtt.Message) { received = append(received, "2:"+string(m.Payload())) })
+	m := &deliveredMessage{testMessage: testMessage{topic: "a/b", payload: b}, delivery: 1}
+	route1(nil, routedMessage{m})
+	route2(nil, routedMessage{m})
+	if len(rejected) != 0 || len(received) != 2 || received[0] != "1:hello" || received[1] != "2:hello" {
+		t.Fatalf("expected both routes to receive the message, got %v (rejected %v)", received, rejected)
+	}
+
+	// The same payload in a different delivery is a replay
+	route1(nil, routedMessage{&deliveredMessage{testMessage: testMessage{topic: "a/b", payload: b}, delivery: 2}})
+	if len(received) != 2 || len(rejected) != 1 || !errors.Is(rejected[0], ErrReplay) {
+		t.Fatalf("expected replay to be rejected, got %v (rejected %v)", received, rejected)
+	}
+}
+
+func Test_MiddlewareRetry(t *testing.T) {
+	s := New().SetTopicKey("#", Key{ID: "k", Cipher: XChaCha20Poly1305, Secret: key32})
+	var rejected []error
+	s.OnReject = func(_ string, err error) { rejected = append(rejected, err) }
+	b, err := s.Seal("a", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	handler := s.Inbound(func(_ mqtt.Client, m mqtt.Message) {
+		if attempts++; attempts == 1 {
+			panic("fail first attempt")
+		}
+		if string(m.Payload()) != "hello" {
+			t.Errorf("unexpected payload %q", m.Payload())
+		}
+	})
+	m := routedMessage{&deliveredMessage{testMessage: testMessage{topic: "a", payload: b}, delivery: 7}}
+	func() {
+		defer func() { _ = recover() }() // The client recovers the panic and calls the handler again
+		handler(nil, m)
+	}()
+	handler(nil, m)
+	if attempts != 2 || len(rejected) != 0 {
+		t.Fatalf("expected the retry to receive the message, attempts %d (rejected %v)", attempts, rejected)
+	}
+}
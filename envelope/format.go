@@ -0,0 +1,148 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Wire format (all integers big endian):
+//
+//	magic       4 bytes  0x00 'M' 'Q' 'E'
+//	version     1 byte   (1)
+//	cipher      1 byte   Cipher
+//	signature   1 byte   SignatureAlgorithm
+//	timestamp   8 bytes  Unix time (nanoseconds) at which the message was sealed
+//	key id      1 byte length + key ID
+//	signer id   1 byte length + signing key ID (empty if unsigned)
+//	nonce       1 byte length + nonce
+//	ciphertext  4 byte length + ciphertext (including the AEAD tag)
+//	signature   remaining bytes
+//
+// The fields up to and including the nonce (the header) and the topic are authenticated as additional data by the
+// AEAD. The signature covers everything preceding it, followed by the topic.
+
+var magic = []byte{0x00, 'M', 'Q', 'E'}
+
+const version = 1
+
+// sealed is a decoded envelope
+type sealed struct {
+	cipher     Cipher
+	sigAlg     SignatureAlgorithm
+	time       time.Time
+	keyID      string
+	signerID   string
+	nonce      []byte
+	ciphertext []byte
+	signature  []byte
+
+	header []byte // raw header (authenticated data)
+	signed []byte // raw bytes covered by the signature
+}
+
+// IsSealed reports whether payload appears to be an envelope
+func IsSealed(payload []byte) bool {
+	return len(payload) > len(magic) && bytes.Equal(payload[:len(magic)], magic)
+}
+
+// appendHeader appends the header fields to b
+func (s *sealed) appendHeader(b []byte) []byte {
+	b = append(b, magic...)
+	b = append(b, version, byte(s.cipher), byte(s.sigAlg))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.time.UnixNano()))
+	b = appendShort(b, []byte(s.keyID))
+	b = appendShort(b, []byte(s.signerID))
+	return appendShort(b, s.nonce)
+}
+
+// appendCiphertext appends the length prefixed ciphertext to b
+func appendCiphertext(b, ct []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ct)))
+	return append(b, ct...)
+}
+
+func appendShort(b, v []byte) []byte {
+	b = append(b, byte(len(v)))
+	return append(b, v...)
+}
+
+// decode parses an envelope
+func decode(b []byte) (*sealed, error) {
+	if !IsSealed(b) {
+		return nil, ErrNotSealed
+	}
+	r := reader{b: b, off: len(magic)}
+	if v := r.byte(); v != version {
+		return nil, ErrMalformed
+	}
+	s := &sealed{
+		cipher: Cipher(r.byte()),
+		sigAlg: SignatureAlgorithm(r.byte()),
+	}
+	s.time = time.Unix(0, int64(r.uint64()))
+	s.keyID = string(r.short())
+	s.signerID = string(r.short())
+	s.nonce = r.short()
+	s.header = b[:r.off]
+	s.ciphertext = r.bytes(int(r.uint32()))
+	if r.err {
+		return nil, ErrMalformed
+	}
+	s.signed = b[:r.off]
+	s.signature = b[r.off:]
+	return s, nil
+}
+
+// reader reads fields from an envelope; err is set if the data is too short
+type reader struct {
+	b   []byte
+	off int
+	err bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || n < 0 || len(r.b)-r.off < n {
+		r.err = true
+		return nil
+	}
+	v := r.b[r.off : r.off+n]
+	r.off += n
+	return v
+}
+
+func (r *reader) byte() byte {
+	if v := r.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *reader) short() []byte { return r.bytes(int(r.byte())) }
+
+func (r *reader) uint32() uint32 {
+	if v := r.bytes(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if v := r.bytes(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
@@ -21,6 +21,8 @@ package mqtt
 import (
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -47,6 +49,57 @@ type message struct {
 	payload   []byte
 	once      sync.Once
 	ack       func()
+	meta      MessageMetadata
+	pooled    bool // payload may be returned to the pool (see ClientOptions.SetPooledPayloads)
+	handlers  int  // number of handlers the message was passed to (the payload is only released if there is one)
+	released  atomic.Bool
+}
+
+// MessageMetadata holds information about the receipt of a message (see Metadata)
+type MessageMetadata struct {
+	ReceivedAt time.Time // When the message was passed to the router
+	Route      string    // Filter of the route (subscription) that matched; "" for the default handler
+	Broker     *url.URL  // Broker the message was received from
+	Generation uint64    // Connection the message was received on (incremented each time a connection is established)
+	WireSize   int       // Size of the PUBLISH packet (including the fixed header)
+	Delivery   uint64    // Identifies the receipt of the message; every handler (and retry) for it sees the same value
+}
+
+// Metadata returns information about the receipt of a message passed to a MessageHandler (nil if the message did
+// not originate from this package). Messages wrapped by middleware are supported as long as the wrapper
+// implements Unwrap() Message.
+func Metadata(m Message) *MessageMetadata {
+	for m != nil {
+		if md, ok := m.(interface{ Metadata() *MessageMetadata }); ok {
+			return md.Metadata()
+		}
+		u, ok := m.(interface{ Unwrap() Message })
+		if !ok {
+			return nil
+		}
+		m = u.Unwrap()
+	}
+	return nil
+}
+
+// ReleasePayload returns the payload buffer of a message received with ClientOptions.SetPooledPayloads enabled
+// to the pool. Messages wrapped by middleware are supported as long as the wrapper implements Unwrap() Message.
+// It returns false (and does nothing) if the message payload is not pooled, has already been released, or the
+// message was passed to more than one handler (i.e. multiple routes matched; another handler may still be using it).
+//
+// Neither the message payload, nor any slice of it, may be used after it has been released.
+func ReleasePayload(m Message) bool {
+	for m != nil {
+		if r, ok := m.(interface{ ReleasePayload() bool }); ok {
+			return r.ReleasePayload()
+		}
+		u, ok := m.(interface{ Unwrap() Message })
+		if !ok {
+			return false
+		}
+		m = u.Unwrap()
+	}
+	return false
 }
 
 func (m *message) Duplicate() bool {
@@ -77,7 +130,25 @@ func (m *message) Ack() {
 	m.once.Do(m.ack)
 }
 
-func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
+// ReleasePayload returns the payload buffer to the pool (see the ReleasePayload function)
+func (m *message) ReleasePayload() bool {
+	if !m.pooled || m.handlers > 1 || !m.released.CompareAndSwap(false, true) {
+		return false
+	}
+	packets.PutBuffer(m.payload)
+	m.payload = nil
+	return true
+}
+
+// Metadata returns a copy of the message metadata
+func (m *message) Metadata() *MessageMetadata {
+	md := m.meta
+	return &md
+}
+
+// messageFromPublish creates the Message passed to handlers; broker and generation identify the connection it
+// was received on
+func messageFromPublish(p *packets.PublishPacket, ack func(), broker *url.URL, generation uint64) *message {
 	return &message{
 		duplicate: p.Dup,
 		qos:       p.Qos,
@@ -86,7 +157,32 @@ func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
 		messageID: p.MessageID,
 		payload:   p.Payload,
 		ack:       ack,
+		meta: MessageMetadata{
+			ReceivedAt: time.Now(),
+			Broker:     broker,
+			Generation: generation,
+			WireSize:   publishWireSize(p),
+		},
+	}
+}
+
+// publishWireSize returns the size of the encoded packet
+func publishWireSize(p *packets.PublishPacket) int {
+	remaining := p.RemainingLength
+	if remaining == 0 { // Not read from the network
+		remaining = 2 + len(p.TopicName) + len(p.Payload)
+		if p.Qos > 0 {
+			remaining += 2
+		}
+	}
+	size := 1 + remaining // Packet type & flags
+	for n := remaining; ; n /= 128 {
+		size++ // Remaining length (variable byte integer)
+		if n < 128 {
+			break
+		}
 	}
+	return size
 }
 
 func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.ConnectPacket {
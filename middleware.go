@@ -0,0 +1,68 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import "github.com/eclipse/paho.mqtt.golang/packets"
+
+// PublishFunc has the same signature as Client.Publish; it is used by outbound middleware (see
+// ClientOptions.UseOutbound)
+type PublishFunc func(topic string, qos byte, retained bool, payload interface{}) Token
+
+// UseInbound adds middleware that will wrap every MessageHandler (including the default handler) when a message
+// is dispatched. Middleware is applied in the order added; the first added is the outermost so is called first
+// (and returns last). For example, with UseInbound(a, b) a message is processed by a, then b, then the handler.
+//
+// Middleware can inspect or replace the message, skip the handler (by not calling next) or perform work after the
+// handler returns. Note that, unless AutoAckDisabled is set, the message is acknowledged once the wrapped
+// handler (and those for any other matching routes) returns.
+func (o *ClientOptions) UseInbound(mw ...func(MessageHandler) MessageHandler) *ClientOptions {
+	o.InboundMiddleware = append(o.InboundMiddleware, mw...)
+	return o
+}
+
+// UseOutbound adds middleware that wraps Client.Publish; it is called before the message is validated, persisted
+// or sent. Middleware is applied in the order added; the first added is the outermost so is called first. For
+// example, with UseOutbound(a, b) a call to Publish is processed by a, then b and then the client.
+//
+// Middleware may modify any of the parameters, or return a Token without calling next (in which case nothing
+// will be published).
+func (o *ClientOptions) UseOutbound(mw ...func(PublishFunc) PublishFunc) *ClientOptions {
+	o.OutboundMiddleware = append(o.OutboundMiddleware, mw...)
+	return o
+}
+
+// wrapInbound applies the inbound middleware to h
+func (c *client) wrapInbound(h MessageHandler) MessageHandler {
+	mw := c.options.InboundMiddleware
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// buildOutbound applies the outbound middleware to publish
+func buildOutbound(publish PublishFunc, mw []func(PublishFunc) PublishFunc) PublishFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		publish = mw[i](publish)
+	}
+	return publish
+}
+
+// ErrorToken returns a completed Token holding err. This allows outbound middleware (and other code wrapping
+// Publish) to fail a publish without calling next.
+func ErrorToken(err error) Token {
+	t := newToken(packets.Publish).(*PublishToken)
+	t.setError(err)
+	return t
+}
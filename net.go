@@ -83,6 +83,9 @@ func connectMQTT(conn io.ReadWriter, cm *packets.ConnectPacket, protocolVersion
 	return rc, sessionPresent, err
 }
 
+// connackSize is the size of a CONNACK packet (MQTT 3.1 and 3.1.1); anything larger is rejected before being read
+const connackSize = 4
+
 // This function is only used for receiving a connack
 // when the connection is first started.
 // This prevents receiving incoming data while resume
@@ -90,7 +93,9 @@ func connectMQTT(conn io.ReadWriter, cm *packets.ConnectPacket, protocolVersion
 func verifyCONNACK(conn io.Reader, logger *slog.Logger) (byte, bool, error) {
 	logger.Debug("connect started", slog.String("component", string(NET)))
 
-	ca, err := packets.ReadPacket(conn)
+	reader := packets.NewUnbufferedReader(conn) // Must not read beyond the CONNACK
+	reader.MaxPacketSize = connackSize
+	ca, err := reader.ReadPacket()
 	if err != nil {
 		logger.Error("connect got error", slog.String("error", err.Error()), slog.String("component", string(NET)))
 		return packets.ErrNetworkError, false, err
@@ -122,20 +127,25 @@ type inbound struct {
 // startIncoming initiates a goroutine that reads incoming messages off the wire and sends them to the channel (returned).
 // If there are any issues with the network connection then the returned channel will be closed and the goroutine will exit
 // (so closing the connection will terminate the goroutine)
-func startIncoming(conn io.Reader, logger *slog.Logger) <-chan inbound {
+func startIncoming(conn io.Reader, c commsFns, logger *slog.Logger) <-chan inbound {
 	var err error
 	var cp packets.ControlPacket
 	ibound := make(chan inbound)
+	reader := c.newReader(conn)
 
 	logger.Debug("incoming started", slog.String("component", string(NET)))
 
 	go func() {
 		for {
-			if cp, err = packets.ReadPacket(conn); err != nil {
+			if cp, err = reader.ReadPacket(); err != nil {
 				// We do not want to log the error if it is due to the network connection having been closed
 				// elsewhere (i.e. after sending DisconnectPacket). Detecting this situation is the subject of
 				// https://github.com/golang/go/issues/4373
 				if !strings.Contains(err.Error(), closedNetConnErrorText) {
+					var pe *packets.ProtocolError
+					if errors.As(err, &pe) {
+						logger.Warn("protocol error in packet received, closing connection", slog.String("error", err.Error()), slog.String("component", string(NET)))
+					}
 					ibound <- inbound{err: err}
 				}
 				close(ibound)
@@ -168,7 +178,7 @@ func startIncomingComms(conn io.Reader,
 	inboundFromStore <-chan packets.ControlPacket,
 	logger *slog.Logger,
 ) <-chan incomingComms {
-	ibound := startIncoming(conn, logger) // Start goroutine that reads from network connection
+	ibound := startIncoming(conn, c, logger) // Start goroutine that reads from network connection
 	output := make(chan incomingComms)
 
 	logger.Debug("startIncomingComms started", slog.String("component", string(NET)))
@@ -222,6 +232,11 @@ func startIncomingComms(conn io.Reader,
 					for i, qos := range m.ReturnCodes {
 						t.subResult[t.subs[i]] = qos
 					}
+					if t.onSuback != nil {
+						if err := t.onSuback(t.subResult); err != nil {
+							t.setError(err)
+						}
+					}
 				}
 
 				token.flowComplete()
@@ -377,6 +392,7 @@ type commsFns interface {
 	persistOutbound(m packets.ControlPacket) // add the packet to the outbound store
 	persistInbound(m packets.ControlPacket)  // add the packet to the inbound store
 	pingRespReceived()                       // Called when a ping response is received
+	newReader(r io.Reader) *packets.Reader   // Create the reader used to read packets from the connection
 }
 
 // startComms initiates goroutines that handles communications over the network connection
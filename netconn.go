@@ -20,6 +20,7 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -35,21 +36,45 @@ import (
 // This just establishes the network connection; once established the type of connection should be irrelevant
 //
 
+// isTLSScheme reports whether connections to brokers using the scheme are secured with TLS
+func isTLSScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
 // openConnection opens a network connection using the protocol indicated in the URL.
 // Does not carry out any MQTT specific handshakes.
-func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer *net.Dialer) (net.Conn, error) {
+// If proxyDial is not nil it will be used to establish the underlying connection (for all transports); otherwise
+// the proxy (if any) is determined from the environment.
+// If alpn is not empty then, following the TLS handshake, the negotiated protocol is checked against it and
+// an *ALPNError returned if it does not match (alpn is ignored for schemes that do not use TLS).
+func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer *net.Dialer, proxyDial dialContextFunc, alpn []string) (conn net.Conn, err error) {
+	defer func() {
+		if err == nil && isTLSScheme(uri.Scheme) {
+			if err = verifyALPN(conn, alpn); err != nil {
+				_ = conn.Close()
+				conn = nil
+			}
+		}
+	}()
 	switch uri.Scheme {
 	case "ws":
 		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
 		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), nil, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(dialURI.String(), nil, timeout, headers, websocketOptions, proxyDial)
 		return conn, err
 	case "wss":
 		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
 		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), tlsc, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(dialURI.String(), tlsc, timeout, headers, websocketOptions, proxyDial)
 		return conn, err
 	case "mqtt", "tcp":
+		if proxyDial != nil {
+			return dialWithTimeout(proxyDial, uri.Host, timeout)
+		}
 		proxyDialer := proxy.FromEnvironmentUsing(dialer)
 		conn, err := proxyDialer.Dial("tcp", uri.Host)
 		if err != nil {
@@ -73,6 +98,13 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 		}
 		return conn, nil
 	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		if proxyDial != nil {
+			conn, err := dialWithTimeout(proxyDial, uri.Host, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return tlsHandshake(conn, uri, tlsc, timeout)
+		}
 		allProxy := os.Getenv("all_proxy")
 		if len(allProxy) == 0 {
 			conn, err := tls.DialWithDialer(dialer, "tcp", uri.Host, tlsc)
@@ -99,3 +131,37 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 	}
 	return nil, errors.New("unknown protocol")
 }
+
+// dialWithTimeout establishes a tcp connection using dial; timeout (if non-zero) limits the time allowed
+func dialWithTimeout(dial dialContextFunc, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, "tcp", addr)
+}
+
+// tlsHandshake performs a TLS client handshake over conn (which is closed on failure)
+func tlsHandshake(conn net.Conn, uri *url.URL, tlsc *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsc == nil {
+		tlsc = &tls.Config{}
+	}
+	if tlsc.ServerName == "" && !tlsc.InsecureSkipVerify { // as per tls.DialWithDialer
+		tlsc = tlsc.Clone()
+		tlsc.ServerName = uri.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsc)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
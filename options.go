@@ -64,6 +64,15 @@ type ConnectionAttemptHandler func(broker *url.URL, tlsCfg *tls.Config) *tls.Con
 // Does not carry out any MQTT specific handshakes.
 type OpenConnectionFunc func(uri *url.URL, options ClientOptions) (net.Conn, error)
 
+// ResubscribeHandler is invoked when the client has automatically resubscribed (see
+// ClientOptions.SetAutoResubscribe); failures holds an error for each filter that could
+// not be restored (it will be empty if all subscriptions were restored).
+type ResubscribeHandler func(client Client, failures map[string]error)
+
+// SubscriptionErrorHandler is invoked when the broker rejects a subscription or grants a
+// lower QoS than requested (see SubscriptionError.Rejected).
+type SubscriptionErrorHandler func(client Client, err *SubscriptionError)
+
 // ConnectionNotificationHandler is invoked for any type of connection event.
 type ConnectionNotificationHandler func(Client, ConnectionNotification)
 
@@ -88,7 +97,11 @@ type ClientOptions struct {
 	ProtocolVersion          uint
 	protocolVersionExplicit  bool
 	TLSConfig                *tls.Config
-	KeepAlive                int64 // Warning: Some brokers may reject connections with Keepalive = 0.
+	TLSReloader              *TLSReloader
+	TLSVerifier              *TLSVerifier
+	TLSProfile               *TLSConnectionProfile
+	BrokerTLSProfiles        map[string]*TLSConnectionProfile // keyed by broker host (host:port)
+	KeepAlive                int64                            // Warning: Some brokers may reject connections with Keepalive = 0.
 	PingTimeout              time.Duration
 	ConnectTimeout           time.Duration
 	MaxReconnectInterval     time.Duration
@@ -105,12 +118,35 @@ type ClientOptions struct {
 	WriteTimeout             time.Duration
 	MessageChannelDepth      uint
 	ResumeSubs               bool
+	AutoResubscribe          bool
+	OnResubscribe            ResubscribeHandler
+	QoSDowngradeIsError      bool
+	OnSubscriptionError      SubscriptionErrorHandler
+	InboundMiddleware        []func(MessageHandler) MessageHandler // see UseInbound
+	OutboundMiddleware       []func(PublishFunc) PublishFunc       // see UseOutbound
+	PayloadCodec             Codec                                 // used by PublishTyped/SubscribeTyped (nil = JSON)
+	topicCodecs              []topicCodec                          // see SetTopicCodec
+	OnDecodeError            DecodeErrorHandler
+	HandlerFailurePolicy     *HandlerFailurePolicy
+	DispatchWorkers          int                  // 0 = dispatch as per Order; see SetDispatchWorkers
+	DispatchQueueSize        int                  // per worker; 0 = DefaultDispatchQueueSize
+	DispatchKeyFunc          func(Message) string // nil = use topic
+	RateLimit                RateLimit
+	topicRateLimits          []topicRateLimit // see SetTopicRateLimit
+	RateLimitMode            RateLimitMode
 	HTTPHeaders              http.Header
 	WebsocketOptions         *WebsocketOptions
 	MaxResumePubInFlight     int // // 0 = no limit; otherwise this is the maximum simultaneous messages sent while resuming
 	Dialer                   *net.Dialer
+	Proxy                    *ProxyConfig
+	BrokerProxies            map[string]*ProxyConfig // keyed by broker host (host:port); nil value = direct connection
 	CustomOpenConnectionFn   OpenConnectionFunc
 	AutoAckDisabled          bool
+	PooledPayloads           bool // see SetPooledPayloads
+	MaxInboundPacketSize     int  // 0 = no limit (other than the 256MB imposed by the spec)
+	StrictProtocol           bool // validate inbound packets (see SetStrictProtocol)
+	RoutePatterns            bool // see SetRoutePatterns
+	PacketTap                PacketTap
 	Logger                   *slog.Logger
 }
 
@@ -174,13 +210,7 @@ func NewClientOptions() *ClientOptions {
 //
 // An example broker URI would look like: tcp://foobar.com:1883
 func (o *ClientOptions) AddBroker(server string) *ClientOptions {
-	if len(server) > 0 && server[0] == ':' {
-		server = "127.0.0.1" + server
-	}
-	if !strings.Contains(server, "://") {
-		server = "tcp://" + server
-	}
-	brokerURI, err := url.Parse(server)
+	brokerURI, err := parseBrokerURI(server)
 	if err != nil {
 		ERROR.Println(CLI, "Failed to parse %q broker address: %s", server, err)
 		return o
@@ -189,6 +219,17 @@ func (o *ClientOptions) AddBroker(server string) *ClientOptions {
 	return o
 }
 
+// parseBrokerURI parses a broker address in the format accepted by AddBroker
+func parseBrokerURI(server string) (*url.URL, error) {
+	if len(server) > 0 && server[0] == ':' {
+		server = "127.0.0.1" + server
+	}
+	if !strings.Contains(server, "://") {
+		server = "tcp://" + server
+	}
+	return url.Parse(server)
+}
+
 // SetResumeSubs will enable resuming of stored (un)subscribe messages when connecting
 // but not reconnecting if CleanSession is false. Otherwise these messages are discarded.
 func (o *ClientOptions) SetResumeSubs(resume bool) *ClientOptions {
@@ -263,6 +304,48 @@ func (o *ClientOptions) SetTLSConfig(t *tls.Config) *ClientOptions {
 	return o
 }
 
+// SetTLSReloader will set a TLSReloader that provides the client certificate and root CAs used when connecting
+// to an MQTT broker. The reloader is applied to a copy of the TLSConfig (see SetTLSConfig) for each connection
+// attempt (prior to calling any ConnectionAttemptHandler) so certificates rotated on disk will be picked up
+// when the client next connects (see TLSReloader.TLSConfig for how it interacts with the certificates in the
+// TLSConfig). If the reloader has RenewBefore set (and AutoReconnect is enabled) the client
+// will reconnect before the certificate in use expires.
+func (o *ClientOptions) SetTLSReloader(r *TLSReloader) *ClientOptions {
+	o.TLSReloader = r
+	return o
+}
+
+// SetTLSVerifier sets a TLSVerifier that will carry out additional checks (public key pinning and OCSP) on the
+// broker certificate after the standard verification has completed. Failures will be reported via
+// ConnectionNotificationBrokerFailed.
+func (o *ClientOptions) SetTLSVerifier(v *TLSVerifier) *ClientOptions {
+	o.TLSVerifier = v
+	return o
+}
+
+// SetTLSProfile sets the TLSConnectionProfile (SNI and ALPN settings) used when connecting to brokers over TLS
+// (including wss). Use SetBrokerTLSProfile to override this for individual brokers.
+func (o *ClientOptions) SetTLSProfile(p *TLSConnectionProfile) *ClientOptions {
+	o.TLSProfile = p
+	return o
+}
+
+// SetBrokerTLSProfile sets the TLSConnectionProfile used when connecting to the specified broker (the broker is
+// identified by host and port so should be specified in the same format as passed to AddBroker). This overrides
+// the profile set with SetTLSProfile; passing nil means that no profile will be applied.
+func (o *ClientOptions) SetBrokerTLSProfile(broker string, p *TLSConnectionProfile) *ClientOptions {
+	brokerURI, err := parseBrokerURI(broker)
+	if err != nil {
+		ERROR.Println(CLI, "Failed to parse %q broker address: %s", broker, err)
+		return o
+	}
+	if o.BrokerTLSProfiles == nil {
+		o.BrokerTLSProfiles = make(map[string]*TLSConnectionProfile)
+	}
+	o.BrokerTLSProfiles[brokerURI.Host] = p
+	return o
+}
+
 // SetStore will set the implementation of the Store interface
 // used to provide message persistence in cases where QoS levels
 // QoS_ONE or QoS_TWO are used. If no store is provided, then the
@@ -433,6 +516,38 @@ func (o *ClientOptions) SetMessageChannelDepth(s uint) *ClientOptions {
 	return o
 }
 
+// SetAutoResubscribe will set the client to automatically restore all subscriptions (see
+// SubscriptionLister) when the broker reports that no session is present upon connection
+// (e.g. following a reconnection with CleanSession true). This removes the need to
+// resubscribe in the OnConnect handler; use SetOnResubscribeHandler to find out about failures.
+func (o *ClientOptions) SetAutoResubscribe(resubscribe bool) *ClientOptions {
+	o.AutoResubscribe = resubscribe
+	return o
+}
+
+// SetOnResubscribeHandler sets the handler that is called once an automatic resubscription
+// completes (see SetAutoResubscribe).
+func (o *ClientOptions) SetOnResubscribeHandler(onResubscribe ResubscribeHandler) *ClientOptions {
+	o.OnResubscribe = onResubscribe
+	return o
+}
+
+// SetQoSDowngradeIsError will set whether a subscription granted with a lower QoS than requested
+// is treated as an error (the SubscribeToken will return a *SubscriptionError). By default
+// only subscriptions rejected by the broker result in an error. Note that a downgraded
+// subscription remains active; call Unsubscribe if the granted QoS is not acceptable.
+func (o *ClientOptions) SetQoSDowngradeIsError(isError bool) *ClientOptions {
+	o.QoSDowngradeIsError = isError
+	return o
+}
+
+// SetSubscriptionErrorHandler sets the handler that is called whenever the broker rejects a
+// subscription, or grants a lower QoS than requested (including when resubscribing).
+func (o *ClientOptions) SetSubscriptionErrorHandler(onError SubscriptionErrorHandler) *ClientOptions {
+	o.OnSubscriptionError = onError
+	return o
+}
+
 // SetHTTPHeaders sets the additional HTTP headers that will be sent in the WebSocket
 // opening handshake.
 func (o *ClientOptions) SetHTTPHeaders(h http.Header) *ClientOptions {
@@ -462,6 +577,30 @@ func (o *ClientOptions) SetDialer(dialer *net.Dialer) *ClientOptions {
 	return o
 }
 
+// SetProxy sets the proxy through which connections to the broker(s) will be established. The proxy is used for
+// all transports (tcp, tls, ws and wss) and, when set, takes precedence over the proxy environment variables and
+// WebsocketOptions.Proxy. Use SetBrokerProxy to override this for individual brokers.
+func (o *ClientOptions) SetProxy(p *ProxyConfig) *ClientOptions {
+	o.Proxy = p
+	return o
+}
+
+// SetBrokerProxy sets the proxy to be used when connecting to the specified broker (the broker is identified by
+// host and port so should be specified in the same format as passed to AddBroker). This overrides the proxy set
+// with SetProxy; passing a nil ProxyConfig means that a direct connection will be made.
+func (o *ClientOptions) SetBrokerProxy(broker string, p *ProxyConfig) *ClientOptions {
+	brokerURI, err := parseBrokerURI(broker)
+	if err != nil {
+		ERROR.Println(CLI, "Failed to parse %q broker address: %s", broker, err)
+		return o
+	}
+	if o.BrokerProxies == nil {
+		o.BrokerProxies = make(map[string]*ProxyConfig)
+	}
+	o.BrokerProxies[brokerURI.Host] = p
+	return o
+}
+
 // SetCustomOpenConnectionFn replaces the inbuilt function that establishes a network connection with a custom function.
 // The passed in function should return an open `net.Conn` or an error (see the existing openConnection function for an example)
 // It enables custom networking types in addition to the defaults (tcp, tls, websockets...)
@@ -480,6 +619,53 @@ func (o *ClientOptions) SetAutoAckDisabled(autoAckDisabled bool) *ClientOptions
 	return o
 }
 
+// SetPooledPayloads, if true, results in the payloads of received messages being read into pooled buffers. A
+// handler that has finished with a message (and retains no reference to its payload) may then call
+// ReleasePayload to return the buffer to the pool, reducing allocations when receiving at high rates. Messages
+// that are not released are garbage collected as usual.
+//
+// Where a message matches multiple routes the same message is passed to each handler; ReleasePayload then does
+// nothing (as another handler may still be using the payload).
+func (o *ClientOptions) SetPooledPayloads(pooled bool) *ClientOptions {
+	o.PooledPayloads = pooled
+	return o
+}
+
+// SetMaxInboundPacketSize sets the maximum size (in bytes, including the fixed header) of a packet that will be
+// accepted from the broker. The size is checked before memory is allocated for the packet; if it is exceeded a
+// *packets.ProtocolError is raised and the connection closed (and the connection lost handler called). This
+// protects against a broken, or malicious, broker causing excessive memory use. 0 (the default) means no limit.
+func (o *ClientOptions) SetMaxInboundPacketSize(size int) *ClientOptions {
+	o.MaxInboundPacketSize = size
+	return o
+}
+
+// SetStrictProtocol enables or disables (the default) validation of packets received from the broker against the
+// MQTT 3.1.1 spec (reserved flags, QoS 3, malformed UTF-8 topic names etc). When enabled, and a violation is
+// detected, a *packets.ProtocolError is raised and the connection closed (and the connection lost handler called).
+// Validation is opt-in as enabling it may cause connections to slightly non-compliant brokers to be dropped.
+// The limit set by SetMaxInboundPacketSize applies regardless of this setting.
+func (o *ClientOptions) SetStrictProtocol(strict bool) *ClientOptions {
+	o.StrictProtocol = strict
+	return o
+}
+
+// SetRoutePatterns enables or disables (the default) topic patterns with named parameters (see Params). When enabled,
+// topics passed to Subscribe, SubscribeMultiple, AddRoute and Unsubscribe may contain levels such as "{id}" which
+// are translated to wildcards. When disabled, topics are used as is (so "devices/{id}/state" is a literal topic).
+func (o *ClientOptions) SetRoutePatterns(enabled bool) *ClientOptions {
+	o.RoutePatterns = enabled
+	return o
+}
+
+// SetPacketTap sets a PacketTap that will be passed every packet sent to, or received from, the broker, starting
+// with the CONNECT (in which the username and password are redacted) and CONNACK of each connection attempt. This is
+// intended to assist in diagnosing issues; see the capture package for a tap that records packets to a file.
+func (o *ClientOptions) SetPacketTap(tap PacketTap) *ClientOptions {
+	o.PacketTap = tap
+	return o
+}
+
 // SetLogger sets the logger instance used by the client.
 //
 // By default, no logger is configured.
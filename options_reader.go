@@ -63,6 +63,12 @@ func (r *ClientOptionsReader) ResumeSubs() bool {
 	return s
 }
 
+// AutoResubscribe returns true if subscriptions will be restored when no session is present
+func (r *ClientOptionsReader) AutoResubscribe() bool {
+	s := r.options.AutoResubscribe
+	return s
+}
+
 // ClientID returns the set client id
 func (r *ClientOptionsReader) ClientID() string {
 	s := r.options.ClientID
@@ -144,7 +144,9 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 		return nil, err
 	}
 
-	packetBytes := make([]byte, fh.RemainingLength)
+	// Unpack copies anything it retains so the packet body can be read into a pooled buffer
+	packetBytes := GetBuffer(fh.RemainingLength)
+	defer PutBuffer(packetBytes)
 	n, err := io.ReadFull(r, packetBytes)
 	if err != nil {
 		return nil, err
@@ -153,7 +155,7 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 		return nil, errors.New("failed to read expected data")
 	}
 
-	err = cp.Unpack(bytes.NewBuffer(packetBytes))
+	err = cp.Unpack(bytes.NewReader(packetBytes))
 	return cp, err
 }
 
@@ -265,15 +267,37 @@ func boolToByte(b bool) byte {
 
 func (fh *FixedHeader) pack() (bytes.Buffer, error) {
 	var header bytes.Buffer
-	header.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain))
-	l, err := encodeLength(fh.RemainingLength)
+	var b [5]byte
+	h, err := fh.appendHeader(b[:0])
 	if err != nil {
 		return header, err
 	}
-	header.Write(l)
+	header.Write(h)
 	return header, nil
 }
 
+// appendHeader appends the encoded fixed header to dst
+func (fh *FixedHeader) appendHeader(dst []byte) ([]byte, error) {
+	if fh.RemainingLength < 0 || fh.RemainingLength > maxRemainingLength {
+		return dst, errors.New("invalid packet length")
+	}
+	dst = append(dst, fh.MessageType<<4|boolToByte(fh.Dup)<<3|fh.Qos<<1|boolToByte(fh.Retain))
+	return appendLength(dst, fh.RemainingLength), nil
+}
+
+// writeAck writes a packet consisting of the fixed header and a message ID (PUBACK, PUBREC etc.)
+func writeAck(w io.Writer, fh *FixedHeader, messageID uint16) error {
+	fh.RemainingLength = 2
+	var b [4]byte
+	packet, err := fh.appendHeader(b[:0])
+	if err != nil {
+		return err
+	}
+	packet = binary.BigEndian.AppendUint16(packet, messageID)
+	_, err = w.Write(packet)
+	return err
+}
+
 func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
 	fh.MessageType = typeAndFlags >> 4
 	fh.Dup = (typeAndFlags>>3)&0x01 > 0
@@ -286,6 +310,9 @@ func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
 }
 
 func decodeByte(b io.Reader) (byte, error) {
+	if br, ok := b.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
 	num := make([]byte, 1)
 	_, err := b.Read(num)
 	if err != nil {
@@ -296,6 +323,17 @@ func decodeByte(b io.Reader) (byte, error) {
 }
 
 func decodeUint16(b io.Reader) (uint16, error) {
+	if br, ok := b.(io.ByteReader); ok {
+		hi, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		lo, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		return uint16(hi)<<8 | uint16(lo), nil
+	}
 	num := make([]byte, 2)
 	_, err := b.Read(num)
 	if err != nil {
@@ -326,7 +364,7 @@ func decodeBytes(b io.Reader) ([]byte, error) {
 	}
 
 	field := make([]byte, fieldLength)
-	_, err = b.Read(field)
+	_, err = io.ReadFull(b, field)
 	if err != nil {
 		return nil, err
 	}
@@ -345,47 +383,79 @@ func encodeBytes(field []byte) []byte {
 	return append(fieldLength, field...)
 }
 
+var errMalformedLength = errors.New("malformed remaining length")
+
+// maxRemainingLength is the largest "Remaining Length" that can be encoded (giving a packet of 256MiB)
+const maxRemainingLength = 268435455
+
 // encodeLength encodes the "Remaining Length" as per 2.2.3 in the spec
 func encodeLength(length int) ([]byte, error) {
 	// Spec states max packet size is 268,435,455 bytes. Sending length outside this range is invalid.
-	if length < 0 || length > 268435455 {
+	if length < 0 || length > maxRemainingLength {
 		return nil, errors.New("invalid packet length")
 	}
-	var encLength []byte
+	return appendLength(nil, length), nil
+}
+
+// appendLength appends the encoded "Remaining Length" (which must be valid) to dst
+func appendLength(dst []byte, length int) []byte {
 	for {
 		digit := byte(length % 128)
 		length /= 128
 		if length > 0 {
 			digit |= 0x80
 		}
-		encLength = append(encLength, digit)
+		dst = append(dst, digit)
 		if length == 0 {
-			break
+			return dst
 		}
 	}
-	return encLength, nil
+}
+
+// lengthSize returns the number of bytes needed to encode the "Remaining Length"
+func lengthSize(length int) int {
+	n := 1
+	for ; length >= 128; length /= 128 {
+		n++
+	}
+	return n
 }
 
 // decodeLength decodes the "Remaining Length" as per 2.2.3 in the spec
 func decodeLength(r io.Reader) (int, error) {
 	var rLength uint32
 	var multiplier uint32
-	b := make([]byte, 1)
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = oneByteReader{r}
+	}
 	for {
-		_, err := io.ReadFull(r, b)
+		digit, err := br.ReadByte()
 		if err != nil {
 			return 0, err
 		}
 
-		digit := b[0]
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
 			break
 		}
 		multiplier += 7
 		if multiplier >= 27 {
-			return 0, errors.New("malformed remaining length") // maximum of 4 bytes may be used (see example in spec)
+			return 0, errMalformedLength // maximum of 4 bytes may be used (see example in spec)
 		}
 	}
 	return int(rLength), nil
 }
+
+// oneByteReader implements io.ByteReader for readers that do not
+type oneByteReader struct {
+	io.Reader
+}
+
+func (o oneByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(o.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
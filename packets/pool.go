@@ -0,0 +1,56 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers are pooled in power of two size classes between minPoolShift and maxPoolShift (64 bytes to 4MiB);
+// larger buffers are allocated on demand and left to the garbage collector.
+const (
+	minPoolShift = 6
+	maxPoolShift = 22
+)
+
+var bufferPools [maxPoolShift - minPoolShift + 1]sync.Pool
+
+// GetBuffer returns a buffer of length n; its contents are undefined. The buffer may be returned to the pool with
+// PutBuffer once it is no longer referenced.
+func GetBuffer(n int) []byte {
+	if n > 1<<maxPoolShift {
+		return make([]byte, n)
+	}
+	class := 0
+	if n > 1<<minPoolShift {
+		class = bits.Len(uint(n-1)) - minPoolShift // Round up to the next size class
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, 1<<(class+minPoolShift))
+}
+
+// PutBuffer returns a buffer to the pool. Any buffer may be passed (not just those from GetBuffer); those that
+// are too small or large to be pooled are ignored. The caller must not use b after calling PutBuffer.
+func PutBuffer(b []byte) {
+	c := cap(b)
+	if c < 1<<minPoolShift || c > 1<<maxPoolShift {
+		return
+	}
+	class := bits.Len(uint(c)) - 1 - minPoolShift // Round down so that GetBuffer can rely on the capacity
+	b = b[:0]
+	bufferPools[class].Put(&b)
+}
@@ -33,16 +33,7 @@ func (pa *PubackPacket) String() string {
 }
 
 func (pa *PubackPacket) Write(w io.Writer) error {
-	var err error
-	pa.FixedHeader.RemainingLength = 2
-	packet, err := pa.FixedHeader.pack()
-	if err != nil {
-		return err
-	}
-	packet.Write(encodeUint16(pa.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(w, &pa.FixedHeader, pa.MessageID)
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
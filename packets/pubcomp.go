@@ -33,16 +33,7 @@ func (pc *PubcompPacket) String() string {
 }
 
 func (pc *PubcompPacket) Write(w io.Writer) error {
-	var err error
-	pc.FixedHeader.RemainingLength = 2
-	packet, err := pc.FixedHeader.pack()
-	if err != nil {
-		return err
-	}
-	packet.Write(encodeUint16(pc.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(w, &pc.FixedHeader, pc.MessageID)
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
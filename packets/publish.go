@@ -17,9 +17,10 @@
 package packets
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 )
 
 // PublishPacket is an internal representation of the fields of the
@@ -36,23 +37,54 @@ func (p *PublishPacket) String() string {
 }
 
 func (p *PublishPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
+	_, err := p.WriteTo(w)
+	return err
+}
+
+// writevThreshold is the payload size at which WriteTo passes the payload to the kernel directly rather than
+// copying it alongside the header
+const writevThreshold = 16 * 1024
 
-	body.Write(encodeString(p.TopicName))
+// WriteTo writes the encoded packet to w and returns the number of bytes written. The packet is passed to w
+// in a single Write call (assembled in a pooled buffer) so that packets written from other goroutines cannot be
+// interleaved with it. When w is a *net.TCPConn, large payloads are written with writev instead, which avoids
+// copying the payload.
+func (p *PublishPacket) WriteTo(w io.Writer) (int64, error) {
+	topic := p.TopicName
+	if len(topic) > 65535 { // As per encodeString
+		topic = topic[:65535]
+	}
+	variableLen := 2 + len(topic)
 	if p.Qos > 0 {
-		body.Write(encodeUint16(p.MessageID))
+		variableLen += 2
 	}
-	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
-	packet, err := p.FixedHeader.pack()
-	if err != nil {
-		return err
+	p.FixedHeader.RemainingLength = variableLen + len(p.Payload)
+
+	_, isTCP := w.(*net.TCPConn)
+	writev := isTCP && len(p.Payload) >= writevThreshold
+	size := 5 + variableLen // Fixed header is at most 5 bytes
+	if !writev {
+		size += len(p.Payload)
 	}
-	packet.Write(body.Bytes())
-	packet.Write(p.Payload)
-	_, err = w.Write(packet.Bytes())
+	buf := GetBuffer(size)
+	defer PutBuffer(buf)
 
-	return err
+	packet, err := p.FixedHeader.appendHeader(buf[:0])
+	if err != nil {
+		return 0, err
+	}
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(topic)))
+	packet = append(packet, topic...)
+	if p.Qos > 0 {
+		packet = binary.BigEndian.AppendUint16(packet, p.MessageID)
+	}
+	if writev {
+		bufs := net.Buffers{packet, p.Payload}
+		return bufs.WriteTo(w)
+	}
+	packet = append(packet, p.Payload...)
+	n, err := w.Write(packet)
+	return int64(n), err
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
@@ -78,7 +110,7 @@ func (p *PublishPacket) Unpack(b io.Reader) error {
 		return fmt.Errorf("error unpacking publish, payload length < 0")
 	}
 	p.Payload = make([]byte, payloadLength)
-	_, err = b.Read(p.Payload)
+	_, err = io.ReadFull(b, p.Payload)
 
 	return err
 }
@@ -33,16 +33,7 @@ func (pr *PubrecPacket) String() string {
 }
 
 func (pr *PubrecPacket) Write(w io.Writer) error {
-	var err error
-	pr.FixedHeader.RemainingLength = 2
-	packet, err := pr.FixedHeader.pack()
-	if err != nil {
-		return err
-	}
-	packet.Write(encodeUint16(pr.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(w, &pr.FixedHeader, pr.MessageID)
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
@@ -0,0 +1,200 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	readerBufferSize = 4096      // Size of the bufio.Reader wrapping the stream
+	maxScratchSize   = 64 * 1024 // Larger packet bodies are read into a pooled buffer rather than retained scratch space
+)
+
+// Reader reads a sequence of packets from a stream. Unlike ReadPacket, it buffers the stream and reuses its
+// internal buffers between calls, so the only allocations made when reading a PUBLISH are the packet, its topic
+// and (unless PooledPayloads is set) its payload.
+//
+// Because the stream is buffered, the Reader may consume bytes beyond the packet returned; it should be the only
+// consumer of the stream once created (see NewUnbufferedReader). A Reader is not safe for concurrent use.
+type Reader struct {
+	// PooledPayloads, if set, results in PUBLISH payloads being obtained via GetBuffer. Once the payload is no
+	// longer in use the caller should return it with PutBuffer (failing to do so is safe, but loses the benefit).
+	PooledPayloads bool
+
+	// MaxPacketSize, if > 0, is the maximum size of a packet (including the fixed header) that will be read. The
+	// size is checked before anything is allocated; a larger packet results in a ProtocolError.
+	MaxPacketSize int
+
+	// Strict, if set, enables validation of packets as per the MQTT 3.1.1 spec (reserved flags, QoS, packet
+	// lengths and PUBLISH topic names). Violations result in a ProtocolError.
+	Strict bool
+
+	in      byteReader
+	scratch []byte
+	body    bytes.Reader
+}
+
+// byteReader is implemented by the stream the Reader reads from
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewReader creates a Reader that reads packets from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{in: bufio.NewReaderSize(r, readerBufferSize)}
+}
+
+// NewUnbufferedReader creates a Reader that never reads beyond the end of the packet returned, so r may be used
+// by others between calls (e.g. when only the CONNACK is to be read). This is slower than NewReader unless r
+// implements io.ByteReader.
+func NewUnbufferedReader(r io.Reader) *Reader {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = oneByteReader{r}
+	}
+	return &Reader{in: br}
+}
+
+// ReadPacket reads the next packet from the stream. The returned packet does not reference the Reader's internal
+// buffers (other than pooled payloads, see PooledPayloads).
+func (r *Reader) ReadPacket() (ControlPacket, error) {
+	typeAndFlags, err := r.in.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var fh FixedHeader
+	if err = fh.unpack(typeAndFlags, r.in); err != nil {
+		if errors.Is(err, errMalformedLength) {
+			return nil, &ProtocolError{PacketType: fh.MessageType, Err: ErrMalformedPacket, Detail: err.Error()}
+		}
+		return nil, err
+	}
+	if r.MaxPacketSize > 0 {
+		if size := 1 + lengthSize(fh.RemainingLength) + fh.RemainingLength; size > r.MaxPacketSize {
+			return nil, &ProtocolError{PacketType: fh.MessageType, Err: ErrPacketTooLarge, Detail: fmt.Sprintf("%d bytes", size)}
+		}
+	}
+	if r.Strict {
+		if err = fh.validate(); err != nil {
+			return nil, err
+		}
+	}
+	cp, err := NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := cp.(*PublishPacket); ok {
+		return p, r.readPublish(p)
+	}
+
+	body := r.buffer(fh.RemainingLength)
+	if len(body) > maxScratchSize {
+		defer PutBuffer(body)
+	}
+	if _, err = io.ReadFull(r.in, body); err != nil {
+		return nil, err
+	}
+	r.body.Reset(body)
+	if err = cp.Unpack(&r.body); err != nil {
+		if r.Strict {
+			return nil, &ProtocolError{PacketType: fh.MessageType, Err: ErrMalformedPacket, Detail: err.Error()}
+		}
+		return nil, err
+	}
+	if r.Strict && r.body.Len() > 0 {
+		return nil, &ProtocolError{PacketType: fh.MessageType, Err: ErrMalformedPacket, Detail: "unexpected data after packet"}
+	}
+	return cp, nil
+}
+
+// readPublish reads the body of a PUBLISH packet; the payload is read directly into its final location
+func (r *Reader) readPublish(p *PublishPacket) error {
+	remaining := p.RemainingLength
+	if remaining < 2 {
+		return r.malformedPublish()
+	}
+	lenBuf := r.buffer(2)
+	if _, err := io.ReadFull(r.in, lenBuf); err != nil {
+		return err
+	}
+	variableLen := 2 + int(binary.BigEndian.Uint16(lenBuf))
+	if p.Qos > 0 {
+		variableLen += 2
+	}
+	if variableLen > remaining {
+		return r.malformedPublish()
+	}
+
+	header := r.buffer(variableLen - 2)
+	if len(header) > maxScratchSize {
+		defer PutBuffer(header)
+	}
+	if _, err := io.ReadFull(r.in, header); err != nil {
+		return err
+	}
+	if p.Qos > 0 {
+		p.TopicName = string(header[:len(header)-2])
+		p.MessageID = binary.BigEndian.Uint16(header[len(header)-2:])
+	} else {
+		p.TopicName = string(header)
+	}
+	if r.Strict {
+		if err := validateTopicName(p.TopicName); err != nil {
+			return err
+		}
+		if p.Qos > 0 && p.MessageID == 0 { // [MQTT-2.3.1-1]
+			return &ProtocolError{PacketType: Publish, Err: ErrMalformedPacket, Detail: "packet identifier 0"}
+		}
+	}
+
+	payloadLen := remaining - variableLen
+	switch {
+	case payloadLen == 0:
+		p.Payload = []byte{}
+		return nil
+	case r.PooledPayloads:
+		p.Payload = GetBuffer(payloadLen)
+	default:
+		p.Payload = make([]byte, payloadLen)
+	}
+	_, err := io.ReadFull(r.in, p.Payload)
+	return err
+}
+
+// malformedPublish returns the error used when the lengths within a PUBLISH are inconsistent
+func (r *Reader) malformedPublish() error {
+	if r.Strict {
+		return &ProtocolError{PacketType: Publish, Err: ErrMalformedPacket, Detail: "topic name exceeds packet"}
+	}
+	return errors.New("error unpacking publish, payload length < 0")
+}
+
+// buffer returns a buffer of length n; this will be the Reader's scratch space unless n exceeds maxScratchSize
+// (in which case the buffer comes from the pool and should be returned once used).
+func (r *Reader) buffer(n int) []byte {
+	if n > maxScratchSize {
+		return GetBuffer(n)
+	}
+	if cap(r.scratch) < n {
+		r.scratch = make([]byte, n, max(n, 256))
+	}
+	return r.scratch[:n]
+}
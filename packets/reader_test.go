@@ -0,0 +1,197 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 64, 65, 1000, 1 << 20, 1<<22 + 1} {
+		b := GetBuffer(n)
+		if len(b) != n {
+			t.Fatalf("GetBuffer(%d) returned length %d", n, len(b))
+		}
+		PutBuffer(b)
+		if b = GetBuffer(n); len(b) != n {
+			t.Fatalf("GetBuffer(%d) returned length %d after PutBuffer", n, len(b))
+		}
+	}
+	PutBuffer(make([]byte, 100)) // Capacity is not a size class
+	if b := GetBuffer(64); len(b) != 64 || cap(b) < 64 {
+		t.Fatalf("unexpected buffer len %d cap %d", len(b), cap(b))
+	}
+}
+
+func TestReader(t *testing.T) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Qos = 1
+	pub.MessageID = 7
+	pub.Payload = []byte("hello")
+	pub0 := NewControlPacket(Publish).(*PublishPacket)
+	pub0.TopicName = "c"
+	pub0.Payload = []byte{}
+	sub := NewControlPacket(Suback).(*SubackPacket)
+	sub.MessageID = 3
+	sub.ReturnCodes = []byte{0, 1, 0x80}
+	ack := NewControlPacket(Puback).(*PubackPacket)
+	ack.MessageID = 9
+	large := NewControlPacket(Publish).(*PublishPacket)
+	large.TopicName = "large"
+	large.Payload = bytes.Repeat([]byte{0x55}, maxScratchSize*2)
+	written := []ControlPacket{pub, sub, pub0, ack, NewControlPacket(Pingresp), large, pub}
+
+	var buf bytes.Buffer
+	for _, p := range written {
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pooled := range []bool{false, true} {
+		r := NewReader(bytes.NewReader(buf.Bytes()))
+		r.PooledPayloads = pooled
+		for i, want := range written {
+			got, err := r.ReadPacket()
+			if err != nil {
+				t.Fatalf("packet %d: unexpected error %v", i, err)
+			}
+			if got.String() != want.String() {
+				t.Fatalf("packet %d: expected %v, got %v", i, want, got)
+			}
+			if p, ok := got.(*PublishPacket); ok && pooled {
+				PutBuffer(p.Payload)
+			}
+		}
+		if _, err := r.ReadPacket(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	}
+}
+
+func TestReaderMalformedPublish(t *testing.T) {
+	// Topic length (10) exceeds the remaining length (4)
+	r := NewReader(bytes.NewReader([]byte{Publish << 4, 4, 0, 10, 'a', 'b'}))
+	if _, err := r.ReadPacket(); err == nil {
+		t.Fatalf("expected error")
+	}
+	// Truncated payload
+	r = NewReader(bytes.NewReader([]byte{Publish << 4, 10, 0, 1, 'a', 'b'}))
+	if _, err := r.ReadPacket(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestPublishWriteTo(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	for _, size := range []int{0, 10, writevThreshold * 2} {
+		pub := NewControlPacket(Publish).(*PublishPacket)
+		pub.TopicName = "a/b"
+		pub.Qos = 2
+		pub.MessageID = 1
+		pub.Payload = bytes.Repeat([]byte{1}, size)
+
+		var buf bytes.Buffer
+		n, err := pub.WriteTo(&buf)
+		if err != nil || int(n) != buf.Len() {
+			t.Fatalf("WriteTo returned (%d, %v), wrote %d bytes", n, err, buf.Len())
+		}
+		read, err := ReadPacket(bytes.NewReader(buf.Bytes()))
+		if err != nil || read.String() != pub.String() {
+			t.Fatalf("read %v (err %v), expected %v", read, err, pub)
+		}
+	}
+}
+
+func TestPublishWriteToTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	received := make(chan ControlPacket, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p, _ := NewReader(conn).ReadPacket()
+		received <- p
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Payload = bytes.Repeat([]byte{2}, writevThreshold*2) // Written with writev
+	if n, err := pub.WriteTo(conn); err != nil || int(n) != 2+1+2+3+len(pub.Payload)+1 {
+		t.Fatalf("WriteTo returned (%d, %v)", n, err)
+	}
+	if p := <-received; p == nil || p.String() != pub.String() {
+		t.Fatalf("unexpected packet received %v", p)
+	}
+}
+
+func benchmarkPublish(size int) (*PublishPacket, []byte) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName = "benchmark/topic"
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.Payload = make([]byte, size)
+	var buf bytes.Buffer
+	_ = pub.Write(&buf)
+	return pub, buf.Bytes()
+}
+
+func BenchmarkPublishWrite(b *testing.B) {
+	pub, _ := benchmarkPublish(1024)
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = pub.Write(io.Discard)
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	_, encoded := benchmarkPublish(1024)
+	r := bytes.NewReader(encoded)
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset(encoded)
+		_, _ = ReadPacket(r)
+	}
+}
+
+func BenchmarkReaderPooled(b *testing.B) {
+	_, encoded := benchmarkPublish(1024)
+	src := bytes.NewReader(encoded)
+	r := NewReader(src)
+	r.PooledPayloads = true
+	b.ReportAllocs()
+	for b.Loop() {
+		src.Reset(encoded)
+		p, _ := r.ReadPacket()
+		PutBuffer(p.(*PublishPacket).Payload)
+	}
+}
@@ -33,16 +33,7 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w io.Writer) error {
-	var err error
-	ua.FixedHeader.RemainingLength = 2
-	packet, err := ua.FixedHeader.pack()
-	if err != nil {
-		return err
-	}
-	packet.Write(encodeUint16(ua.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(w, &ua.FixedHeader, ua.MessageID)
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
@@ -0,0 +1,112 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reasons for a ProtocolError (use errors.Is to check for these)
+var (
+	ErrPacketTooLarge    = errors.New("packet exceeds maximum size")
+	ErrMalformedPacket   = errors.New("malformed packet")
+	ErrUnknownPacketType = errors.New("unknown packet type")
+	ErrInvalidFlags      = errors.New("reserved flags set")
+	ErrInvalidQos        = errors.New("invalid QoS")
+	ErrInvalidTopicName  = errors.New("invalid topic name")
+)
+
+// ProtocolError is returned when a packet read does not conform to the MQTT 3.1.1 specification (or exceeds the
+// configured maximum size). Err will be one of the Err... values above.
+type ProtocolError struct {
+	PacketType byte // Type of the offending packet
+	Err        error
+	Detail     string // Optional further information
+}
+
+func (e *ProtocolError) Error() string {
+	name, ok := PacketNames[e.PacketType]
+	if !ok {
+		name = fmt.Sprintf("packet type 0x%x", e.PacketType)
+	}
+	if e.Detail != "" {
+		return fmt.Sprintf("protocol error in %s: %s (%s)", name, e.Err, e.Detail)
+	}
+	return fmt.Sprintf("protocol error in %s: %s", name, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// fixedRemainingLength holds the remaining length required for packets whose size is fixed
+var fixedRemainingLength = map[byte]int{
+	Connack:    2,
+	Puback:     2,
+	Pubrec:     2,
+	Pubrel:     2,
+	Pubcomp:    2,
+	Unsuback:   2,
+	Pingreq:    0,
+	Pingresp:   0,
+	Disconnect: 0,
+}
+
+// validate checks the fixed header as per section 2.2 of the MQTT 3.1.1 spec
+func (fh *FixedHeader) validate() error {
+	if _, ok := PacketNames[fh.MessageType]; !ok {
+		return &ProtocolError{PacketType: fh.MessageType, Err: ErrUnknownPacketType}
+	}
+	flags := boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain)
+	switch fh.MessageType {
+	case Publish:
+		if fh.Qos > 2 {
+			return &ProtocolError{PacketType: Publish, Err: ErrInvalidQos, Detail: "QoS 3"}
+		}
+		if fh.Dup && fh.Qos == 0 { // [MQTT-3.3.1-2]
+			return &ProtocolError{PacketType: Publish, Err: ErrInvalidFlags, Detail: "DUP set on QoS 0 message"}
+		}
+	case Pubrel, Subscribe, Unsubscribe:
+		if flags != 0x02 {
+			return &ProtocolError{PacketType: fh.MessageType, Err: ErrInvalidFlags, Detail: fmt.Sprintf("flags 0x%x", flags)}
+		}
+	default:
+		if flags != 0 {
+			return &ProtocolError{PacketType: fh.MessageType, Err: ErrInvalidFlags, Detail: fmt.Sprintf("flags 0x%x", flags)}
+		}
+	}
+	if l, ok := fixedRemainingLength[fh.MessageType]; ok && fh.RemainingLength != l {
+		return &ProtocolError{PacketType: fh.MessageType, Err: ErrMalformedPacket, Detail: fmt.Sprintf("remaining length %d", fh.RemainingLength)}
+	}
+	return nil
+}
+
+// validateTopicName checks that the topic name in a PUBLISH is well-formed UTF-8 without the null character or
+// wildcards (sections 1.5.3 and 4.7 of the spec)
+func validateTopicName(topic string) error {
+	switch {
+	case topic == "":
+		return &ProtocolError{PacketType: Publish, Err: ErrInvalidTopicName, Detail: "empty"}
+	case !utf8.ValidString(topic):
+		return &ProtocolError{PacketType: Publish, Err: ErrInvalidTopicName, Detail: "malformed UTF-8"}
+	case strings.ContainsRune(topic, 0):
+		return &ProtocolError{PacketType: Publish, Err: ErrInvalidTopicName, Detail: "contains U+0000"}
+	case strings.ContainsAny(topic, "+#"):
+		return &ProtocolError{PacketType: Publish, Err: ErrInvalidTopicName, Detail: "contains wildcard"}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReaderStrict(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error // nil = valid
+	}{
+		{"valid publish", []byte{0x30, 4, 0, 1, 'a', 'x'}, nil},
+		{"valid pubrel", []byte{0x62, 2, 0, 1}, nil},
+		{"qos 3", []byte{0x36, 5, 0, 1, 'a', 0, 1}, ErrInvalidQos},
+		{"dup on qos 0", []byte{0x38, 3, 0, 1, 'a'}, ErrInvalidFlags},
+		{"puback flags", []byte{0x41, 2, 0, 1}, ErrInvalidFlags},
+		{"pubrel flags", []byte{0x60, 2, 0, 1}, ErrInvalidFlags},
+		{"pingresp flags", []byte{0xd1, 0}, ErrInvalidFlags},
+		{"reserved type 0", []byte{0x00, 0}, ErrUnknownPacketType},
+		{"reserved type 15", []byte{0xf0, 0}, ErrUnknownPacketType},
+		{"puback length", []byte{0x40, 3, 0, 1, 0}, ErrMalformedPacket},
+		{"remaining length", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}, ErrMalformedPacket},
+		{"topic exceeds packet", []byte{0x30, 3, 0, 5, 'a'}, ErrMalformedPacket},
+		{"invalid utf-8 topic", []byte{0x30, 4, 0, 2, 0xc3, 0x28}, ErrInvalidTopicName},
+		{"null in topic", []byte{0x30, 4, 0, 2, 'a', 0}, ErrInvalidTopicName},
+		{"wildcard in topic", []byte{0x30, 4, 0, 2, 'a', '#'}, ErrInvalidTopicName},
+		{"empty topic", []byte{0x30, 2, 0, 0}, ErrInvalidTopicName},
+		{"zero packet id", []byte{0x32, 5, 0, 1, 'a', 0, 0}, ErrMalformedPacket},
+		{"valid suback", []byte{0x90, 4, 0, 1, 0, 0x80}, nil},
+		{"valid connack", []byte{0x20, 2, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(tt.raw))
+			r.Strict = true
+			_, err := r.ReadPacket()
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			var pe *ProtocolError
+			if !errors.As(err, &pe) || !errors.Is(err, tt.err) {
+				t.Fatalf("expected ProtocolError wrapping %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// Without Strict, invalid flags are accepted as before
+	r := NewReader(bytes.NewReader([]byte{0x41, 2, 0, 1}))
+	if _, err := r.ReadPacket(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestReaderMaxPacketSize(t *testing.T) {
+	// 256MB packet; this must be rejected without allocating the body
+	raw := []byte{0x30, 0xff, 0xff, 0xff, 0x7f}
+	r := NewReader(bytes.NewReader(raw))
+	r.MaxPacketSize = 1024
+	if _, err := r.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+	}
+
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName = "a"
+	pub.Payload = make([]byte, 1019) // Packet is exactly 1024 bytes (2 + 3 + 1019)
+	var buf bytes.Buffer
+	_ = pub.Write(&buf)
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	r.MaxPacketSize = buf.Len()
+	if _, err := r.ReadPacket(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	r.MaxPacketSize = buf.Len() - 1
+	if _, err := r.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("expected ErrPacketTooLarge, got %v", err)
+	}
+}
+
+func TestNewUnbufferedReader(t *testing.T) {
+	src := bytes.NewBuffer([]byte{0x20, 2, 0, 0, 0xd0, 0})
+	if p, err := NewUnbufferedReader(src).ReadPacket(); err != nil || p.(*ConnackPacket).ReturnCode != 0 {
+		t.Fatalf("unexpected result %v, %v", p, err)
+	}
+	if src.Len() != 2 {
+		t.Fatalf("reader consumed beyond the packet (%d bytes remain)", src.Len())
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is the error returned (via the Token) by Publish when a message exceeds the rate limit and the
+// RateLimitMode is RateLimitReject
+var ErrRateLimited = errors.New("publish rate limit exceeded")
+
+// ErrRateLimitStopped is the error returned (via the Token) by Publish when the connection is closed whilst a message
+// is being delayed by the rate limit (RateLimitBlock)
+var ErrRateLimitStopped = errors.New("connection closed whilst waiting for publish rate limit")
+
+// ErrRateLimitTimeout is the error returned (via the Token) by Publish when a message would be delayed by the rate
+// limit (RateLimitBlock) for longer than the WriteTimeout (see ClientOptions.SetWriteTimeout)
+var ErrRateLimitTimeout = errors.New("publish rate limit delay exceeds write timeout")
+
+// RateLimit defines a token bucket limit on the rate at which messages are published. A zero rate means that the
+// corresponding dimension is not limited.
+type RateLimit struct {
+	Messages     float64 // Messages per second
+	MessageBurst int     // Maximum messages sent in a burst (defaults to Messages, min 1)
+	Bytes        float64 // Payload bytes per second
+	ByteBurst    int     // Maximum payload bytes sent in a burst (defaults to Bytes); larger messages are permitted when the bucket is full
+}
+
+// RateLimitMode determines what happens when a publish would exceed a rate limit
+type RateLimitMode byte
+
+const (
+	RateLimitBlock  RateLimitMode = iota // Publish blocks until the message can be sent (see SetRateLimitMode)
+	RateLimitReject                      // Publish fails with ErrRateLimited
+)
+
+// RateLimitStats holds the state of a rate limit (see RateLimitReporter)
+type RateLimitStats struct {
+	Filter        string        // Topic filter ("" for the global limit)
+	MessageTokens float64       // Messages that can be sent immediately (negative if publishers are waiting)
+	ByteTokens    float64       // Payload bytes that can be sent immediately (negative if publishers are waiting)
+	Allowed       uint64        // Messages permitted (including those that were delayed)
+	Delayed       uint64        // Messages delayed (RateLimitBlock)
+	Rejected      uint64        // Messages rejected (RateLimitReject)
+	Abandoned     uint64        // Delayed messages not sent due to the write timeout or connection closure
+	Waited        time.Duration // Total time that publishers have been delayed
+}
+
+// SetRateLimit sets a limit on the rate at which all messages are published (in addition to any topic limits)
+func (o *ClientOptions) SetRateLimit(l RateLimit) *ClientOptions {
+	o.RateLimit = l
+	return o
+}
+
+// SetTopicRateLimit sets a rate limit for messages published to topics matching filter. The limit is shared by all
+// matching topics; where multiple filters match a topic only the first added applies (the global limit, see
+// SetRateLimit, applies in addition).
+func (o *ClientOptions) SetTopicRateLimit(filter string, l RateLimit) *ClientOptions {
+	o.topicRateLimits = append(o.topicRateLimits, topicRateLimit{filter: filter, limit: l})
+	return o
+}
+
+// SetRateLimitMode determines whether Publish blocks (the default) or fails when a rate limit is exceeded. Note
+// that, when blocking, a call to Publish from a message handler may delay the handling of other messages. A blocked
+// Publish fails with ErrRateLimitTimeout if the delay would exceed the WriteTimeout (if set), or with
+// ErrRateLimitStopped if the connection closes whilst it is waiting; the message then does not count against the
+// limit.
+func (o *ClientOptions) SetRateLimitMode(m RateLimitMode) *ClientOptions {
+	o.RateLimitMode = m
+	return o
+}
+
+// topicRateLimit associates a topic filter with a rate limit
+type topicRateLimit struct {
+	filter string
+	limit  RateLimit
+}
+
+// tokenBucket implements a token bucket (tokens may go negative when callers wait)
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, rate)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// refill adds the tokens accumulated since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+d.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// available reports whether n tokens can be taken without waiting (requests larger than the bucket are permitted
+// when it is full)
+func (b *tokenBucket) available(n float64) bool {
+	return b == nil || b.tokens >= math.Min(n, b.burst)
+}
+
+// refund returns n tokens taken by take
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+math.Min(n, b.burst))
+}
+
+// take removes n tokens (requests larger than the bucket are capped to its size) and returns how long the caller
+// must wait before the tokens would have been available
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens -= math.Min(n, b.burst)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limitState holds the buckets, and statistics, for a single RateLimit
+type limitState struct {
+	filter   string
+	messages *tokenBucket
+	bytes    *tokenBucket
+	stats    RateLimitStats
+}
+
+// rateLimiter applies the rate limits configured in ClientOptions
+type rateLimiter struct {
+	mode RateLimitMode
+	now  func() time.Time
+
+	mu     sync.Mutex
+	global *limitState
+	topics []*limitState
+}
+
+// newRateLimiter returns a rateLimiter implementing the limits in o (nil if there are none)
+func newRateLimiter(o *ClientOptions) *rateLimiter {
+	l := &rateLimiter{mode: o.RateLimitMode, now: time.Now}
+	now := l.now()
+	newState := func(filter string, rl RateLimit) *limitState {
+		return &limitState{
+			filter:   filter,
+			messages: newTokenBucket(rl.Messages, rl.MessageBurst, now),
+			bytes:    newTokenBucket(rl.Bytes, rl.ByteBurst, now),
+		}
+	}
+	if o.RateLimit.Messages > 0 || o.RateLimit.Bytes > 0 {
+		l.global = newState("", o.RateLimit)
+	}
+	for _, t := range o.topicRateLimits {
+		l.topics = append(l.topics, newState(t.filter, t.limit))
+	}
+	if l.global == nil && len(l.topics) == 0 {
+		return nil
+	}
+	return l
+}
+
+// wait applies the rate limits to a message of size bytes published to topic. With RateLimitBlock it blocks until
+// the message may be sent; ErrRateLimitTimeout is returned if that would take longer than timeout (if non-zero),
+// and ErrRateLimitStopped if stop is closed first (in both cases the tokens taken are refunded). With
+// RateLimitReject ErrRateLimited is returned if the message cannot be sent immediately.
+func (l *rateLimiter) wait(topic string, size int, timeout time.Duration, stop <-chan struct{}) error {
+	l.mu.Lock()
+	now := l.now()
+	states := make([]*limitState, 0, 2)
+	if l.global != nil {
+		states = append(states, l.global)
+	}
+	for _, s := range l.topics {
+		if TopicMatches(s.filter, topic) {
+			states = append(states, s)
+			break
+		}
+	}
+	n := float64(size)
+	for _, s := range states {
+		s.messages.refill(now)
+		s.bytes.refill(now)
+	}
+	if l.mode == RateLimitReject {
+		for _, s := range states {
+			if !s.messages.available(1) || !s.bytes.available(n) {
+				s.stats.Rejected++
+				l.mu.Unlock()
+				return ErrRateLimited
+			}
+		}
+	}
+	var delay time.Duration
+	delays := make([]time.Duration, len(states))
+	for i, s := range states {
+		d := max(s.messages.take(1), s.bytes.take(n))
+		s.stats.Allowed++
+		if d > 0 {
+			s.stats.Delayed++
+			s.stats.Waited += d
+		}
+		delays[i] = d
+		delay = max(delay, d)
+	}
+	if timeout > 0 && delay > timeout {
+		l.abandon(states, delays, n)
+		l.mu.Unlock()
+		return ErrRateLimitTimeout
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-stop:
+			l.mu.Lock()
+			l.abandon(states, delays, n)
+			l.mu.Unlock()
+			return ErrRateLimitStopped
+		}
+	}
+	return nil
+}
+
+// abandon refunds the tokens taken by wait for a message of n bytes that will not be sent (l.mu must be held)
+func (l *rateLimiter) abandon(states []*limitState, delays []time.Duration, n float64) {
+	for i, s := range states {
+		s.messages.refund(1)
+		s.bytes.refund(n)
+		s.stats.Allowed--
+		s.stats.Abandoned++
+		s.stats.Waited -= delays[i]
+	}
+}
+
+// stats returns the current state of each limit
+func (l *rateLimiter) stats() []RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var r []RateLimitStats
+	for _, s := range append([]*limitState{l.global}, l.topics...) {
+		if s == nil {
+			continue
+		}
+		s.messages.refill(now)
+		s.bytes.refill(now)
+		st := s.stats
+		st.Filter = s.filter
+		st.MessageTokens, st.ByteTokens = math.Inf(1), math.Inf(1)
+		if s.messages != nil {
+			st.MessageTokens = s.messages.tokens
+		}
+		if s.bytes != nil {
+			st.ByteTokens = s.bytes.tokens
+		}
+		r = append(r, st)
+	}
+	return r
+}
+
+// RateLimitReporter is implemented by a Client that supports rate limiting (as the Client returned by NewClient
+// does)
+type RateLimitReporter interface {
+	// RateLimitStats returns the state of the rate limits set in ClientOptions (nil if there are none)
+	RateLimitStats() []RateLimitStats
+}
+
+// RateLimitStats returns the state of each rate limit (the global limit first, if set, followed by topic limits
+// in the order added). Tokens are +Inf where a dimension is not limited.
+func (c *client) RateLimitStats() []RateLimitStats {
+	if c.rateLimiter == nil {
+		return nil
+	}
+	return c.rateLimiter.stats()
+}
@@ -0,0 +1,280 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// deadLetterPrefix is the key prefix used by DeadLetterStore
+const deadLetterPrefix = "d."
+
+// DefaultMaxRetryInterval is the limit on the delay between retries used when HandlerFailurePolicy.MaxRetryInterval
+// is zero
+const DefaultMaxRetryInterval = 30 * time.Second
+
+// HandlerPanicError describes a panic in a MessageHandler (see HandlerFailurePolicy)
+type HandlerPanicError struct {
+	Topic     string
+	MessageID uint16
+	Attempt   int    // 1 for the first call, 2 for the first retry etc.
+	Value     any    // Value passed to panic
+	Stack     []byte // Stack trace of the goroutine that panicked
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("handler for topic %q panicked (attempt %d): %v", e.Topic, e.Attempt, e.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error
+func (e *HandlerPanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// FailureAck determines whether a message is acknowledged when a handler has failed (after any retries)
+type FailureAck byte
+
+const (
+	// AckOnFailure acknowledges the message (so the broker will not redeliver it)
+	AckOnFailure FailureAck = iota
+	// AckIfDeadLettered acknowledges the message only if it was successfully passed to the DeadLetter
+	AckIfDeadLettered
+	// NoAckOnFailure leaves the message unacknowledged; with a persistent session a QoS 1/2 message will be
+	// redelivered when the connection is re-established (note that this holds up the acknowledgment of later
+	// messages, see ClientOptions.SetOrderMatters)
+	NoAckOnFailure
+)
+
+// DeadLetter receives messages whose handler has failed
+type DeadLetter interface {
+	DeadLetter(c Client, msg Message, err error) error
+}
+
+// DeadLetterFunc is an adapter allowing a function to be used as a DeadLetter
+type DeadLetterFunc func(c Client, msg Message, err error) error
+
+// DeadLetter calls f(c, msg, err)
+func (f DeadLetterFunc) DeadLetter(c Client, msg Message, err error) error { return f(c, msg, err) }
+
+// DeadLetterTopic republishes failed messages to Prefix + the original topic (e.g. with Prefix "dead/" a message
+// on "a/b" will be published to "dead/a/b"). The publish is not waited for (waiting within a handler can deadlock).
+type DeadLetterTopic struct {
+	Prefix string
+	QoS    byte
+}
+
+// DeadLetter publishes msg
+func (d DeadLetterTopic) DeadLetter(c Client, msg Message, _ error) error {
+	t := c.Publish(d.Prefix+msg.Topic(), d.QoS, false, bytes.Clone(msg.Payload())) // Payload may be pooled
+	select {
+	case <-t.Done():
+		return t.Error()
+	default:
+		return nil
+	}
+}
+
+// DeadLetterStore saves failed messages in a Store. Store implementations require keys in the form
+// "X.[messageid]" so keys are "d.1", "d.2" etc. (continuing from the highest key in the store); after "d.65535" the
+// sequence restarts from 1, overwriting any earlier message. The Store must not be the one used by the client.
+type DeadLetterStore struct {
+	Store Store
+
+	mu   sync.Mutex
+	seq  uint16
+	init bool
+}
+
+// DeadLetter saves msg to the store
+func (d *DeadLetterStore) DeadLetter(_ Client, msg Message, _ error) error {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = msg.Topic()
+	pub.Qos = msg.Qos()
+	pub.Retain = msg.Retained()
+	pub.MessageID = msg.MessageID()
+	pub.Payload = bytes.Clone(msg.Payload()) // The payload may be pooled (see SetPooledPayloads)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.init {
+		for _, k := range d.Store.All() {
+			if strings.HasPrefix(k, deadLetterPrefix) {
+				d.seq = max(d.seq, mIDFromKey(k))
+			}
+		}
+		d.init = true
+	}
+	if d.seq++; d.seq == 0 {
+		d.seq = 1
+	}
+	d.Store.Put(deadLetterPrefix+strconv.Itoa(int(d.seq)), pub)
+	return nil
+}
+
+// HandlerFailurePolicy determines what happens when a MessageHandler panics. Without a policy a panic in a handler
+// is not recovered (so will terminate the application).
+type HandlerFailurePolicy struct {
+	// OnPanic, if not nil, is called each time a handler panics (including during retries)
+	OnPanic func(c Client, msg Message, err *HandlerPanicError)
+	// MaxRetries is the number of times the handler will be called again after a panic. Retries block the
+	// delivery of further messages when order matters. Any remaining retries are abandoned (and the message
+	// treated as failed) if the connection is closed whilst waiting for the retry interval to elapse.
+	MaxRetries int
+	// RetryInterval is the delay before the first retry; this doubles with each retry up to MaxRetryInterval
+	// (DefaultMaxRetryInterval if zero)
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// DeadLetter, if not nil, is passed messages whose handler failed on every attempt. Where a message matched
+	// multiple routes it is passed once, after all handlers have returned, if any of them failed.
+	DeadLetter DeadLetter
+	// Ack determines whether the failed message is acknowledged; this applies to the message as a whole so a
+	// failure in any handler takes precedence over the success of the others
+	Ack FailureAck
+}
+
+// SetHandlerFailurePolicy enables recovery from panics in message handlers (including the default handler) and
+// determines how such failures are handled. Pass nil to disable recovery.
+func (o *ClientOptions) SetHandlerFailurePolicy(p *HandlerFailurePolicy) *ClientOptions {
+	o.HandlerFailurePolicy = p
+	return o
+}
+
+// handlerGroup tracks the handlers that a message has been passed to; the message is acknowledged (or not) once
+// all of them have returned, so that a failure in one handler is not masked by the success of another
+type handlerGroup struct {
+	m       Message
+	stop    <-chan struct{} // closed when the connection the message was received on is closed (nil if none)
+	pending atomic.Int32
+
+	mu  sync.Mutex
+	err *HandlerPanicError // first failure (nil if every handler has succeeded)
+}
+
+// newHandlerGroup creates a handlerGroup for a message passed to n handlers
+func newHandlerGroup(m Message, n int) *handlerGroup {
+	g := &handlerGroup{m: m}
+	g.pending.Store(int32(n))
+	return g
+}
+
+// done records the result of a handler, returning true if it was the last to complete
+func (g *handlerGroup) done(err *HandlerPanicError) bool {
+	if err != nil {
+		g.mu.Lock()
+		if g.err == nil {
+			g.err = err
+		}
+		g.mu.Unlock()
+	}
+	return g.pending.Add(-1) == 0
+}
+
+// callHandler calls the handler, applying the HandlerFailurePolicy (if any). Once every handler in the group has
+// returned the message is acknowledged (see completeMessage).
+func (c *client) callHandler(h MessageHandler, g *handlerGroup) {
+	m := g.m
+	p := c.options.HandlerFailurePolicy
+	if p == nil {
+		h(c, m)
+		if g.done(nil) {
+			c.completeMessage(g)
+		}
+		return
+	}
+
+	interval, maxInterval := p.RetryInterval, p.MaxRetryInterval
+	if maxInterval == 0 {
+		maxInterval = DefaultMaxRetryInterval
+	}
+	var err *HandlerPanicError
+retries:
+	for attempt := 1; attempt <= p.MaxRetries+1; attempt++ {
+		if err = safeCall(h, c, m, attempt); err == nil {
+			break
+		}
+		c.logger.Error("message handler panicked", slog.String("topic", m.Topic()), slog.Int("attempt", attempt),
+			slog.Any("panic", err.Value), slog.String("component", string(ROU)))
+		if p.OnPanic != nil {
+			p.OnPanic(c, m, err)
+		}
+		if attempt <= p.MaxRetries && interval > 0 {
+			interval = min(interval, maxInterval)
+			t := time.NewTimer(interval)
+			select {
+			case <-t.C:
+			case <-g.stop:
+				t.Stop()
+				c.logger.Debug("connection closed; abandoning handler retries", slog.String("topic", m.Topic()), slog.String("component", string(ROU)))
+				break retries
+			}
+			interval *= 2
+		}
+	}
+	if g.done(err) {
+		c.completeMessage(g)
+	}
+}
+
+// completeMessage is called once all handlers in the group have returned. The message is acknowledged (unless
+// AutoAckDisabled is set) if every handler succeeded; otherwise it is passed to the DeadLetter (once) and
+// acknowledged in accordance with the HandlerFailurePolicy.
+func (c *client) completeMessage(g *handlerGroup) {
+	g.mu.Lock()
+	err := g.err
+	g.mu.Unlock()
+	m := g.m
+	if err == nil {
+		if !c.options.AutoAckDisabled {
+			m.Ack()
+		}
+		return
+	}
+
+	p := c.options.HandlerFailurePolicy
+	deadLettered := false
+	if p.DeadLetter != nil {
+		if dlErr := p.DeadLetter.DeadLetter(c, m, err); dlErr != nil {
+			c.logger.Error("failed to dead letter message", slog.String("topic", m.Topic()), slog.String("error", dlErr.Error()), slog.String("component", string(ROU)))
+		} else {
+			deadLettered = true
+		}
+	}
+	if !c.options.AutoAckDisabled && (p.Ack == AckOnFailure || p.Ack == AckIfDeadLettered && deadLettered) {
+		m.Ack()
+	}
+}
+
+// safeCall calls h, returning an error if it panics
+func safeCall(h MessageHandler, c Client, m Message, attempt int) (err *HandlerPanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &HandlerPanicError{Topic: m.Topic(), MessageID: m.MessageID(), Attempt: attempt, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	h(c, m)
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package retained provides helpers for working with retained messages: reading the retained value of a topic,
+// taking a snapshot of (or clearing) all retained messages under a filter, and backing up/restoring retained
+// messages to a file.
+//
+// MQTT v3.1.1 provides no way to determine how many retained messages a broker holds, so the helpers subscribe and
+// collect retained messages until none has been received for Settle (the broker sends retained messages
+// immediately after acknowledging the subscription).
+//
+// The helpers subscribe to, and then unsubscribe from, the filter passed in; they will fail with
+// ErrAlreadySubscribed if the client has an existing subscription, or route (see Client.AddRoute), for the same
+// filter (subscribing would replace the route's handler and unsubscribing would remove it). This check requires a
+// client that implements mqtt.SubscriptionLister and mqtt.RouteLister (as those created by mqtt.NewClient do).
+package retained
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultSettle is the default Manager.Settle
+const DefaultSettle = 500 * time.Millisecond
+
+var (
+	ErrNotFound          = errors.New("no retained message")
+	ErrAlreadySubscribed = errors.New("client is already subscribed to filter")
+	ErrWildcard          = errors.New("topic must not contain wildcards")
+)
+
+// Entry is a retained message
+type Entry struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+// Manager provides the retained message helpers
+type Manager struct {
+	// The fields below may be changed prior to use
+	QoS    byte          // QoS used when subscribing and publishing
+	Settle time.Duration // Period without a retained message after which collection is considered complete
+
+	client mqtt.Client
+}
+
+// New creates a Manager that uses client (which must be connected)
+func New(client mqtt.Client) *Manager {
+	return &Manager{QoS: 1, Settle: DefaultSettle, client: client}
+}
+
+// Get returns the retained message for topic (which must not contain wildcards); ErrNotFound is returned if there
+// is no retained message.
+func (m *Manager) Get(ctx context.Context, topic string) (*Entry, error) {
+	if strings.ContainsAny(topic, "+#") {
+		return nil, ErrWildcard
+	}
+	entries, err := m.collect(ctx, topic, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	return &entries[0], nil
+}
+
+// Snapshot returns the retained messages on topics matching filter, ordered by topic
+func (m *Manager) Snapshot(ctx context.Context, filter string) ([]Entry, error) {
+	return m.collect(ctx, filter, false)
+}
+
+// Clear removes the retained messages on topics matching filter (by publishing an empty retained message to
+// each) and returns the number removed
+func (m *Manager) Clear(ctx context.Context, filter string) (int, error) {
+	entries, err := m.collect(ctx, filter, false)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range entries {
+		if err = m.publish(ctx, e.Topic, e.QoS, nil); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Backup writes the retained messages on topics matching filter to w (as JSON, one message per line) and returns
+// the number written
+func (m *Manager) Backup(ctx context.Context, filter string, w io.Writer) (int, error) {
+	entries, err := m.collect(ctx, filter, false)
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		if err = enc.Encode(&entries[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Restore publishes, as retained messages, each message read from r (in the format written by Backup) and returns
+// the number published
+func (m *Manager) Restore(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	n := 0
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, fmt.Errorf("invalid backup: %w", err)
+		}
+		if len(e.Payload) == 0 {
+			continue // An empty payload would clear the message
+		}
+		if err := m.publish(ctx, e.Topic, e.QoS, e.Payload); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// BackupFile writes a backup (see Backup) to the named file
+func (m *Manager) BackupFile(ctx context.Context, filter string, name string) (int, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.Backup(ctx, filter, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// RestoreFile restores a backup (see Restore) from the named file
+func (m *Manager) RestoreFile(ctx context.Context, name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return m.Restore(ctx, f)
+}
+
+// collect subscribes to filter and gathers retained messages until none has been received for Settle (or, if
+// single is set, the first is received)
+func (m *Manager) collect(ctx context.Context, filter string, single bool) ([]Entry, error) {
+	if sl, ok := m.client.(mqtt.SubscriptionLister); ok {
+		for _, s := range sl.Subscriptions() {
+			if s.Filter == filter {
+				return nil, fmt.Errorf("%w %q", ErrAlreadySubscribed, filter)
+			}
+		}
+	}
+	if rl, ok := m.client.(mqtt.RouteLister); ok {
+		for _, r := range rl.Routes() {
+			if r == filter {
+				return nil, fmt.Errorf("%w %q (a route exists)", ErrAlreadySubscribed, filter)
+			}
+		}
+	}
+	settle := m.Settle
+	if settle <= 0 {
+		settle = DefaultSettle
+	}
+
+	var mu sync.Mutex
+	entries := make(map[string]Entry)
+	received := make(chan struct{}, 1)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() {
+			return // Published after we subscribed
+		}
+		mu.Lock()
+		if len(msg.Payload()) > 0 {
+			entries[msg.Topic()] = Entry{Topic: msg.Topic(), QoS: msg.Qos(), Payload: append([]byte(nil), msg.Payload()...)}
+		}
+		mu.Unlock()
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	}
+	if err := waitToken(ctx, m.client.Subscribe(filter, m.QoS, handler)); err != nil {
+		return nil, err
+	}
+	defer m.client.Unsubscribe(filter) // Not waited for (the result does not affect the outcome)
+
+	timer := time.NewTimer(settle)
+	defer timer.Stop()
+wait:
+	for {
+		select {
+		case <-received:
+			if single {
+				break wait
+			}
+			timer.Reset(settle)
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	r := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		r = append(r, e)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Topic < r[j].Topic })
+	return r, nil
+}
+
+// publish publishes a retained message and waits for completion
+func (m *Manager) publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	if payload == nil {
+		payload = []byte{}
+	}
+	return waitToken(ctx, m.client.Publish(topic, qos, true, payload))
+}
+
+// waitToken waits for the token to complete (or ctx to be done)
+func waitToken(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
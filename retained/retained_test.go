@@ -0,0 +1,207 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package retained
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is a token that has already completed
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+// testMessage implements mqtt.Message
+type testMessage struct {
+	mqtt.Message
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+func (m *testMessage) Retained() bool  { return m.retained }
+func (m *testMessage) Qos() byte       { return 1 }
+
+// testClient emulates a broker's handling of retained messages
+type testClient struct {
+	mqtt.Client
+	mu       sync.Mutex
+	retained map[string][]byte
+	handlers map[string]mqtt.MessageHandler
+	routes   map[string]mqtt.MessageHandler // added by AddRoute (without a subscription)
+}
+
+func newTestClient() *testClient {
+	return &testClient{
+		retained: make(map[string][]byte),
+		handlers: make(map[string]mqtt.MessageHandler),
+		routes:   make(map[string]mqtt.MessageHandler),
+	}
+}
+
+func (c *testClient) AddRoute(filter string, h mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[filter] = h
+}
+
+func (c *testClient) Routes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var r []string
+	for f := range c.handlers {
+		r = append(r, f)
+	}
+	for f := range c.routes {
+		r = append(r, f)
+	}
+	return r
+}
+
+func (c *testClient) Subscriptions() []mqtt.Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var s []mqtt.Subscription
+	for f := range c.handlers {
+		s = append(s, mqtt.Subscription{Filter: f})
+	}
+	return s
+}
+
+func (c *testClient) Publish(topic string, _ byte, retained bool, payload interface{}) mqtt.Token {
+	p := payload.([]byte)
+	c.mu.Lock()
+	if retained {
+		if len(p) == 0 {
+			delete(c.retained, topic)
+		} else {
+			c.retained[topic] = p
+		}
+	}
+	var hs []mqtt.MessageHandler
+	for f, h := range c.handlers {
+		if mqtt.TopicMatches(f, topic) {
+			hs = append(hs, h)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range hs {
+		h(c, &testMessage{topic: topic, payload: p})
+	}
+	return doneToken{}
+}
+
+func (c *testClient) Subscribe(filter string, _ byte, h mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	c.handlers[filter] = h
+	var msgs []*testMessage
+	for t, p := range c.retained {
+		if mqtt.TopicMatches(filter, t) {
+			msgs = append(msgs, &testMessage{topic: t, payload: p, retained: true})
+		}
+	}
+	c.mu.Unlock()
+	go func() {
+		for _, m := range msgs {
+			h(c, m)
+		}
+	}()
+	return doneToken{}
+}
+
+func (c *testClient) Unsubscribe(filters ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range filters {
+		delete(c.handlers, f)
+	}
+	return doneToken{}
+}
+
+func Test_Retained(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient()
+	m := New(c)
+	m.Settle = 20 * time.Millisecond
+
+	for _, topic := range []string{"a/1", "a/2", "a/b/3", "b/1"} {
+		c.Publish(topic, 1, true, []byte("v"+topic))
+	}
+
+	e, err := m.Get(ctx, "a/2")
+	if err != nil || e.Topic != "a/2" || string(e.Payload) != "va/2" {
+		t.Fatalf("unexpected result %+v: %v", e, err)
+	}
+	if _, err = m.Get(ctx, "a/9"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = m.Get(ctx, "a/+"); !errors.Is(err, ErrWildcard) {
+		t.Fatalf("expected ErrWildcard, got %v", err)
+	}
+
+	entries, err := m.Snapshot(ctx, "a/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for _, e := range entries {
+		topics = append(topics, e.Topic)
+	}
+	if !reflect.DeepEqual(topics, []string{"a/1", "a/2", "a/b/3"}) {
+		t.Fatalf("unexpected snapshot %v", topics)
+	}
+
+	file := filepath.Join(t.TempDir(), "backup.jsonl")
+	if n, err := m.BackupFile(ctx, "a/#", file); err != nil || n != 3 {
+		t.Fatalf("backup failed (%d): %v", n, err)
+	}
+	if n, err := m.Clear(ctx, "a/#"); err != nil || n != 3 {
+		t.Fatalf("clear failed (%d): %v", n, err)
+	}
+	if len(c.retained) != 1 {
+		t.Fatalf("expected only b/1 to remain, got %v", c.retained)
+	}
+	if n, err := m.RestoreFile(ctx, file); err != nil || n != 3 {
+		t.Fatalf("restore failed (%d): %v", n, err)
+	}
+	if len(c.retained) != 4 || !bytes.Equal(c.retained["a/b/3"], []byte("va/b/3")) {
+		t.Fatalf("unexpected retained messages after restore %v", c.retained)
+	}
+
+	c.Subscribe("b/#", 1, func(mqtt.Client, mqtt.Message) {})
+	if _, err = m.Snapshot(ctx, "b/#"); !errors.Is(err, ErrAlreadySubscribed) {
+		t.Fatalf("expected ErrAlreadySubscribed, got %v", err)
+	}
+	c.AddRoute("a/#", func(mqtt.Client, mqtt.Message) {})
+	if _, err = m.Snapshot(ctx, "a/#"); !errors.Is(err, ErrAlreadySubscribed) {
+		t.Fatalf("expected ErrAlreadySubscribed for a route, got %v", err)
+	}
+	if c.routes["a/#"] == nil {
+		t.Fatalf("route removed")
+	}
+}
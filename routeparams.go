@@ -0,0 +1,150 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidRoutePattern is the error returned when a topic pattern containing named parameters is malformed
+var ErrInvalidRoutePattern = errors.New("invalid Topic; malformed route pattern")
+
+// Route Patterns
+// When enabled with ClientOptions.SetRoutePatterns, Subscribe, SubscribeMultiple, AddRoute and Unsubscribe accept
+// topic patterns with named parameters in place of
+// wildcards. A level in the form {name} is equivalent to "+" and a final level in the form {name...} is equivalent
+// to "#"; for example "devices/{id}/telemetry/{rest...}" subscribes to "devices/+/telemetry/#". The values matched
+// by each parameter are available to the handler via Params (or Param); a {name...} parameter holds the remaining
+// levels joined by "/" (which may be empty). Levels that do not begin with "{" and end with "}" are unaffected.
+// Note that patterns translating to the same filter share a route.
+
+// routeParam is a named parameter within a route pattern
+type routeParam struct {
+	name  string
+	level int  // Index of the level (after removal of any shared subscription prefix)
+	rest  bool // Matches all remaining levels
+}
+
+// parseRoutePattern translates a pattern containing named parameters into a topic filter. If the pattern contains
+// no parameters it is returned unchanged.
+func parseRoutePattern(pattern string) (string, []routeParam, error) {
+	if !strings.Contains(pattern, "{") {
+		return pattern, nil, nil
+	}
+	topicFilter := stripSharedPrefix(pattern)
+	prefix := pattern[:len(pattern)-len(topicFilter)]
+	levels := strings.Split(topicFilter, "/")
+	var params []routeParam
+	for i, level := range levels {
+		if len(level) < 2 || level[0] != '{' || level[len(level)-1] != '}' {
+			continue
+		}
+		p := routeParam{name: level[1 : len(level)-1], level: i}
+		if name, ok := strings.CutSuffix(p.name, "..."); ok {
+			if i != len(levels)-1 {
+				return "", nil, ErrInvalidRoutePattern
+			}
+			p.name, p.rest = name, true
+			levels[i] = "#"
+		} else {
+			levels[i] = "+"
+		}
+		if p.name == "" || strings.ContainsAny(p.name, "{}+#") {
+			return "", nil, ErrInvalidRoutePattern
+		}
+		for _, q := range params {
+			if q.name == p.name {
+				return "", nil, ErrInvalidRoutePattern
+			}
+		}
+		params = append(params, p)
+	}
+	return prefix + strings.Join(levels, "/"), params, nil
+}
+
+// parsePattern translates topic into a filter if route patterns are enabled; otherwise it is returned unchanged
+func (r *router) parsePattern(topic string) (string, []routeParam, error) {
+	if !r.patterns {
+		return topic, nil, nil
+	}
+	return parseRoutePattern(topic)
+}
+
+// routeFilter returns the topic filter for a topic that may be a pattern (or the topic itself if it is invalid)
+func (r *router) routeFilter(topic string) string {
+	if f, _, err := r.parsePattern(topic); err == nil {
+		return f
+	}
+	return topic
+}
+
+// extractParams returns the parameter values from topic
+func extractParams(params []routeParam, topic string) map[string]string {
+	levels := strings.Split(topic, "/")
+	values := make(map[string]string, len(params))
+	for _, p := range params {
+		switch {
+		case p.level >= len(levels):
+			values[p.name] = "" // "#" matches the absence of a level
+		case p.rest:
+			values[p.name] = strings.Join(levels[p.level:], "/")
+		default:
+			values[p.name] = levels[p.level]
+		}
+	}
+	return values
+}
+
+// routedMessage is passed to handlers; it holds information specific to the route that matched
+type routedMessage struct {
+	Message
+	route  string
+	params map[string]string
+}
+
+func (m *routedMessage) Params() map[string]string { return m.params }
+func (m *routedMessage) Unwrap() Message           { return m.Message }
+
+// Metadata returns the metadata of the underlying message with the matching route filled in
+func (m *routedMessage) Metadata() *MessageMetadata {
+	md := Metadata(m.Message)
+	if md == nil {
+		md = &MessageMetadata{}
+	}
+	md.Route = m.route
+	return md
+}
+
+// Params returns the values of the named parameters in the route pattern that matched the message (nil if the
+// route had no parameters). Messages wrapped by middleware are supported as long as the wrapper implements
+// Unwrap() Message.
+func Params(m Message) map[string]string {
+	for m != nil {
+		if p, ok := m.(interface{ Params() map[string]string }); ok {
+			return p.Params()
+		}
+		u, ok := m.(interface{ Unwrap() Message })
+		if !ok {
+			return nil
+		}
+		m = u.Unwrap()
+	}
+	return nil
+}
+
+// Param returns the value of a named parameter in the route pattern that matched the message ("" if not present)
+func Param(m Message, name string) string {
+	return Params(m)[name]
+}
@@ -23,6 +23,7 @@ import (
 	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -33,6 +34,8 @@ import (
 type route struct {
 	topic    string
 	callback MessageHandler
+	handler  MessageHandler // callback wrapped in the inbound middleware and bound to the route (see bind)
+	params   []routeParam   // named parameters, if the route was added using a pattern
 }
 
 // match takes a slice of strings which represent the route being tested having been split on '/'
@@ -63,28 +66,43 @@ func routeIncludesTopic(route, topic string) bool {
 	return match(routeSplit(route), strings.Split(topic, "/"))
 }
 
-// removes $share and sharename when splitting the route to allow
-// shared subscription routes to correctly match the topic
+// removes any shared subscription prefix ($share/sharename or $queue) when splitting
+// the route to allow shared subscription routes to correctly match the topic
 func routeSplit(route string) []string {
-	var result []string
-	if strings.HasPrefix(route, "$share") {
-		result = strings.Split(route, "/")[2:]
-	} else {
-		result = strings.Split(route, "/")
-	}
-	return result
+	return strings.Split(stripSharedPrefix(route), "/")
 }
 
 // match takes the topic string of the published message and does a basic compare to the
-// string of the current Route, if they match it returns true
+// string of the current Route, if they match it returns true.
+// Routes are keyed by the full filter, so routes for shared subscriptions (in different
+// groups) and a normal subscription to the same filter can coexist; note that each will
+// be called for every matching message (the broker sends a copy for each subscription).
 func (r *route) match(topic string) bool {
 	return r.topic == topic || routeIncludesTopic(r.topic, topic)
 }
 
+// bind returns a handler that calls h with the message wrapped so that the route (and its parameters) are
+// available. It is called when the route is added or changed, so dispatching a message allocates nothing per
+// route until the handler is actually called.
+func (r *route) bind(h MessageHandler) MessageHandler {
+	topic, params := r.topic, r.params
+	return func(c Client, m Message) {
+		rm := &routedMessage{Message: m, route: topic}
+		if len(params) > 0 {
+			rm.params = extractParams(params, m.Topic())
+		}
+		h(c, rm)
+	}
+}
+
 type router struct {
 	sync.RWMutex
 	routes         *list.List
 	defaultHandler MessageHandler
+	defaultWrapped MessageHandler                      // defaultHandler wrapped in the inbound middleware
+	wrap           func(MessageHandler) MessageHandler // applies the inbound middleware (nil if none)
+	patterns       bool                                // topics may be patterns with named parameters
+	deliveries     atomic.Uint64                       // last MessageMetadata.Delivery issued
 	messages       chan *packets.PublishPacket
 	logger         *slog.Logger
 }
@@ -99,22 +117,56 @@ func newRouter(logger *slog.Logger) *router {
 // addRoute takes a topic string and MessageHandler callback. It looks in the current list of
 // routes to see if there is already a matching Route. If there is it replaces the current
 // callback with the new one. If not it add a new entry to the list of Routes.
+// If patterns are enabled the topic may contain named parameters (and is translated to a filter).
 func (r *router) addRoute(topic string, callback MessageHandler) {
+	var params []routeParam
+	if f, p, err := r.parsePattern(topic); err == nil { // callers validate patterns
+		topic, params = f, p
+	}
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
 		if e.Value.(*route).topic == topic {
-			r := e.Value.(*route)
-			r.callback = callback
+			rt := e.Value.(*route)
+			rt.callback = callback
+			rt.params = params
+			rt.handler = rt.bind(r.wrapHandler(callback))
 			return
 		}
 	}
-	r.routes.PushBack(&route{topic: topic, callback: callback})
+	rt := &route{topic: topic, callback: callback, params: params}
+	rt.handler = rt.bind(r.wrapHandler(callback))
+	r.routes.PushBack(rt)
+}
+
+// filters returns the topic filters of the routes in the order they were added
+func (r *router) filters() []string {
+	r.RLock()
+	defer r.RUnlock()
+	f := make([]string, 0, r.routes.Len())
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		f = append(f, e.Value.(*route).topic)
+	}
+	return f
+}
+
+// RouteLister is implemented by a Client that can report the routes (message handlers) it holds (as the Client
+// returned by NewClient does)
+type RouteLister interface {
+	// Routes returns the topic filters of the routes added by Subscribe, SubscribeMultiple and AddRoute (and not
+	// subsequently removed); patterns (see SetRoutePatterns) are returned as the filter they translate to.
+	Routes() []string
+}
+
+// Routes returns the topic filters of the routes held by the client
+func (c *client) Routes() []string {
+	return c.msgRouter.filters()
 }
 
 // deleteRoute takes a route string, looks for a matching Route in the list of Routes. If
 // found it removes the Route from the list.
 func (r *router) deleteRoute(topic string) {
+	topic = r.routeFilter(topic)
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
@@ -131,12 +183,36 @@ func (r *router) setDefaultHandler(handler MessageHandler) {
 	r.Lock()
 	defer r.Unlock()
 	r.defaultHandler = handler
+	r.defaultWrapped = r.wrapHandler(handler)
+}
+
+// setMiddleware sets the function used to apply the inbound middleware to handlers (nil if there is none). Handlers
+// are wrapped when added (so middleware is not rebuilt for each message); any existing handlers are rewrapped.
+func (r *router) setMiddleware(wrap func(MessageHandler) MessageHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.wrap = wrap
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		rt := e.Value.(*route)
+		rt.handler = rt.bind(r.wrapHandler(rt.callback))
+	}
+	r.defaultWrapped = r.wrapHandler(r.defaultHandler)
+}
+
+// wrapHandler applies the inbound middleware to h (r must be locked)
+func (r *router) wrapHandler(h MessageHandler) MessageHandler {
+	if h == nil || r.wrap == nil {
+		return h
+	}
+	return r.wrap(h)
 }
 
 // matchAndDispatch takes a channel of Message pointers as input and starts a go routine that
 // takes messages off the channel, matches them against the internal route list and calls the
 // associated callback (or the defaultHandler, if one exists and no other route matched). If
 // anything is sent down the stop channel the function will end.
+// If ClientOptions.DispatchWorkers is set then handlers are called by a pool of workers (see SetDispatchWorkers)
+// and order is ignored.
 func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order bool, client *client) <-chan *PacketAndToken {
 	ackChan := make(chan *PacketAndToken) // Channel returned to caller; closed when goroutine terminates
 
@@ -155,57 +231,58 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 		}
 	}
 
+	broker, generation, stop := client.connBroker, client.connGeneration, client.stop // Fixed for the life of the connection
+	var pool *workerPool
+	if client.options.DispatchWorkers > 0 {
+		pool = newWorkerPool(client)
+	}
+
 	go func() { // Main go routine handling inbound messages
 		var handlers []MessageHandler
 		for message := range messages {
 			// DEBUG.Println(ROU, "matchAndDispatch received message")
-			sent := false
 			r.RLock()
-			m := messageFromPublish(message, ackFunc(sendAck, client.persist, message, r.logger))
+			m := messageFromPublish(message, ackFunc(sendAck, client.persist, message, r.logger), broker, generation)
+			m.pooled = client.options.PooledPayloads
+			m.meta.Delivery = r.deliveries.Add(1)
 			for e := r.routes.Front(); e != nil; e = e.Next() {
-				if e.Value.(*route).match(message.TopicName) {
-					if order {
-						handlers = append(handlers, e.Value.(*route).callback)
-					} else {
-						hd := e.Value.(*route).callback
-						go func() {
-							hd(client, m)
-							if !client.options.AutoAckDisabled {
-								m.Ack()
-							}
-						}()
-					}
-					sent = true
+				if rt := e.Value.(*route); rt.match(message.TopicName) {
+					handlers = append(handlers, rt.handler)
 				}
 			}
-			if !sent {
-				if r.defaultHandler != nil {
-					if order {
-						handlers = append(handlers, r.defaultHandler)
-					} else {
-						go func() {
-							r.defaultHandler(client, m)
-							if !client.options.AutoAckDisabled {
-								m.Ack()
-							}
-						}()
-					}
+			if len(handlers) == 0 {
+				if r.defaultWrapped != nil {
+					handlers = append(handlers, r.defaultWrapped)
 				} else {
 					r.logger.Debug("matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.", slog.String("component", string(ROU)))
 				}
 			}
 			r.RUnlock()
-			if order {
+			// All handlers are collected before any is called so that the count is known (see message.ReleasePayload)
+			m.handlers = len(handlers)
+			g := newHandlerGroup(m, len(handlers))
+			g.stop = stop
+			switch {
+			case len(handlers) == 0:
+			case pool != nil:
+				pool.dispatch(handlers, g)
+				handlers = nil // The slice is now owned by the worker
+			case order:
 				for _, handler := range handlers {
-					handler(client, m)
-					if !client.options.AutoAckDisabled {
-						m.Ack()
-					}
+					client.callHandler(handler, g)
+				}
+				handlers = handlers[:0]
+			default:
+				for _, handler := range handlers {
+					go client.callHandler(handler, g)
 				}
 				handlers = handlers[:0]
 			}
 			// DEBUG.Println(ROU, "matchAndDispatch handled message")
 		}
+		if pool != nil {
+			pool.stop() // Allow queued messages to be handled (and acknowledged)
+		}
 		ackMutex.Lock()
 		sendAckChan = nil
 		ackMutex.Unlock()
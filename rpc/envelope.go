@@ -0,0 +1,119 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Envelope wire format (MQTT v3.1.1 has no properties so the request/response metadata is carried in the payload):
+//
+//	byte 0      envelopeMarker
+//	byte 1      envelopeVersion
+//	byte 2      flags (bit 0 set if the request failed, in which case Error is present)
+//	            ResponseTopic   - uint16 length (big endian) followed by UTF-8 string
+//	            CorrelationData - uint16 length followed by binary data
+//	            Error           - uint16 length followed by UTF-8 string (only if flag bit 0 set)
+//	remainder   Payload
+//
+// Strings and binary data use the same encoding as MQTT so that, with MQTT v5, ResponseTopic and CorrelationData can
+// map directly to the Response Topic (0x08) and Correlation Data (0x09) properties (and Error to a User Property).
+
+const (
+	envelopeMarker  = 0xC5
+	envelopeVersion = 1
+	flagError       = 0x01
+)
+
+// ErrInvalidEnvelope is returned when a payload is not a valid envelope
+var ErrInvalidEnvelope = errors.New("rpc: invalid envelope")
+
+// Envelope holds a request or response along with the information needed to correlate them
+type Envelope struct {
+	ResponseTopic   string // Topic to which the response should be published ("" if no response is expected)
+	CorrelationData []byte // Identifies the request; copied into the response
+	Failed          bool   // Set (in a response) if the handler failed
+	Error           string // The error message (if Failed; this may be empty)
+	Payload         []byte
+}
+
+// MarshalBinary encodes the envelope
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	if len(e.ResponseTopic) > math.MaxUint16 || len(e.CorrelationData) > math.MaxUint16 || len(e.Error) > math.MaxUint16 {
+		return nil, errors.New("rpc: envelope field exceeds 65535 bytes")
+	}
+	size := 3 + 2 + len(e.ResponseTopic) + 2 + len(e.CorrelationData) + len(e.Payload)
+	var flags byte
+	failed := e.Failed || e.Error != ""
+	if failed {
+		flags |= flagError
+		size += 2 + len(e.Error)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, envelopeMarker, envelopeVersion, flags)
+	b = appendField(b, []byte(e.ResponseTopic))
+	b = appendField(b, e.CorrelationData)
+	if failed {
+		b = appendField(b, []byte(e.Error))
+	}
+	return append(b, e.Payload...), nil
+}
+
+// UnmarshalBinary decodes the envelope; Payload and CorrelationData will reference b
+func (e *Envelope) UnmarshalBinary(b []byte) error {
+	if len(b) < 3 || b[0] != envelopeMarker || b[1] != envelopeVersion {
+		return ErrInvalidEnvelope
+	}
+	flags := b[2]
+	b = b[3:]
+	var field []byte
+	var ok bool
+	if field, b, ok = readField(b); !ok {
+		return ErrInvalidEnvelope
+	}
+	e.ResponseTopic = string(field)
+	if e.CorrelationData, b, ok = readField(b); !ok {
+		return ErrInvalidEnvelope
+	}
+	e.Error = ""
+	e.Failed = flags&flagError != 0
+	if e.Failed {
+		if field, b, ok = readField(b); !ok {
+			return ErrInvalidEnvelope
+		}
+		e.Error = string(field)
+	}
+	e.Payload = b
+	return nil
+}
+
+// appendField appends the length prefixed field to b
+func appendField(b []byte, field []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(field)))
+	return append(b, field...)
+}
+
+// readField reads a length prefixed field from b, returning the field and the remainder of b
+func readField(b []byte) (field []byte, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, false
+	}
+	return b[2 : 2+l], b[2+l:], true
+}
@@ -0,0 +1,212 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package rpc implements request/response (command/reply) messaging on top of an mqtt.Client.
+//
+// A Requester publishes requests (wrapped in an Envelope that carries the reply topic and a correlation ID) and
+// waits for the matching response; a Server subscribes to request topics and publishes the value returned by the
+// handler to the reply topic. For example:
+//
+//	srv := rpc.NewServer(client)
+//	srv.Handle("svc/echo", func(ctx context.Context, req *rpc.Request) ([]byte, error) {
+//		return req.Payload, nil
+//	}).Wait()
+//
+//	r := rpc.NewRequester(client)
+//	resp, err := r.Call(ctx, "svc/echo", []byte("hello"))
+//
+// Note: If the client may reconnect with a clean session, enable ClientOptions.SetAutoResubscribe so that the
+// reply and request subscriptions are restored.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultReplyTopicPrefix is the prefix of the reply topic used by a Requester (unless ReplyTopic is set)
+const DefaultReplyTopicPrefix = "rpc/reply/"
+
+// DefaultTimeout is the maximum time Call will wait for a response if the context passed in has no deadline
+const DefaultTimeout = 30 * time.Second
+
+// ErrClosed is returned by Call if the Requester has been closed
+var ErrClosed = errors.New("rpc: requester closed")
+
+// RemoteError is returned by Call when the server handler returned an error
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string { return "rpc: remote error: " + e.Message }
+
+// Requester issues requests and correlates the responses. A single subscription (to ReplyTopic) is made when
+// the first request is sent. Requester is safe for concurrent use.
+type Requester struct {
+	// The fields below may be changed prior to the first call to Call
+	ReplyTopic string        // Topic that responses will be sent to (a unique topic is generated by NewRequester)
+	QoS        byte          // QoS used for requests and the reply subscription
+	Timeout    time.Duration // Used if the ctx passed to Call has no deadline (0 = no timeout)
+
+	client mqtt.Client
+
+	mu         sync.Mutex
+	subscribed bool
+	closed     bool
+	pending    map[string]chan *Envelope // keyed by correlation data
+}
+
+// NewRequester creates a Requester that will use client (which should be connected before Call is called). The
+// reply topic is DefaultReplyTopicPrefix followed by the client ID and a random suffix.
+func NewRequester(client mqtt.Client) *Requester {
+	r := client.OptionsReader()
+	return &Requester{
+		ReplyTopic: DefaultReplyTopicPrefix + r.ClientID() + "/" + randomID(4),
+		QoS:        1,
+		Timeout:    DefaultTimeout,
+		client:     client,
+		pending:    make(map[string]chan *Envelope),
+	}
+}
+
+// Call publishes payload to topic and waits for the response (or for ctx to be done).
+// Returns a *RemoteError if the server reported an error.
+func (r *Requester) Call(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if err := r.subscribe(ctx); err != nil {
+		return nil, err
+	}
+
+	correlation := randomID(16)
+	respChan := make(chan *Envelope, 1)
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrClosed
+	}
+	r.pending[correlation] = respChan
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, correlation)
+		r.mu.Unlock()
+	}()
+
+	req := Envelope{ResponseTopic: r.ReplyTopic, CorrelationData: []byte(correlation), Payload: payload}
+	b, err := req.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err = waitToken(ctx, r.client.Publish(topic, r.QoS, false, b)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if resp.Failed {
+			return nil, &RemoteError{Message: resp.Error}
+		}
+		return resp.Payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close unsubscribes from the reply topic and causes any outstanding calls to return ErrClosed
+func (r *Requester) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	subscribed := r.subscribed
+	for k, c := range r.pending {
+		close(c)
+		delete(r.pending, k)
+	}
+	r.mu.Unlock()
+	if subscribed {
+		t := r.client.Unsubscribe(r.ReplyTopic)
+		t.Wait()
+		return t.Error()
+	}
+	return nil
+}
+
+// subscribe subscribes to the reply topic if this has not already been done
+func (r *Requester) subscribe(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock() // Held so that concurrent callers wait for the subscription to complete
+	if r.closed {
+		return ErrClosed
+	}
+	if r.subscribed {
+		return nil
+	}
+	if err := waitToken(ctx, r.client.Subscribe(r.ReplyTopic, r.QoS, r.handleResponse)); err != nil {
+		return err
+	}
+	r.subscribed = true
+	return nil
+}
+
+// handleResponse is the message handler for the reply topic
+func (r *Requester) handleResponse(_ mqtt.Client, m mqtt.Message) {
+	var resp Envelope
+	// The envelope references the payload, which is copied as the response outlives the handler (and the payload
+	// may be pooled; see mqtt.ClientOptions.SetPooledPayloads)
+	if err := resp.UnmarshalBinary(bytes.Clone(m.Payload())); err != nil {
+		return // Not a response; ignore it
+	}
+	r.mu.Lock()
+	c, ok := r.pending[string(resp.CorrelationData)]
+	if ok {
+		delete(r.pending, string(resp.CorrelationData)) // Ensures only one response is delivered
+	}
+	r.mu.Unlock()
+	if ok {
+		c <- &resp // Buffered so will not block
+	}
+}
+
+// waitToken waits for the token to complete (or ctx to be done)
+func waitToken(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// randomID returns a random hex string generated from n bytes
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,179 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// doneToken is a token that has already completed
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (t doneToken) Error() error                   { return t.err }
+
+// testMessage implements mqtt.Message
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+// testClient is an in-memory mqtt.Client supporting Publish/Subscribe with exact topic matching (other methods
+// will panic)
+type testClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	handlers  map[string]mqtt.MessageHandler
+	published []string
+}
+
+func newTestClient() *testClient {
+	return &testClient{handlers: make(map[string]mqtt.MessageHandler)}
+}
+
+func (c *testClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(mqtt.NewClientOptions().SetClientID("test"))
+}
+
+func (c *testClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	c.published = append(c.published, topic)
+	h := c.handlers[topic]
+	c.mu.Unlock()
+	if h != nil {
+		go h(c, &testMessage{topic: topic, payload: payload.([]byte)})
+	}
+	return doneToken{}
+}
+
+func (c *testClient) Subscribe(topic string, _ byte, h mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	c.handlers[topic] = h
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+func (c *testClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	for _, t := range topics {
+		delete(c.handlers, t)
+	}
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+func Test_Envelope(t *testing.T) {
+	in := Envelope{ResponseTopic: "reply", CorrelationData: []byte{1, 2, 3}, Error: "failed", Payload: []byte("payload")}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Envelope
+	if err = out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if out.ResponseTopic != in.ResponseTopic || !bytes.Equal(out.CorrelationData, in.CorrelationData) ||
+		!out.Failed || out.Error != in.Error || !bytes.Equal(out.Payload, in.Payload) {
+		t.Fatalf("expected %+v, got %+v", in, out)
+	}
+
+	// A failure with an empty error message must still be reported as a failure
+	if b, err = (&Envelope{Failed: true}).MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.UnmarshalBinary(b); err != nil || !out.Failed || out.Error != "" {
+		t.Fatalf("expected failure, got %+v (%v)", out, err)
+	}
+	for _, bad := range [][]byte{nil, []byte("plain payload"), b[:5]} {
+		if err = out.UnmarshalBinary(bad); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Fatalf("expected ErrInvalidEnvelope for %v, got %v", bad, err)
+		}
+	}
+}
+
+func Test_CallAndHandle(t *testing.T) {
+	c := newTestClient()
+	srv := NewServer(c)
+	srv.Handle("svc/upper", func(_ context.Context, req *Request) ([]byte, error) {
+		if len(req.Payload) == 0 {
+			return nil, errors.New("empty request")
+		}
+		if string(req.Payload) == "-" {
+			return nil, errors.New("")
+		}
+		return []byte(strings.ToUpper(string(req.Payload))), nil
+	})
+	srv.Handle("svc/slow", func(ctx context.Context, _ *Request) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer srv.Close()
+
+	r := NewRequester(c)
+	if !strings.HasPrefix(r.ReplyTopic, DefaultReplyTopicPrefix+"test/") {
+		t.Fatalf("unexpected reply topic %q", r.ReplyTopic)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := r.Call(context.Background(), "svc/upper", []byte(s))
+			if err != nil || string(resp) != strings.ToUpper(s) {
+				t.Errorf("unexpected response %q: %v", resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var remote *RemoteError
+	if _, err := r.Call(context.Background(), "svc/upper", nil); !errors.As(err, &remote) || remote.Message != "empty request" {
+		t.Fatalf("expected RemoteError, got %v", err)
+	}
+	if _, err := r.Call(context.Background(), "svc/upper", []byte("-")); !errors.As(err, &remote) || remote.Message != "" {
+		t.Fatalf("expected RemoteError with empty message, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Call(ctx, "svc/slow", []byte("x")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Call(context.Background(), "svc/upper", []byte("x")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Request is passed to a HandlerFunc
+type Request struct {
+	Topic           string // Topic the request was received on
+	Payload         []byte
+	ResponseTopic   string // "" if no response is expected
+	CorrelationData []byte
+	Message         mqtt.Message // The message as received
+}
+
+// HandlerFunc processes a request; the returned payload is published as the response. If an error is returned
+// the caller will receive a *RemoteError holding its message.
+type HandlerFunc func(ctx context.Context, req *Request) ([]byte, error)
+
+// Server routes requests to handlers and publishes their responses. Handlers are run in their own goroutine so
+// may block (and may call Publish etc.).
+type Server struct {
+	// The fields below may be changed prior to calling Handle
+	QoS     byte                          // QoS used for subscriptions and responses
+	OnError func(topic string, err error) // If not nil, called when a request cannot be processed or responded to
+
+	client mqtt.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	topics []string
+}
+
+// NewServer creates a Server that will use client (which must be connected before Handle is called)
+func NewServer(client mqtt.Client) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{QoS: 1, client: client, ctx: ctx, cancel: cancel}
+}
+
+// Handle subscribes to topic (which may include wildcards or be a shared subscription) and calls h for each request
+// received. The returned token completes when the subscription has been acknowledged.
+func (s *Server) Handle(topic string, h HandlerFunc) mqtt.Token {
+	s.mu.Lock()
+	s.topics = append(s.topics, topic)
+	s.mu.Unlock()
+	return s.client.Subscribe(topic, s.QoS, func(c mqtt.Client, m mqtt.Message) {
+		var env Envelope
+		// The payload is copied as the request is handled after this handler returns (and the payload may be
+		// pooled; see mqtt.ClientOptions.SetPooledPayloads)
+		if err := env.UnmarshalBinary(bytes.Clone(m.Payload())); err != nil {
+			s.error(m.Topic(), err)
+			return
+		}
+		go s.serve(h, m, &env)
+	})
+}
+
+// Close unsubscribes from all topics passed to Handle and cancels the context passed to any running handlers
+func (s *Server) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	topics := s.topics
+	s.topics = nil
+	s.mu.Unlock()
+	if len(topics) == 0 {
+		return nil
+	}
+	t := s.client.Unsubscribe(topics...)
+	t.Wait()
+	return t.Error()
+}
+
+// serve calls the handler and publishes the response
+func (s *Server) serve(h HandlerFunc, m mqtt.Message, env *Envelope) {
+	req := &Request{
+		Topic:           m.Topic(),
+		Payload:         env.Payload,
+		ResponseTopic:   env.ResponseTopic,
+		CorrelationData: env.CorrelationData,
+		Message:         m,
+	}
+	payload, err := h(s.ctx, req)
+	if env.ResponseTopic == "" {
+		if err != nil {
+			s.error(m.Topic(), err)
+		}
+		return // No response expected
+	}
+	resp := Envelope{CorrelationData: env.CorrelationData, Payload: payload}
+	if err != nil {
+		resp.Failed = true
+		resp.Error = err.Error()
+		resp.Payload = nil
+	}
+	b, err := resp.MarshalBinary()
+	if err != nil {
+		s.error(m.Topic(), err)
+		return
+	}
+	t := s.client.Publish(env.ResponseTopic, s.QoS, false, b)
+	select {
+	case <-t.Done():
+		if t.Error() != nil {
+			s.error(m.Topic(), t.Error())
+		}
+	case <-s.ctx.Done():
+	}
+}
+
+// error reports an error via OnError (if set)
+func (s *Server) error(topic string, err error) {
+	if s.OnError != nil {
+		s.OnError(topic, err)
+	}
+}
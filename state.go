@@ -0,0 +1,203 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the state of the connection between the client and the broker (see status.go for details
+// of the transitions between states).
+type ConnectionState uint32
+
+const (
+	StateDisconnected  = ConnectionState(disconnected)
+	StateDisconnecting = ConnectionState(disconnecting) // Transitioning to StateDisconnected (or StateReconnecting)
+	StateConnecting    = ConnectionState(connecting)    // Connect has been called and is in progress
+	StateReconnecting  = ConnectionState(reconnecting)  // Connection was lost and the client is reconnecting
+	StateConnected     = ConnectionState(connected)
+)
+
+// String returns the state as a string (e.g. "connected")
+func (s ConnectionState) String() string {
+	return status(s).String()
+}
+
+// ErrDisconnectRequested is the Cause of state changes that result from a call to Disconnect
+var ErrDisconnectRequested = errors.New("disconnect requested")
+
+// StateChange describes a change in the ConnectionState
+type StateChange struct {
+	Previous ConnectionState
+	State    ConnectionState
+	Time     time.Time // When the change occurred
+	Since    time.Time // When the client entered the Previous state (zero if this is the initial state)
+	Broker   *url.URL  // The broker most recently connected to (or attempted); nil if no attempt has been made
+	Cause    error     // Why the change occurred (e.g. the error that led to the connection being lost); may be nil
+}
+
+// stateNotifier keeps track of state changes and delivers them to any watchers
+type stateNotifier struct {
+	mu       sync.Mutex
+	broker   *url.URL
+	cause    error
+	since    time.Time // time the current state was entered
+	watchers map[*stateWatcher]struct{}
+}
+
+// setBroker records the broker that is being connected to
+func (n *stateNotifier) setBroker(broker *url.URL) {
+	n.mu.Lock()
+	n.broker = broker
+	n.mu.Unlock()
+}
+
+// currentBroker returns the broker most recently connected to (or attempted)
+func (n *stateNotifier) currentBroker() *url.URL {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.broker
+}
+
+// setCause records the reason for the next state change
+func (n *stateNotifier) setCause(err error) {
+	n.mu.Lock()
+	n.cause = err
+	n.mu.Unlock()
+}
+
+// changed should be called whenever the status changes (it is used as connectionStatus.onChange so is called
+// with the status lock held and must not block)
+func (n *stateNotifier) changed(prev, next status) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	sc := StateChange{
+		Previous: ConnectionState(prev),
+		State:    ConnectionState(next),
+		Time:     now,
+		Since:    n.since,
+		Broker:   n.broker,
+		Cause:    n.cause,
+	}
+	n.since = now
+	if next == connected {
+		n.cause = nil // Any subsequent change is unrelated to the error that led up to the connection
+	}
+	for w := range n.watchers {
+		w.push(sc)
+	}
+}
+
+// watch registers a watcher; the initial state (as passed in) is queued before any changes
+func (n *stateNotifier) watch(current ConnectionState) *stateWatcher {
+	w := &stateWatcher{signal: make(chan struct{}, 1)}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.watchers == nil {
+		n.watchers = make(map[*stateWatcher]struct{})
+	}
+	n.watchers[w] = struct{}{}
+	w.push(StateChange{
+		Previous: current,
+		State:    current,
+		Time:     n.since,
+		Broker:   n.broker,
+		Cause:    n.cause,
+	})
+	return w
+}
+
+// unwatch removes a watcher
+func (n *stateNotifier) unwatch(w *stateWatcher) {
+	n.mu.Lock()
+	delete(n.watchers, w)
+	n.mu.Unlock()
+}
+
+// stateWatcher queues changes for a single watcher (so that a slow reader cannot block the client)
+type stateWatcher struct {
+	mu     sync.Mutex
+	queue  []StateChange
+	signal chan struct{} // buffered; receives a value when queue becomes non-empty
+}
+
+// push adds a change to the queue; it will not block
+func (w *stateWatcher) push(sc StateChange) {
+	w.mu.Lock()
+	w.queue = append(w.queue, sc)
+	w.mu.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued changes to out until ctx is done (at which point out is closed)
+func (w *stateWatcher) run(ctx context.Context, out chan<- StateChange) {
+	defer close(out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.signal:
+		}
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, sc := range queue {
+			select {
+			case out <- sc:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// StateWatcher is implemented by a Client that reports the state of its connection (as the Client returned by
+// NewClient does). It is separate from Client so that existing implementations of that interface are unaffected.
+type StateWatcher interface {
+	// State returns the current state of the connection to the broker
+	State() ConnectionState
+	// WatchState returns a channel that receives the current state, and then each
+	// change of state, until ctx is done (at which point the channel is closed).
+	WatchState(ctx context.Context) <-chan StateChange
+}
+
+// State returns the current state of the connection.
+// Warning: The state may change at any time; use WatchState to be notified of changes.
+func (c *client) State() ConnectionState {
+	return ConnectionState(c.status.ConnectionStatus())
+}
+
+// WatchState returns a channel that receives the current state followed by each subsequent state change (in
+// order). The channel is closed when ctx is done. Changes are queued for each watcher so a slow reader will not
+// delay the client (but, equally, will not skip any changes).
+func (c *client) WatchState(ctx context.Context) <-chan StateChange {
+	out := make(chan StateChange)
+	c.status.RLock() // Prevent state changes until the watcher is registered (so none are missed)
+	w := c.stateNotifier.watch(ConnectionState(c.status.status))
+	c.status.RUnlock()
+	go func() {
+		w.run(ctx, out)
+		c.stateNotifier.unwatch(w)
+	}()
+	return out
+}
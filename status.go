@@ -121,6 +121,19 @@ type connectionStatus struct {
 	// `connecting`). `actionCompleted` will be set whenever we move into one of the above statues and the channel
 	// returned to anything else requesting a status change. The channel will be closed when the operation is complete.
 	actionCompleted chan struct{} // Only valid whilst status is Connecting or Reconnecting; will be closed when connection completed (success or failure)
+
+	// onChange, if not nil, is called (with the lock held so calls are in order) whenever the status changes. It
+	// must not block or call any function of connectionStatus.
+	onChange func(prev, next status)
+}
+
+// setStatus sets the status and notifies onChange if it has changed. The lock MUST be held by the caller.
+func (c *connectionStatus) setStatus(s status) {
+	prev := c.status
+	c.status = s
+	if prev != s && c.onChange != nil {
+		c.onChange(prev, s)
+	}
 }
 
 // ConnectionStatus returns the connection status.
@@ -152,7 +165,7 @@ func (c *connectionStatus) Connecting() (connCompletedFn, error) {
 	if c.status != disconnected {
 		return nil, errStatusMustBeDisconnected
 	}
-	c.status = connecting
+	c.setStatus(connecting)
 	c.actionCompleted = make(chan struct{})
 	return c.connected, nil
 }
@@ -172,9 +185,9 @@ func (c *connectionStatus) connected(success bool) error {
 		return errAbortConnection
 	}
 	if success {
-		c.status = connected
+		c.setStatus(connected)
 	} else {
-		c.status = disconnected
+		c.setStatus(disconnected)
 	}
 	return nil
 }
@@ -199,7 +212,7 @@ func (c *connectionStatus) Disconnecting() (disconnectCompletedFn, error) {
 	}
 
 	prevStatus := c.status
-	c.status = disconnecting
+	c.setStatus(disconnecting)
 
 	// We may need to wait for connection/reconnection process to complete (they should regularly check the status)
 	if prevStatus == connecting || prevStatus == reconnecting {
@@ -221,7 +234,7 @@ func (c *connectionStatus) Disconnecting() (disconnectCompletedFn, error) {
 func (c *connectionStatus) disconnectionCompleted() {
 	c.Lock()
 	defer c.Unlock()
-	c.status = disconnected
+	c.setStatus(disconnected)
 	close(c.actionCompleted) // Alert anything waiting on the connection process to complete
 	c.actionCompleted = nil
 }
@@ -233,6 +246,12 @@ func (c *connectionStatus) disconnectionCompleted() {
 // reconnect completes (or nil if no reconnect requested/disconnect called in the interim).
 // Note: This function may block if a connection is in progress (the move to connected will be rejected)
 func (c *connectionStatus) ConnectionLost(willReconnect bool) (connectionLostHandledFn, error) {
+	return c.connectionLost(willReconnect, nil)
+}
+
+// connectionLost implements ConnectionLost; if the status changes, beforeChange (if not nil) is called, with the lock
+// held, immediately before the change is made (it must not call any function of connectionStatus).
+func (c *connectionStatus) connectionLost(willReconnect bool, beforeChange func()) (connectionLostHandledFn, error) {
 	c.Lock()
 	defer c.Unlock()
 	if c.status == disconnected {
@@ -242,9 +261,12 @@ func (c *connectionStatus) ConnectionLost(willReconnect bool) (connectionLostHan
 		return nil, errDisconnectionInProgress
 	}
 
+	if beforeChange != nil {
+		beforeChange()
+	}
 	c.willReconnect = willReconnect
 	prevStatus := c.status
-	c.status = disconnecting
+	c.setStatus(disconnecting)
 
 	// There is a slight possibility that a connection attempt is in progress (connection up and goroutines started but
 	// status not yet changed). By changing the status we ensure that process will exit cleanly
@@ -272,7 +294,7 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 
 		// `Disconnecting()` may have been called while the disconnection was being processed (this makes it permanent!)
 		if !c.willReconnect || !proceed {
-			c.status = disconnected
+			c.setStatus(disconnected)
 			close(c.actionCompleted) // Alert anything waiting on the connection process to complete
 			c.actionCompleted = nil
 			if !reconnectRequested || !proceed {
@@ -281,7 +303,7 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 			return nil, errDisconnectionRequested
 		}
 
-		c.status = reconnecting
+		c.setStatus(reconnecting)
 		return c.connected, nil // Note that c.actionCompleted is still live and will be closed in connected
 	}
 }
@@ -292,5 +314,5 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 func (c *connectionStatus) forceConnectionStatus(s status) {
 	c.Lock()
 	defer c.Unlock()
-	c.status = s
+	c.setStatus(s)
 }
@@ -0,0 +1,299 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrSubscriptionRejected is returned (possibly wrapped) when the broker rejects a subscription (SUBACK return
+// code 0x80)
+var ErrSubscriptionRejected = errors.New("subscription rejected by broker")
+
+// ErrQoSDowngraded is returned (possibly wrapped) when the broker grants a lower QoS than requested and
+// ClientOptions.QoSDowngradeIsError is set
+var ErrQoSDowngraded = errors.New("subscription granted with lower QoS than requested")
+
+// subackFailure is the SUBACK return code indicating that the subscription failed
+const subackFailure = 0x80
+
+// maxResubscribeFilters is the maximum number of filters sent in a single SUBSCRIBE packet when resubscribing
+const maxResubscribeFilters = 100
+
+// SubscriptionError provides details of a single filter that the broker rejected (or granted a lower QoS than
+// requested). Use errors.Is with ErrSubscriptionRejected or ErrQoSDowngraded to determine which.
+type SubscriptionError struct {
+	Filter    string
+	Requested byte // QoS requested
+	Granted   byte // SUBACK return code (0x80 if rejected)
+}
+
+func (e *SubscriptionError) Error() string {
+	if e.Rejected() {
+		return fmt.Sprintf("subscription to %q rejected by broker", e.Filter)
+	}
+	return fmt.Sprintf("subscription to %q granted QoS %d (requested %d)", e.Filter, e.Granted, e.Requested)
+}
+
+// Rejected returns true if the broker rejected the subscription (false if the QoS was downgraded)
+func (e *SubscriptionError) Rejected() bool {
+	return e.Granted == subackFailure
+}
+
+// Is allows errors.Is to match ErrSubscriptionRejected or ErrQoSDowngraded as appropriate
+func (e *SubscriptionError) Is(target error) bool {
+	if e.Rejected() {
+		return target == ErrSubscriptionRejected
+	}
+	return target == ErrQoSDowngraded
+}
+
+// Subscription holds details of a subscription in the client's registry (see Client.Subscriptions)
+type Subscription struct {
+	Filter  string // Topic filter as passed to Subscribe (including any $share/$queue prefix)
+	QoS     byte   // Requested QoS
+	Granted byte   // QoS granted by the broker (only valid if Pending is false)
+	Pending bool   // True until the broker acknowledges the subscription
+}
+
+// subscriptionEntry is an entry in the subscriptionRegistry
+type subscriptionEntry struct {
+	Subscription
+	route string // The route added when subscribing ("" if none)
+}
+
+// subscriptionRegistry keeps track of the subscriptions that the client has requested (so they can be restored
+// if the broker does not retain the session). Entries are added when Subscribe is called and removed upon
+// Unsubscribe or if the broker rejects the subscription.
+type subscriptionRegistry struct {
+	sync.RWMutex
+	subs map[string]*subscriptionEntry // keyed by filter
+}
+
+// add adds (or replaces) the subscription for filter; the returned entry should be passed to acknowledged
+func (r *subscriptionRegistry) add(filter string, qos byte, route string) *subscriptionEntry {
+	e := &subscriptionEntry{Subscription: Subscription{Filter: filter, QoS: qos, Pending: true}, route: route}
+	r.Lock()
+	defer r.Unlock()
+	if r.subs == nil {
+		r.subs = make(map[string]*subscriptionEntry)
+	}
+	r.subs[filter] = e
+	return e
+}
+
+// acknowledged records the broker's response to the subscription. If the broker rejected the subscription
+// it is removed from the registry. Returns false if the entry has been replaced or removed in the interim.
+func (r *subscriptionRegistry) acknowledged(e *subscriptionEntry, granted byte) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.subs[e.Filter] != e {
+		return false
+	}
+	if granted == subackFailure {
+		delete(r.subs, e.Filter)
+		return true
+	}
+	e.Granted = granted
+	e.Pending = false
+	return true
+}
+
+// remove removes the specified filters from the registry
+func (r *subscriptionRegistry) remove(filters ...string) {
+	r.Lock()
+	defer r.Unlock()
+	for _, f := range filters {
+		delete(r.subs, f)
+	}
+}
+
+// list returns a copy of the registry ordered by filter
+func (r *subscriptionRegistry) list() []Subscription {
+	r.RLock()
+	defer r.RUnlock()
+	subs := make([]Subscription, 0, len(r.subs))
+	for _, e := range r.subs {
+		subs = append(subs, e.Subscription)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	return subs
+}
+
+// entries returns the registry entries themselves (so they can be passed to acknowledged)
+func (r *subscriptionRegistry) entries() []*subscriptionEntry {
+	r.RLock()
+	defer r.RUnlock()
+	subs := make([]*subscriptionEntry, 0, len(r.subs))
+	for _, e := range r.subs {
+		subs = append(subs, e)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	return subs
+}
+
+// SubscriptionLister is implemented by a Client that tracks its subscriptions (as the Client returned by NewClient
+// does)
+type SubscriptionLister interface {
+	// Subscriptions returns the subscriptions that the client has requested (and
+	// not unsubscribed from); these are restored automatically if AutoResubscribe is set.
+	Subscriptions() []Subscription
+}
+
+// Subscriptions returns the subscriptions that the client has requested and not subsequently unsubscribed from
+// (or had rejected by the broker). This is the set that will be restored if AutoResubscribe is enabled.
+func (c *client) Subscriptions() []Subscription {
+	return c.subscriptions.list()
+}
+
+// trackSubscribe adds the filters being subscribed to (via token) to the registry and arranges for the SUBACK to
+// be checked when it is received. routed indicates that Subscribe added routes (keyed by filter).
+func (c *client) trackSubscribe(token *SubscribeToken, filters []string, qoss []byte, routed bool) {
+	entries := make([]*subscriptionEntry, len(filters))
+	for i, f := range filters {
+		var route string
+		if routed {
+			route = f
+		}
+		entries[i] = c.subscriptions.add(f, qoss[i], route)
+	}
+	token.onSuback = func(result map[string]byte) error {
+		var errs []error
+		for i, e := range entries {
+			if granted, ok := result[token.subs[i]]; ok {
+				if err := c.subscriptionAcknowledged(e, granted); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// subscriptionAcknowledged processes the broker's response to the subscription e. If the broker rejected the
+// subscription then any route added by Subscribe is removed. The OnSubscriptionError handler is called if the
+// subscription was rejected or downgraded. Returns a *SubscriptionError if the response is not acceptable.
+// Note: This is called from the comms goroutine so must not block.
+func (c *client) subscriptionAcknowledged(e *subscriptionEntry, granted byte) error {
+	current := c.subscriptions.acknowledged(e, granted)
+	if granted != subackFailure && granted >= e.QoS {
+		return nil
+	}
+	se := &SubscriptionError{Filter: e.Filter, Requested: e.QoS, Granted: granted}
+	c.logger.Warn("subscription not granted as requested", slog.String("topic", e.Filter), slog.Int("requested", int(e.QoS)), slog.Int("granted", int(granted)), slog.String("component", string(CLI)))
+	if c.options.OnSubscriptionError != nil {
+		go c.options.OnSubscriptionError(c, se)
+	}
+	if se.Rejected() {
+		if current && e.route != "" {
+			c.msgRouter.deleteRoute(e.route)
+		}
+		return se
+	}
+	if c.options.QoSDowngradeIsError {
+		return se
+	}
+	return nil
+}
+
+// resubscribe sends SUBSCRIBE packets for the registry entries passed in (called when the broker reports that no
+// session is present) and then calls the OnResubscribe handler with any failures. It runs as a worker so exits,
+// without calling the handler, if stop is closed (the subscriptions will be restored when the client reconnects).
+func (c *client) resubscribe(entries []*subscriptionEntry, stop <-chan struct{}) {
+	c.logger.Debug("resubscribing", slog.Int("filters", len(entries)), slog.String("component", string(CLI)))
+	waitTimeout := c.options.WriteTimeout
+	if waitTimeout == 0 {
+		waitTimeout = time.Second * 30
+	}
+
+	failures := make(map[string]error)
+	for start := 0; start < len(entries); start += maxResubscribeFilters {
+		batch := entries[start:min(start+maxResubscribeFilters, len(entries))]
+		failed := func(err error) {
+			for _, e := range batch {
+				failures[e.Filter] = err
+			}
+		}
+
+		sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		token := newToken(packets.Subscribe).(*SubscribeToken)
+		for _, e := range batch {
+			sub.Topics = append(sub.Topics, e.Filter)
+			sub.Qoss = append(sub.Qoss, e.QoS)
+			token.subs = append(token.subs, e.Filter)
+		}
+		mID := c.getID(token)
+		if mID == 0 {
+			failed(errors.New("no message IDs available"))
+			continue
+		}
+		sub.MessageID = mID
+		token.messageID = mID
+
+		timer := time.NewTimer(waitTimeout)
+		select {
+		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
+		case <-timer.C:
+			c.freeID(mID)
+			failed(errors.New("resubscribe was broken by timeout"))
+			continue
+		case <-stop:
+			timer.Stop()
+			c.freeID(mID)
+			c.logger.Debug("resubscribe stopped", slog.String("component", string(CLI)))
+			return
+		}
+		timer.Reset(waitTimeout)
+		select {
+		case <-token.Done():
+			timer.Stop()
+		case <-timer.C:
+			failed(errors.New("resubscribe timed out awaiting SUBACK"))
+			continue
+		case <-stop:
+			timer.Stop()
+			c.logger.Debug("resubscribe stopped", slog.String("component", string(CLI)))
+			return
+		}
+		if err := token.Error(); err != nil {
+			failed(err)
+			continue
+		}
+		result := token.Result()
+		for _, e := range batch {
+			granted, ok := result[e.Filter]
+			if !ok {
+				failures[e.Filter] = errors.New("no result in SUBACK")
+				continue
+			}
+			if err := c.subscriptionAcknowledged(e, granted); err != nil {
+				failures[e.Filter] = err
+			}
+		}
+	}
+
+	for filter, err := range failures {
+		c.logger.Warn("resubscribe failed", slog.String("topic", filter), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+	}
+	if c.options.OnResubscribe != nil {
+		go c.options.OnResubscribe(c, failures) // The handler may call Disconnect (which waits for this worker)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// tapRedacted replaces the username and password in CONNECT packets passed to a PacketTap
+const tapRedacted = "<redacted>"
+
+// TapDirection indicates whether a packet passed to a PacketTap was sent or received
+type TapDirection byte
+
+const (
+	TapInbound  TapDirection = iota // Received from the broker
+	TapOutbound                     // Sent to the broker
+)
+
+func (d TapDirection) String() string {
+	if d == TapOutbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// PacketTap receives a copy of each packet sent or received over the network connection (see
+// ClientOptions.SetPacketTap), including CONNECT (with any username and password replaced by "<redacted>") and
+// CONNACK. The package capture provides an implementation that records packets to a file.
+type PacketTap interface {
+	// TapPacket is called with each complete packet; raw holds the encoded packet and must not be retained. It is
+	// called from the goroutines reading from, and writing to, the connection so must be safe for concurrent use,
+	// and should return quickly (it delays communications).
+	TapPacket(dir TapDirection, at time.Time, raw []byte)
+}
+
+// PacketTapFunc is an adapter allowing a function to be used as a PacketTap
+type PacketTapFunc func(dir TapDirection, at time.Time, raw []byte)
+
+// TapPacket calls f(dir, at, raw)
+func (f PacketTapFunc) TapPacket(dir TapDirection, at time.Time, raw []byte) {
+	f(dir, at, raw)
+}
+
+// tapConn wraps a net.Conn, passing each packet read or written to a PacketTap
+type tapConn struct {
+	net.Conn
+	tap PacketTap
+
+	inMu  sync.Mutex
+	in    tapFramer
+	outMu sync.Mutex
+	out   tapFramer
+}
+
+// newTapConn returns conn wrapped such that packets are passed to tap
+func newTapConn(conn net.Conn, tap PacketTap) *tapConn {
+	return &tapConn{
+		Conn: conn,
+		tap:  tap,
+		in:   tapFramer{dir: TapInbound},
+		out:  tapFramer{dir: TapOutbound},
+	}
+}
+
+func (t *tapConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.inMu.Lock()
+		t.in.feed(p[:n], t.tap)
+		t.inMu.Unlock()
+	}
+	return n, err
+}
+
+// Write passes p to the underlying connection; the lock ensures the tap sees packets in the order they were sent
+func (t *tapConn) Write(p []byte) (int, error) {
+	t.outMu.Lock()
+	defer t.outMu.Unlock()
+	n, err := t.Conn.Write(p)
+	if n > 0 {
+		t.out.feed(p[:n], t.tap)
+	}
+	return n, err
+}
+
+// tapFramer splits a stream of bytes into packets
+type tapFramer struct {
+	dir TapDirection
+	buf []byte
+}
+
+// feed adds b to the stream, passing any packets completed to tap
+func (f *tapFramer) feed(b []byte, tap PacketTap) {
+	if len(f.buf) == 0 {
+		b = f.emit(b, tap) // Avoid copying where b holds complete packets (usually the case when writing)
+		if len(b) == 0 {
+			return
+		}
+	}
+	f.buf = append(f.buf, b...)
+	if rest := f.emit(f.buf, tap); len(rest) < len(f.buf) {
+		f.buf = append(f.buf[:0], rest...)
+	}
+}
+
+// emit passes each complete packet at the start of b to tap, returning the remainder
+func (f *tapFramer) emit(b []byte, tap PacketTap) []byte {
+	for {
+		size, ok := tapPacketSize(b)
+		if !ok || size > len(b) {
+			return b
+		}
+		if raw := b[:size]; f.dir == TapOutbound && raw[0]>>4 == packets.Connect {
+			if raw = redactConnect(raw); raw != nil {
+				tap.TapPacket(f.dir, time.Now(), raw)
+			}
+		} else {
+			tap.TapPacket(f.dir, time.Now(), raw)
+		}
+		b = b[size:]
+	}
+}
+
+// tapPacketSize returns the size of the packet at the start of b (false if the fixed header is incomplete). A
+// malformed remaining length results in the entire buffer being treated as a single packet (so it is not lost).
+func tapPacketSize(b []byte) (int, bool) {
+	length, multiplier := 0, 1
+	for i := 1; i < len(b); i++ {
+		length += int(b[i]&127) * multiplier
+		if b[i]&128 == 0 {
+			return 1 + i + length, true
+		}
+		if multiplier *= 128; i == 4 {
+			return len(b), true
+		}
+	}
+	return 0, false
+}
+
+// redactConnect returns a copy of the CONNECT packet raw with the username and password replaced (nil if it cannot
+// be decoded, in which case it is not passed to the tap as it may hold credentials)
+func redactConnect(raw []byte) []byte {
+	cp, err := packets.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return nil
+	}
+	if connect.UsernameFlag {
+		connect.Username = tapRedacted
+	}
+	if connect.PasswordFlag {
+		connect.Password = []byte(tapRedacted)
+	}
+	var buf bytes.Buffer
+	if err = connect.Write(&buf); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,103 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// TLSConnectionProfile holds TLS settings that may vary between brokers. Some cloud brokers accept MQTT over TLS on
+// port 443 and use ALPN to distinguish MQTT from other traffic; for example:
+//
+//	opts.AddBroker("tls://example-ats.iot.eu-west-1.amazonaws.com:443")
+//	opts.SetTLSProfile(&mqtt.TLSConnectionProfile{ALPN: []string{"x-amzn-mqtt-ca"}})
+type TLSConnectionProfile struct {
+	// ServerName overrides the server name sent in the TLS ClientHello (SNI) and used to verify the broker
+	// certificate. If "" the broker hostname (or tls.Config.ServerName, if set) is used.
+	ServerName string
+
+	// ALPN lists the application protocols offered during the TLS handshake (in order of preference). When
+	// set, the connection will fail with an *ALPNError unless the broker selects one of these protocols.
+	ALPN []string
+}
+
+// ALPNError is returned when a connection is made with ALPN protocols set in a TLSConnectionProfile but the
+// broker does not agree one of them.
+type ALPNError struct {
+	Offered    []string // Protocols offered by the client
+	Negotiated string   // Protocol selected by the broker ("" if none)
+}
+
+func (e *ALPNError) Error() string {
+	if e.Negotiated == "" {
+		return fmt.Sprintf("ALPN protocol not negotiated (offered %s)", strings.Join(e.Offered, ","))
+	}
+	return fmt.Sprintf("unexpected ALPN protocol %q negotiated (offered %s)", e.Negotiated, strings.Join(e.Offered, ","))
+}
+
+// apply returns a copy of tlsc (which may be nil) with the profile applied
+func (p *TLSConnectionProfile) apply(tlsc *tls.Config) *tls.Config {
+	if p == nil || (p.ServerName == "" && len(p.ALPN) == 0) {
+		return tlsc
+	}
+	if tlsc == nil {
+		tlsc = &tls.Config{}
+	} else {
+		tlsc = tlsc.Clone()
+	}
+	if p.ServerName != "" {
+		tlsc.ServerName = p.ServerName
+	}
+	if len(p.ALPN) > 0 {
+		tlsc.NextProtos = append([]string(nil), p.ALPN...)
+	}
+	return tlsc
+}
+
+// brokerTLSProfile returns the TLSConnectionProfile that applies to the broker (nil if none)
+func (o *ClientOptions) brokerTLSProfile(broker *url.URL) *TLSConnectionProfile {
+	if p, ok := o.BrokerTLSProfiles[broker.Host]; ok {
+		return p
+	}
+	return o.TLSProfile
+}
+
+// verifyALPN checks that one of the protocols in alpn was negotiated on conn (which must be a TLS connection,
+// either directly or beneath a websocket that provides UnderlyingConn). Does nothing if alpn is empty.
+func verifyALPN(conn net.Conn, alpn []string) error {
+	if len(alpn) == 0 {
+		return nil
+	}
+	var tlsConn *tls.Conn
+	switch c := conn.(type) {
+	case *tls.Conn:
+		tlsConn = c
+	case interface{ UnderlyingConn() net.Conn }: // e.g. websocketConnector
+		tlsConn, _ = c.UnderlyingConn().(*tls.Conn)
+	}
+	if tlsConn == nil {
+		return fmt.Errorf("ALPN requires a TLS connection (offered %s)", strings.Join(alpn, ","))
+	}
+	negotiated := tlsConn.ConnectionState().NegotiatedProtocol
+	for _, p := range alpn {
+		if p == negotiated {
+			return nil
+		}
+	}
+	return &ALPNError{Offered: alpn, Negotiated: negotiated}
+}
@@ -0,0 +1,338 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrCertificateRenewal is passed to the connection lost handlers when the client drops the connection in
+// order to reconnect with a renewed client certificate (see TLSReloader.RenewBefore).
+var ErrCertificateRenewal = errors.New("reconnecting to present renewed client certificate")
+
+// TLSSource returns the client certificate and root CAs that should be used for new connections. Either
+// value may be nil (no client certificate will be presented / the RootCAs from the base tls.Config are used).
+type TLSSource func() (*tls.Certificate, *x509.CertPool, error)
+
+// NewFileTLSSource returns a TLSSource that loads a PEM encoded certificate/key pair and, optionally, a PEM
+// encoded CA bundle from disk each time it is called. Pass "" for certFile/keyFile or caFile to omit them.
+func NewFileTLSSource(certFile, keyFile, caFile string) TLSSource {
+	return func() (*tls.Certificate, *x509.CertPool, error) {
+		var cert *tls.Certificate
+		if certFile != "" || keyFile != "" {
+			c, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			cert = &c
+		}
+		var roots *x509.CertPool
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("loading CA file: %w", err)
+			}
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+			}
+		}
+		return cert, roots, nil
+	}
+}
+
+// TLSReloader holds a client certificate and set of root CAs that can be replaced whilst the client is running.
+// Certificates are (re)loaded from a TLSSource; this can be done on demand (Reload) or periodically (Watch).
+// Each connection attempt uses the most recently loaded material.
+//
+// Use ClientOptions.SetTLSReloader to apply the reloader to a client.
+type TLSReloader struct {
+	// RenewBefore, if non-zero, causes the client to reconnect (when AutoReconnect is enabled) this long before
+	// the certificate used for the current connection expires, so long as a certificate with a later expiry
+	// is available by then.
+	RenewBefore time.Duration
+
+	// OnReload, if set, is called after each attempt to load new material that either fails or changes
+	// the certificate/CAs in use.
+	OnReload func(err error)
+
+	source TLSSource
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	leaf    *x509.Certificate
+	roots   *x509.CertPool
+	changed chan struct{} // closed (and replaced) whenever the certificate changes
+
+	watchMu sync.Mutex
+	stop    chan struct{}
+}
+
+// NewTLSReloader creates a TLSReloader and performs the initial load from source.
+func NewTLSReloader(source TLSSource) (*TLSReloader, error) {
+	if source == nil {
+		return nil, errors.New("nil TLSSource")
+	}
+	r := &TLSReloader{source: source, changed: make(chan struct{})}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewFileTLSReloader is a convenience function that creates a TLSReloader using NewFileTLSSource.
+func NewFileTLSReloader(certFile, keyFile, caFile string) (*TLSReloader, error) {
+	return NewTLSReloader(NewFileTLSSource(certFile, keyFile, caFile))
+}
+
+// Reload retrieves the certificate and root CAs from the source. The existing values are retained if an
+// error is returned.
+func (r *TLSReloader) Reload() error {
+	cert, roots, err := r.source()
+	if err != nil {
+		r.notify(err)
+		return err
+	}
+	var leaf *x509.Certificate
+	if cert != nil {
+		if len(cert.Certificate) == 0 {
+			err = errors.New("TLSSource returned a certificate with no data")
+			r.notify(err)
+			return err
+		}
+		if leaf = cert.Leaf; leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				err = fmt.Errorf("parsing client certificate: %w", err)
+				r.notify(err)
+				return err
+			}
+		}
+	}
+
+	r.mu.Lock()
+	certChanged := !sameCertificate(r.cert, cert)
+	rootsChanged := !sameRoots(r.roots, roots)
+	r.cert, r.leaf, r.roots = cert, leaf, roots
+	if certChanged {
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+	r.mu.Unlock()
+
+	if certChanged || rootsChanged {
+		r.notify(nil)
+	}
+	return nil
+}
+
+// notify calls OnReload (if set)
+func (r *TLSReloader) notify(err error) {
+	if r.OnReload != nil {
+		r.OnReload(err)
+	}
+}
+
+// Watch starts a goroutine that calls Reload every interval until Stop is called. Calling Watch when already
+// watching replaces the existing watcher.
+func (r *TLSReloader) Watch(interval time.Duration) {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_ = r.Reload() // errors are reported via OnReload
+			}
+		}
+	}()
+}
+
+// Stop ends any watch started by Watch
+func (r *TLSReloader) Stop() {
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// Certificate returns the currently loaded client certificate (may be nil)
+func (r *TLSReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// NotAfter returns the expiry time of the currently loaded client certificate (zero if there is none)
+func (r *TLSReloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.leaf == nil {
+		return time.Time{}
+	}
+	return r.leaf.NotAfter
+}
+
+// TLSConfig returns a copy of base (which may be nil) with RootCAs and the client certificate set from the reloader.
+// If the reloader holds a client certificate it takes precedence: GetClientCertificate is set and any Certificates
+// in base are cleared. Otherwise the client certificate configuration in base (Certificates or GetClientCertificate)
+// is retained. Likewise RootCAs are only replaced if a CA bundle has been loaded. Note that the values are fixed in
+// the returned config; the client calls TLSConfig for every connection attempt so will always pick up the latest.
+func (r *TLSReloader) TLSConfig(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	r.mu.RLock()
+	if r.roots != nil {
+		cfg.RootCAs = r.roots
+	}
+	if r.cert != nil {
+		cfg.Certificates = nil
+		cfg.GetClientCertificate = r.getClientCertificate
+	}
+	r.mu.RUnlock()
+	return cfg
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate
+func (r *TLSReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil // No certificate will be sent
+}
+
+// changedChan returns a channel that will be closed when the certificate is next changed
+func (r *TLSReloader) changedChan() <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.changed
+}
+
+func sameCertificate(a, b *tls.Certificate) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Certificate) != len(b.Certificate) {
+		return false
+	}
+	for i := range a.Certificate {
+		if !bytes.Equal(a.Certificate[i], b.Certificate[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRoots(a, b *x509.CertPool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
+
+// tlsRenewal is a worker that reconnects ahead of the expiry of the client certificate used for the current connection
+// (so long as a newer certificate is available).
+func tlsRenewal(c *client, r *TLSReloader) {
+	defer c.workers.Done()
+	c.logger.Debug("tlsRenewal starting", slog.String("component", string(CLI)))
+	connExpiry := r.NotAfter() // The connection was just established so this is the certificate in use
+	if connExpiry.IsZero() {
+		c.logger.Debug("tlsRenewal no client certificate; exiting", slog.String("component", string(CLI)))
+		return
+	}
+	const recheckInterval = time.Minute // if no newer certificate is available when renewal is due we check periodically
+
+	timer := time.NewTimer(time.Until(connExpiry.Add(-r.RenewBefore)))
+	defer timer.Stop()
+	for {
+		changed := r.changedChan()
+		select {
+		case <-c.stop:
+			c.logger.Debug("tlsRenewal stopped", slog.String("component", string(CLI)))
+			return
+		case <-changed:
+			continue // Certificate change does not impact the current connection; but it may be newer (checked below)
+		case <-timer.C:
+		}
+		if err := r.Reload(); err != nil {
+			c.logger.Warn("tlsRenewal unable to reload certificate", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		}
+		if !r.NotAfter().After(connExpiry) {
+			c.logger.Warn("client certificate due for renewal but no newer certificate available",
+				slog.Time("notAfter", connExpiry),
+				slog.String("component", string(CLI)),
+			)
+			timer.Reset(recheckInterval)
+			continue
+		}
+		c.logger.Info("reconnecting to use renewed client certificate", slog.String("component", string(CLI)))
+		c.gracefulReconnect(ErrCertificateRenewal)
+		return
+	}
+}
+
+// gracefulReconnect sends a DISCONNECT (so the will is not published) and then drops the connection which will trigger
+// an automatic reconnection. Must only be called from a worker (i.e. with c.stop active and AutoReconnect enabled).
+func (c *client) gracefulReconnect(reason error) {
+	// Once the DISCONNECT is sent the broker may close the connection before we call internalConnLost; whichever call
+	// handles the loss will report reason (unless the connection is lost for another reason before it is stored)
+	cause := &reason
+	c.lostCause.Store(cause)
+	defer c.lostCause.CompareAndSwap(cause, (*error)(nil))
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dt := newToken(packets.Disconnect)
+	timeout := c.options.WriteTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+		select {
+		case <-dt.Done():
+		case <-t.C:
+		case <-c.stop:
+			return // connection already being torn down
+		}
+	case <-t.C:
+	case <-c.stop:
+		return
+	}
+	c.internalConnLost(reason)
+}
@@ -0,0 +1,285 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// SPKIPin is the SHA-256 hash of a certificate's DER encoded SubjectPublicKeyInfo (as used in HPKP). Pinning the
+// public key, rather than the certificate, means that the pin survives certificate renewal with the same key.
+type SPKIPin [sha256.Size]byte
+
+// ParseSPKIPin parses a pin in any of the formats "sha256/<base64>", "<base64>" or "<hex>" (the format output by
+// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`).
+func ParseSPKIPin(s string) (SPKIPin, error) {
+	var pin SPKIPin
+	s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != len(pin) {
+		if b, err = hex.DecodeString(s); err != nil || len(b) != len(pin) {
+			return pin, fmt.Errorf("invalid SPKI pin %q", s)
+		}
+	}
+	copy(pin[:], b)
+	return pin, nil
+}
+
+// SPKIPinFromCertificate returns the pin for the public key within cert
+func SPKIPinFromCertificate(cert *x509.Certificate) SPKIPin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// String returns the pin in the form "sha256/<base64>"
+func (p SPKIPin) String() string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// PinSet is a named group of pins that is valid for a period of time. Using multiple sets allows keys to be
+// rotated (e.g. a set for the current key plus one for the key that will replace it).
+type PinSet struct {
+	Name      string
+	Pins      []SPKIPin
+	NotBefore time.Time // Zero means no start time
+	NotAfter  time.Time // Zero means no end time
+}
+
+// active returns true if the set should be used at time t
+func (s PinSet) active(t time.Time) bool {
+	return (s.NotBefore.IsZero() || !t.Before(s.NotBefore)) && (s.NotAfter.IsZero() || !t.After(s.NotAfter))
+}
+
+// OCSPMode determines how stapled OCSP responses are checked by TLSVerifier
+type OCSPMode int
+
+const (
+	OCSPDisabled    OCSPMode = iota // Stapled OCSP responses are ignored
+	OCSPIfStapled                   // A stapled response is checked if the broker provides one
+	OCSPRequireGood                 // The broker must staple a valid response with status good
+)
+
+// ErrNoActivePins is returned (wrapped in a *PinMismatchError) when a TLSVerifier has pin sets but none is currently active
+var ErrNoActivePins = errors.New("no pin set is currently active")
+
+// PinMismatchError is returned when none of the certificates presented by the broker match an active pin
+type PinMismatchError struct {
+	Presented []SPKIPin // Pins of the certificates presented by the broker
+	Err       error     // Optional additional information
+}
+
+func (e *PinMismatchError) Error() string {
+	p := make([]string, len(e.Presented))
+	for i := range e.Presented {
+		p[i] = e.Presented[i].String()
+	}
+	msg := "broker public key does not match any pinned key (presented " + strings.Join(p, ",") + ")"
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PinMismatchError) Unwrap() error { return e.Err }
+
+// CertificateRevokedError is returned when the stapled OCSP response indicates that the broker certificate is revoked
+type CertificateRevokedError struct {
+	SerialNumber     *big.Int
+	RevokedAt        time.Time
+	RevocationReason int // As per RFC 5280 (see constants in golang.org/x/crypto/ocsp)
+}
+
+func (e *CertificateRevokedError) Error() string {
+	return fmt.Sprintf("broker certificate %s revoked at %s (reason %d)", e.SerialNumber, e.RevokedAt.Format(time.RFC3339), e.RevocationReason)
+}
+
+// OCSPError is returned when a stapled OCSP response is required but missing or when the response is invalid
+type OCSPError struct {
+	Err error
+}
+
+func (e *OCSPError) Error() string { return "OCSP verification failed: " + e.Err.Error() }
+
+func (e *OCSPError) Unwrap() error { return e.Err }
+
+// TLSVerifier performs additional checks on the broker certificate once the standard verification (as configured in
+// the tls.Config) has completed. Failures are returned as *PinMismatchError, *CertificateRevokedError or *OCSPError
+// and will be reported via ConnectionNotificationBrokerFailed (use errors.As to check for them).
+//
+// Use ClientOptions.SetTLSVerifier to apply the verifier to a client.
+type TLSVerifier struct {
+	// PinSets holds the acceptable broker public keys; if empty no pinning is performed. The connection is accepted
+	// if any certificate in the verified chain matches a pin in any currently active set. If the chain has not been
+	// verified (e.g. InsecureSkipVerify is set) only the leaf, and the certificates presented after it that each
+	// sign the one before, are considered (so a pinned certificate cannot simply be appended to a forged chain).
+	PinSets []PinSet
+
+	// OCSP determines how stapled OCSP responses are handled. The issuer of the response is taken from the verified
+	// chain; if the chain has not been verified the response cannot be trusted so is ignored (and, with
+	// OCSPRequireGood, the connection is rejected).
+	OCSP OCSPMode
+
+	// Now returns the current time (for testing); time.Now is used if nil
+	Now func() time.Time
+}
+
+// NewPinningVerifier is a convenience function that returns a TLSVerifier with a single pin set built from the
+// provided pins (see ParseSPKIPin for the accepted formats).
+func NewPinningVerifier(pins ...string) (*TLSVerifier, error) {
+	set := PinSet{Name: "default"}
+	for _, s := range pins {
+		p, err := ParseSPKIPin(s)
+		if err != nil {
+			return nil, err
+		}
+		set.Pins = append(set.Pins, p)
+	}
+	return &TLSVerifier{PinSets: []PinSet{set}}, nil
+}
+
+// TLSConfig returns a copy of base (which may be nil) with VerifyConnection set such that the verifier will be
+// called (any existing VerifyConnection function is called first).
+func (v *TLSVerifier) TLSConfig(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if existing := cfg.VerifyConnection; existing != nil {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := existing(cs); err != nil {
+				return err
+			}
+			return v.VerifyConnection(cs)
+		}
+	} else {
+		cfg.VerifyConnection = v.VerifyConnection
+	}
+	return cfg
+}
+
+// VerifyConnection checks the connection state against the pins and OCSP policy. It may be used as
+// tls.Config.VerifyConnection.
+func (v *TLSVerifier) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return &PinMismatchError{Err: errors.New("no certificates presented")}
+	}
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	if err := v.verifyPins(cs, now); err != nil {
+		return err
+	}
+	return v.verifyOCSP(cs, now)
+}
+
+// verifyPins checks that at least one certificate in the chain matches an active pin
+func (v *TLSVerifier) verifyPins(cs tls.ConnectionState, now time.Time) error {
+	if len(v.PinSets) == 0 {
+		return nil
+	}
+	var active []PinSet
+	for _, s := range v.PinSets {
+		if s.active(now) {
+			active = append(active, s)
+		}
+	}
+
+	chain := signedPrefix(cs.PeerCertificates) // The presented chain is untrusted
+	if len(cs.VerifiedChains) > 0 {            // Include the root (which the broker may not send)
+		chain = cs.VerifiedChains[0]
+	}
+	presented := make([]SPKIPin, 0, len(chain))
+	for _, cert := range chain {
+		p := SPKIPinFromCertificate(cert)
+		presented = append(presented, p)
+		for _, s := range active {
+			for _, pin := range s.Pins {
+				if pin == p {
+					return nil
+				}
+			}
+		}
+	}
+	if len(active) == 0 {
+		return &PinMismatchError{Presented: presented, Err: ErrNoActivePins}
+	}
+	return &PinMismatchError{Presented: presented}
+}
+
+// signedPrefix returns the leading certificates in chain where each is signed by the one that follows it
+func signedPrefix(chain []*x509.Certificate) []*x509.Certificate {
+	for i := 1; i < len(chain); i++ {
+		if chain[i-1].CheckSignatureFrom(chain[i]) != nil {
+			return chain[:i]
+		}
+	}
+	return chain
+}
+
+// verifyOCSP checks any stapled OCSP response in line with the OCSP policy
+func (v *TLSVerifier) verifyOCSP(cs tls.ConnectionState, now time.Time) error {
+	if v.OCSP == OCSPDisabled {
+		return nil
+	}
+	if len(cs.OCSPResponse) == 0 {
+		if v.OCSP == OCSPRequireGood {
+			return &OCSPError{Err: errors.New("broker did not staple an OCSP response")}
+		}
+		return nil
+	}
+
+	if len(cs.VerifiedChains) == 0 { // An issuer presented by the broker could vouch for its own certificate
+		if v.OCSP == OCSPRequireGood {
+			return &OCSPError{Err: errors.New("stapled OCSP response cannot be checked without a verified chain")}
+		}
+		return nil
+	}
+	leaf := cs.PeerCertificates[0]
+	if len(cs.VerifiedChains[0]) < 2 {
+		return &OCSPError{Err: errors.New("unable to determine issuer of broker certificate")}
+	}
+	issuer := cs.VerifiedChains[0][1]
+
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return &OCSPError{Err: err}
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return &OCSPError{Err: fmt.Errorf("stapled OCSP response expired at %s", resp.NextUpdate.Format(time.RFC3339))}
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return &CertificateRevokedError{SerialNumber: resp.SerialNumber, RevokedAt: resp.RevokedAt, RevocationReason: resp.RevocationReason}
+	default:
+		if v.OCSP == OCSPRequireGood {
+			return &OCSPError{Err: errors.New("stapled OCSP response status is unknown")}
+		}
+		return nil
+	}
+}
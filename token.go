@@ -19,6 +19,7 @@ package mqtt
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
@@ -165,6 +166,7 @@ func (c *ConnectToken) SessionPresent() bool {
 type PublishToken struct {
 	baseToken
 	messageID uint16
+	pooled    *PooledPayload // set if the payload passed to Publish was a *PooledPayload
 }
 
 // MessageID returns the MQTT message ID that was assigned to the
@@ -173,6 +175,56 @@ func (p *PublishToken) MessageID() uint16 {
 	return p.messageID
 }
 
+// ReleasePayload returns the buffer holding the published payload to the pool used by the packets package, so
+// that it may be reused by a subsequent Publish or by incoming messages. Only payloads passed to Publish as a
+// *PooledPayload are released; for any other payload (including one replaced by outbound middleware) this does
+// nothing.
+//
+// The buffer is only released once the publish has completed successfully (until then it may be resent); false
+// is returned if the token is incomplete, failed, the payload was not pooled or has already been released.
+func (p *PublishToken) ReleasePayload() bool {
+	select {
+	case <-p.complete:
+	default:
+		return false
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.err != nil || p.pooled == nil {
+		return false
+	}
+	return p.pooled.release()
+}
+
+// PooledPayload is a payload buffer taken from the pool used by the packets package (see NewPooledPayload).
+// Publishing a *PooledPayload allows the buffer to be returned to the pool, once the publish has completed, with
+// PublishToken.ReleasePayload. A PooledPayload must not be passed to Publish more than once.
+type PooledPayload struct {
+	b        []byte
+	released atomic.Bool
+}
+
+// NewPooledPayload takes a buffer of length n from the pool; its contents are undefined so should be filled
+// (via Bytes) before it is published
+func NewPooledPayload(n int) *PooledPayload {
+	return &PooledPayload{b: packets.GetBuffer(n)}
+}
+
+// Bytes returns the buffer (which must not be used after the payload has been released)
+func (p *PooledPayload) Bytes() []byte {
+	return p.b
+}
+
+// release returns the buffer to the pool (once only)
+func (p *PooledPayload) release() bool {
+	if !p.released.CompareAndSwap(false, true) {
+		return false
+	}
+	packets.PutBuffer(p.b)
+	p.b = nil
+	return true
+}
+
 // SubscribeToken is an extension of Token containing the extra fields
 // required to provide information about calls to Subscribe()
 type SubscribeToken struct {
@@ -180,11 +232,16 @@ type SubscribeToken struct {
 	subs      []string
 	subResult map[string]byte
 	messageID uint16
+
+	// onSuback, if not nil, is called when the SUBACK has been received (prior to the token completing). Any
+	// error returned will be set on the token.
+	onSuback func(result map[string]byte) error
 }
 
 // Result returns a map of topics that were subscribed to along with
 // the matching return code from the broker. This is either the Qos
-// value of the subscription or an error code.
+// value of the subscription or an error code. The map is keyed by the
+// filters as sent to the broker (including any shared subscription prefix).
 func (s *SubscribeToken) Result() map[string]byte {
 	s.m.RLock()
 	defer s.m.RUnlock()
@@ -36,6 +36,10 @@ var ErrInvalidTopicEmptyString = errors.New("invalid Topic; empty string")
 // the last
 var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard must be last level")
 
+// ErrInvalidSharedSubscription is the error returned when a shared subscription
+// ($share/{ShareName}/{filter} or $queue/{filter}) is malformed
+var ErrInvalidSharedSubscription = errors.New("invalid Topic; malformed shared subscription")
+
 // Topic Names and Topic Filters
 // The MQTT v3.1.1 spec clarifies a number of ambiguities with regard
 // to the validity of Topic strings.
@@ -53,15 +57,51 @@ var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard
 // - A TopicFilter with a # will match the absence of a level
 //     Example:  a subscription to "foo/#" will match messages published to "foo".
 
-func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
+// Shared Subscriptions
+// Topic filters in the form $share/{ShareName}/{filter} (MQTT v5, also supported by many v3.1.1 brokers) and
+// $queue/{filter} (EMQX/HiveMQ) request that messages be shared between the subscribing clients. The broker
+// publishes messages using the topic name so the prefix must be removed when matching. The ShareName must be at
+// least one character long and must not include "/", "+" or "#".
+
+// sharedSubscription splits a shared subscription filter into its group and topic filter. ok is false if the
+// filter does not begin with $share/ or $queue/ (for $queue the group is "").
+func sharedSubscription(filter string) (group string, topicFilter string, ok bool) {
+	if rest, found := strings.CutPrefix(filter, "$share/"); found {
+		group, topicFilter, _ = strings.Cut(rest, "/")
+		return group, topicFilter, true
+	}
+	if rest, found := strings.CutPrefix(filter, "$queue/"); found {
+		return "", rest, true
+	}
+	return "", filter, false
+}
+
+// stripSharedPrefix returns the topic filter without any shared subscription prefix
+func stripSharedPrefix(filter string) string {
+	_, topicFilter, _ := sharedSubscription(filter)
+	return topicFilter
+}
+
+// TopicMatches reports whether topic matches filter (which may contain wildcards and may be a shared
+// subscription). This uses the same rules as the router so is useful when implementing per-topic policies.
+func TopicMatches(filter, topic string) bool {
+	return routeIncludesTopic(filter, topic)
+}
+
+// validateSubscribeMap validates subs, translating any patterns using parse
+func validateSubscribeMap(subs map[string]byte, parse func(string) (string, []routeParam, error)) ([]string, []byte, error) {
 	if len(subs) == 0 {
 		return nil, nil, errors.New("invalid subscription; subscribe map must not be empty")
 	}
 
 	var topics []string
 	var qoss []byte
-	for topic, qos := range subs {
-		if err := validateTopicAndQos(topic, qos); err != nil {
+	for pattern, qos := range subs {
+		topic, _, err := parse(pattern)
+		if err == nil {
+			err = validateTopicAndQos(topic, qos)
+		}
+		if err != nil {
 			return nil, nil, err
 		}
 		topics = append(topics, topic)
@@ -76,6 +116,16 @@ func validateTopicAndQos(topic string, qos byte) error {
 		return ErrInvalidTopicEmptyString
 	}
 
+	if group, topicFilter, ok := sharedSubscription(topic); ok {
+		if strings.HasPrefix(topic, "$share/") && (group == "" || strings.ContainsAny(group, "+#")) {
+			return ErrInvalidSharedSubscription
+		}
+		if len(topicFilter) == 0 {
+			return ErrInvalidSharedSubscription
+		}
+		topic = topicFilter
+	}
+
 	levels := strings.Split(topic, "/")
 	for i, level := range levels {
 		if level == "#" && i != len(levels)-1 {
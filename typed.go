@@ -0,0 +1,151 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// Codec converts between Go values and message payloads. It is used by PublishTyped and SubscribeTyped.
+// JSONCodec is provided here; codecs for protobuf, CBOR and MessagePack are in the codec package (which is a
+// separate module, so that users of this package do not depend upon the libraries they require).
+type Codec interface {
+	// Name identifies the codec in error messages (e.g. "json")
+	Name() string
+	// Marshal encodes v
+	Marshal(v any) ([]byte, error)
+	// Unmarshal decodes data into v (which will be a pointer)
+	Unmarshal(data []byte, v any) error
+}
+
+// DecodeErrorHandler is invoked when SubscribeTyped receives a message that cannot be decoded
+type DecodeErrorHandler func(client Client, msg Message, err error)
+
+// DecodeError is passed to the DecodeErrorHandler when a payload cannot be decoded
+type DecodeError struct {
+	Topic string
+	Codec string // Name of the codec used
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode payload on topic %q (codec %s): %s", e.Topic, e.Codec, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// JSONCodec encodes payloads using encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                       { return "json" }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// SetPayloadCodec sets the codec used by PublishTyped and SubscribeTyped (JSONCodec is used by default)
+func (o *ClientOptions) SetPayloadCodec(c Codec) *ClientOptions {
+	o.PayloadCodec = c
+	return o
+}
+
+// SetTopicCodec sets the codec used by PublishTyped and SubscribeTyped for topics matching filter (overriding
+// that set with SetPayloadCodec). Where multiple filters match the topic the first added takes precedence.
+func (o *ClientOptions) SetTopicCodec(filter string, c Codec) *ClientOptions {
+	o.topicCodecs = append(o.topicCodecs, topicCodec{filter: filter, codec: c})
+	return o
+}
+
+// SetDecodeErrorHandler sets the handler called when SubscribeTyped cannot decode a message (the error will be a
+// *DecodeError). If no handler is set decode errors are logged.
+func (o *ClientOptions) SetDecodeErrorHandler(h DecodeErrorHandler) *ClientOptions {
+	o.OnDecodeError = h
+	return o
+}
+
+// topicCodec associates a topic filter with a codec
+type topicCodec struct {
+	filter string
+	codec  Codec
+}
+
+// codecFor returns the codec to use for the specified topic (or filter when subscribing)
+func (o *ClientOptions) codecFor(topic string) Codec {
+	for _, tc := range o.topicCodecs {
+		if tc.filter == topic || routeIncludesTopic(tc.filter, topic) {
+			return tc.codec
+		}
+	}
+	if o.PayloadCodec != nil {
+		return o.PayloadCodec
+	}
+	return JSONCodec{}
+}
+
+// typedOptions returns the options in use by c
+func typedOptions(c Client) *ClientOptions {
+	if cl, ok := c.(*client); ok {
+		return &cl.options
+	}
+	r := c.OptionsReader()
+	return r.options
+}
+
+// PublishTyped encodes v using the codec configured for topic (see SetPayloadCodec/SetTopicCodec) and
+// publishes it. If v cannot be encoded the returned token will hold the error.
+func PublishTyped[T any](c Client, topic string, qos byte, retained bool, v T) Token {
+	codec := typedOptions(c).codecFor(topic)
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return ErrorToken(fmt.Errorf("failed to encode payload (codec %s): %w", codec.Name(), err))
+	}
+	return c.Publish(topic, qos, retained, payload)
+}
+
+// SubscribeTyped subscribes to filter and decodes each message received into a T (using the codec configured for
+// the message topic) before calling handler. Messages that cannot be decoded are passed to the DecodeErrorHandler
+// (see ClientOptions.SetDecodeErrorHandler) and are acknowledged as normal.
+func SubscribeTyped[T any](c Client, filter string, qos byte, handler func(Client, T, Message)) Token {
+	return c.Subscribe(filter, qos, TypedHandler(c, handler))
+}
+
+// TypedHandler returns a MessageHandler that decodes messages into a T before calling handler (see
+// SubscribeTyped). This can be used with AddRoute or SubscribeMultiple.
+func TypedHandler[T any](c Client, handler func(Client, T, Message)) MessageHandler {
+	o := typedOptions(c)
+	return func(mc Client, msg Message) {
+		codec := o.codecFor(msg.Topic())
+		var v T
+		if err := safeUnmarshal(codec, msg.Payload(), &v); err != nil {
+			err = &DecodeError{Topic: msg.Topic(), Codec: codec.Name(), Err: err}
+			if o.OnDecodeError != nil {
+				o.OnDecodeError(mc, msg, err)
+			} else if cl, ok := mc.(*client); ok {
+				cl.logger.Warn("failed to decode message", slog.String("topic", msg.Topic()), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			}
+			return
+		}
+		handler(mc, v, msg)
+	}
+}
+
+// safeUnmarshal calls codec.Unmarshal converting any panic into an error
+func safeUnmarshal(codec Codec, data []byte, v any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("codec panic: %v", r)
+		}
+	}()
+	return codec.Unmarshal(data, v)
+}
@@ -0,0 +1,197 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT broker used by unit tests. It accepts any connection (reporting that no session is
+// present), acknowledges subscriptions and forwards publications (at QoS 0) to matching subscribers.
+type testBroker struct {
+	t    *testing.T
+	l    net.Listener
+	addr string
+
+	mu    sync.Mutex
+	conns map[net.Conn]*testBrokerConn
+
+	// SubackCode (if not nil) is called to determine the return code for each subscription
+	SubackCode func(filter string, qos byte) byte
+
+	subscribes chan *packets.SubscribePacket // every SUBSCRIBE received (buffered; extras are dropped)
+}
+
+// testBrokerConn holds the state of a single client connection
+type testBrokerConn struct {
+	wMu     sync.Mutex          // Serialises writes
+	filters map[string]struct{} // Subscribed filters (protected by testBroker.mu)
+}
+
+// write sends p to the client
+func (c *testBrokerConn) write(conn net.Conn, p packets.ControlPacket) {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	_ = p.Write(conn)
+}
+
+// startTestBroker starts a testBroker (which will be closed when the test completes)
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:          t,
+		l:          l,
+		addr:       "tcp://" + l.Addr().String(),
+		conns:      make(map[net.Conn]*testBrokerConn),
+		subscribes: make(chan *packets.SubscribePacket, 100),
+	}
+	t.Cleanup(b.close)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.handle(conn)
+		}
+	}()
+	return b
+}
+
+// close stops the broker and drops all connections
+func (b *testBroker) close() {
+	b.l.Close()
+	b.dropConnections()
+}
+
+// dropConnections closes all client connections (simulating a network failure)
+func (b *testBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+// sendRaw writes b to every client connection (e.g. to simulate a malformed packet)
+func (b *testBroker) sendRaw(raw []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn, bc := range b.conns {
+		bc.wMu.Lock()
+		_, _ = conn.Write(raw)
+		bc.wMu.Unlock()
+	}
+}
+
+// handle processes packets from a single client
+func (b *testBroker) handle(conn net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	bc := &testBrokerConn{filters: make(map[string]struct{})}
+	write := func(p packets.ControlPacket) { bc.write(conn, p) }
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.conns[conn] = bc
+			b.mu.Unlock()
+			write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			select {
+			case b.subscribes <- p:
+			default:
+			}
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			b.mu.Lock()
+			for i, f := range p.Topics {
+				code := p.Qoss[i]
+				if b.SubackCode != nil {
+					code = b.SubackCode(f, p.Qoss[i])
+				}
+				if code != subackFailure {
+					bc.filters[f] = struct{}{}
+				}
+				ack.ReturnCodes = append(ack.ReturnCodes, code)
+			}
+			b.mu.Unlock()
+			write(ack)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, f := range p.Topics {
+				delete(bc.filters, f)
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			write(ack)
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				write(rec)
+			}
+			b.forward(p)
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			write(comp)
+		case *packets.PingreqPacket:
+			write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// forward sends p (at QoS 0) to every connection with a matching subscription
+func (b *testBroker) forward(p *packets.PublishPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn, bc := range b.conns {
+		for f := range bc.filters {
+			if routeIncludesTopic(f, p.TopicName) {
+				fwd := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				fwd.TopicName = p.TopicName
+				fwd.Payload = p.Payload
+				fwd.Retain = p.Retain
+				bc.write(conn, fwd)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func newTestPublish(topic, payload string) *packets.PublishPacket {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Payload = []byte(payload)
+	return pub
+}
+
+func Test_DispatchWorkers_Ordering(t *testing.T) {
+	const topics, perTopic = 8, 50
+
+	var mu sync.Mutex
+	received := make(map[string][]int)
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(topics * perTopic)
+	cb := func(_ Client, m Message) {
+		defer wg.Done()
+		n := running.Add(1)
+		for {
+			if prev := maxRunning.Load(); n <= prev || maxRunning.CompareAndSwap(prev, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Microsecond)
+		running.Add(-1)
+		i, _ := strconv.Atoi(string(m.Payload()))
+		mu.Lock()
+		received[m.Topic()] = append(received[m.Topic()], i)
+		mu.Unlock()
+	}
+
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	msgs := make(chan *packets.PublishPacket)
+	c := &client{oboundP: make(chan *PacketAndToken, 100), options: ClientOptions{DispatchWorkers: 4}}
+	ackOut := router.matchAndDispatch(msgs, false, c)
+
+	for i := 0; i < perTopic; i++ {
+		for j := 0; j < topics; j++ {
+			msgs <- newTestPublish(fmt.Sprintf("t%d", j), strconv.Itoa(i))
+		}
+	}
+	wg.Wait()
+	close(msgs)
+	select {
+	case <-ackOut:
+	case <-time.After(time.Second):
+		t.Fatalf("matchAndDispatch should have exited")
+	}
+
+	for topic, seq := range received {
+		for i, v := range seq {
+			if v != i {
+				t.Fatalf("messages on %s out of order: %v", topic, seq)
+			}
+		}
+	}
+	if maxRunning.Load() < 2 {
+		t.Fatalf("expected messages to be handled in parallel")
+	}
+}
+
+func Test_DispatchWorkers_Backpressure(t *testing.T) {
+	release := make(chan struct{})
+	cb := func(Client, Message) { <-release }
+
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	msgs := make(chan *packets.PublishPacket)
+	c := &client{oboundP: make(chan *PacketAndToken, 100), options: ClientOptions{
+		DispatchWorkers:   1,
+		DispatchQueueSize: 1,
+		DispatchKeyFunc:   func(Message) string { return "" },
+	}}
+	ackOut := router.matchAndDispatch(msgs, false, c)
+
+	// One message is being handled, one is queued and one is waiting to be queued; the next must block
+	for i := 0; i < 3; i++ {
+		msgs <- newTestPublish("a", "")
+	}
+	select {
+	case msgs <- newTestPublish("a", ""):
+		t.Fatalf("expected send to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	close(msgs)
+	select {
+	case <-ackOut:
+	case <-time.After(time.Second):
+		t.Fatalf("matchAndDispatch should have exited")
+	}
+}
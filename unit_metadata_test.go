@@ -0,0 +1,116 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_PublishWireSize(t *testing.T) {
+	for _, size := range []int{0, 10, 200, 20000} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		pub.Qos = 1
+		pub.MessageID = 1
+		pub.Payload = make([]byte, size)
+		var sb strings.Builder
+		if err := pub.Write(&sb); err != nil {
+			t.Fatal(err)
+		}
+		if got := publishWireSize(pub); got != sb.Len() {
+			t.Errorf("payload %d: expected %d, got %d", size, sb.Len(), got)
+		}
+	}
+}
+
+func Test_MessageMetadata(t *testing.T) {
+	b := startTestBroker(t)
+
+	received := make(chan *MessageMetadata, 1)
+	o := NewClientOptions().AddBroker(b.addr).SetAutoResubscribe(true).SetRoutePatterns(true)
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if token := c.Subscribe("a/{id}", 1, func(_ Client, m Message) { received <- Metadata(m) }); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+
+	check := func(topic, route string, generation uint64) {
+		t.Helper()
+		start := time.Now()
+		c.Publish(topic, 1, false, "0123456789")
+		select {
+		case md := <-received:
+			if md == nil || md.Route != route || md.Generation != generation || md.Broker == nil || md.Broker.Host != b.addr[len("tcp://"):] {
+				t.Fatalf("unexpected metadata %+v", md)
+			}
+			if md.WireSize != 1+1+2+len(topic)+10 || md.ReceivedAt.Before(start) { // The test broker forwards at QoS 0
+				t.Fatalf("unexpected metadata %+v", md)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message not received")
+		}
+	}
+	check("a/b", "a/+", 1)
+
+	for len(b.subscribes) > 0 {
+		<-b.subscribes
+	}
+	b.dropConnections()
+	select {
+	case <-b.subscribes: // resubscribed
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for resubscribe")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	sl := c.(SubscriptionLister)
+	for len(sl.Subscriptions()) == 0 || sl.Subscriptions()[0].Pending || !c.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for reconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check("a/c", "a/+", 2)
+}
+
+func Test_MessageMetadataDelivery(t *testing.T) {
+	var deliveries []uint64
+	record := func(_ Client, m Message) { deliveries = append(deliveries, Metadata(m).Delivery) }
+	router := newRouter(noopSLogger)
+	router.addRoute("a/#", record)
+	router.addRoute("a/b", record)
+
+	msgs := make(chan *packets.PublishPacket)
+	done := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+	for range 2 {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a/b"
+		msgs <- pub
+	}
+	close(msgs)
+	for range done {
+	}
+	// Both routes see the same value for a message, but each message has a different value
+	if len(deliveries) != 4 || deliveries[0] == 0 || deliveries[0] != deliveries[1] || deliveries[2] != deliveries[3] ||
+		deliveries[0] == deliveries[2] {
+		t.Fatalf("unexpected deliveries %v", deliveries)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_Middleware(t *testing.T) {
+	b := startTestBroker(t)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(s string) {
+		mu.Lock()
+		calls = append(calls, s)
+		mu.Unlock()
+	}
+	inbound := func(name string) func(MessageHandler) MessageHandler {
+		return func(next MessageHandler) MessageHandler {
+			return func(c Client, m Message) {
+				record(name + " in")
+				next(c, m)
+				record(name + " out")
+			}
+		}
+	}
+	outbound := func(name string) func(PublishFunc) PublishFunc {
+		return func(next PublishFunc) PublishFunc {
+			return func(topic string, qos byte, retained bool, payload interface{}) Token {
+				record(name)
+				return next(topic, qos, retained, payload.(string)+"+"+name)
+			}
+		}
+	}
+	blockTopic := func(next PublishFunc) PublishFunc {
+		return func(topic string, qos byte, retained bool, payload interface{}) Token {
+			if topic == "blocked" {
+				t := newToken(packets.Publish).(*PublishToken)
+				t.setError(ErrNotConnected)
+				return t
+			}
+			return next(topic, qos, retained, payload)
+		}
+	}
+
+	o := NewClientOptions().AddBroker(b.addr).
+		UseInbound(inbound("a"), inbound("b")).
+		UseInbound(inbound("c")).
+		UseOutbound(outbound("x"), blockTopic).
+		UseOutbound(outbound("y"))
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	received := make(chan string, 1)
+	if token := c.Subscribe("test", 1, func(_ Client, m Message) {
+		record("handler")
+		received <- string(m.Payload())
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+
+	if token := c.Publish("test", 1, false, "msg"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	select {
+	case p := <-received:
+		if p != "msg+x+y" {
+			t.Fatalf("unexpected payload %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+	if token := c.Publish("blocked", 1, false, "msg"); token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected middleware error, got %v", token.Error())
+	}
+
+	time.Sleep(10 * time.Millisecond) // Allow the inbound chain to complete
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"x", "y", "a in", "b in", "c in", "handler", "c out", "b out", "a out", "x"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected %v, got %v", expected, calls)
+	}
+}
+
+func Test_MiddlewareBuiltOncePerHandler(t *testing.T) {
+	var built, calls atomic.Int32
+	mw := func(next MessageHandler) MessageHandler {
+		built.Add(1)
+		return func(c Client, m Message) {
+			calls.Add(1)
+			next(c, m)
+		}
+	}
+	router := newRouter(noopSLogger)
+	router.addRoute("a", func(Client, Message) {})
+	router.setMiddleware(func(h MessageHandler) MessageHandler { return mw(h) })
+	router.addRoute("b", func(Client, Message) {})
+	router.setDefaultHandler(func(Client, Message) {})
+	if built.Load() != 3 {
+		t.Fatalf("expected middleware to be built for 3 handlers, got %d", built.Load())
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	done := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+	for _, topic := range []string{"a", "b", "c", "a", "b", "c"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		msgs <- pub
+	}
+	close(msgs)
+	for range done {
+	}
+	if built.Load() != 3 || calls.Load() != 6 {
+		t.Fatalf("expected 3 builds and 6 calls, got %d and %d", built.Load(), calls.Load())
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_PooledPayloads(t *testing.T) {
+	b := startTestBroker(t)
+
+	received := make(chan []byte, 1)
+	o := NewClientOptions().AddBroker(b.addr).SetPooledPayloads(true)
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if token := c.Subscribe("a/b", 1, func(_ Client, m Message) {
+		p := bytes.Clone(m.Payload())
+		if !ReleasePayload(m) || m.Payload() != nil || ReleasePayload(m) {
+			t.Errorf("payload not released as expected")
+		}
+		received <- p
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+
+	payload := NewPooledPayload(100)
+	copy(payload.Bytes(), bytes.Repeat([]byte("x"), 100))
+	token := c.Publish("a/b", 1, false, payload).(*PublishToken)
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if !token.ReleasePayload() || token.ReleasePayload() {
+		t.Fatalf("publish payload not released as expected")
+	}
+	select {
+	case p := <-received:
+		if !bytes.Equal(p, bytes.Repeat([]byte("x"), 100)) {
+			t.Fatalf("unexpected payload %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+}
+
+func Test_ReleasePayloadNotPooled(t *testing.T) {
+	m := &message{payload: []byte("abc")}
+	if ReleasePayload(m) || m.Payload() == nil {
+		t.Fatalf("payload of unpooled message should not be released")
+	}
+	if ReleasePayload(&routedMessage{Message: &message{payload: make([]byte, 64), pooled: true}}) != true {
+		t.Fatalf("wrapped message payload not released")
+	}
+
+	token := newToken(packets.Publish).(*PublishToken)
+	token.pooled = NewPooledPayload(64)
+	if token.ReleasePayload() {
+		t.Fatalf("payload released before token complete")
+	}
+	token.setError(ErrNotConnected)
+	if token.ReleasePayload() {
+		t.Fatalf("payload released after failure")
+	}
+
+	// Only payloads published as a *PooledPayload are released
+	b := startTestBroker(t)
+	c := NewClient(NewClientOptions().AddBroker(b.addr))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	pt := c.Publish("a/b", 1, false, packets.GetBuffer(64)).(*PublishToken)
+	if pt.Wait() && pt.Error() != nil {
+		t.Fatalf("unexpected error: %v", pt.Error())
+	}
+	if pt.ReleasePayload() {
+		t.Fatalf("[]byte payload released")
+	}
+}
+
+func Test_ReleasePayloadOnce(t *testing.T) {
+	m := &message{payload: packets.GetBuffer(64), pooled: true, handlers: 1}
+	var wg sync.WaitGroup
+	var released atomic.Int32
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ReleasePayload(m) {
+				released.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if released.Load() != 1 {
+		t.Fatalf("payload released %d times", released.Load())
+	}
+
+	m = &message{payload: packets.GetBuffer(64), pooled: true, handlers: 2}
+	if ReleasePayload(m) || m.Payload() == nil {
+		t.Fatalf("payload of message passed to multiple handlers should not be released")
+	}
+}
+
+func Test_ReleasePayloadMultipleRoutes(t *testing.T) {
+	released := make(chan bool, 2)
+	h := func(_ Client, m Message) { released <- ReleasePayload(m) }
+	router := newRouter(noopSLogger)
+	router.addRoute("a/#", h)
+	router.addRoute("a/b", h)
+
+	msgs := make(chan *packets.PublishPacket)
+	c := &client{oboundP: make(chan *PacketAndToken, 100)}
+	c.options.PooledPayloads = true
+	done := router.matchAndDispatch(msgs, false, c)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Payload = "a/b", packets.GetBuffer(64)
+	msgs <- pub
+	for range 2 {
+		select {
+		case r := <-released:
+			if r {
+				t.Fatalf("payload released although two handlers were called")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler not called")
+		}
+	}
+	close(msgs)
+	for range done {
+	}
+}
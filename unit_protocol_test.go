@@ -0,0 +1,88 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_InboundProtocolError(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(o *ClientOptions)
+		raw  []byte
+		err  error
+	}{
+		{"qos 3", func(o *ClientOptions) { o.SetStrictProtocol(true) }, []byte{0x36, 5, 0, 1, 'a', 0, 1}, packets.ErrInvalidQos},
+		{"invalid topic", func(o *ClientOptions) { o.SetStrictProtocol(true) }, []byte{0x30, 4, 0, 2, 0xc3, 0x28}, packets.ErrInvalidTopicName},
+		{"too large", func(o *ClientOptions) { o.SetMaxInboundPacketSize(16) }, []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, packets.ErrPacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := startTestBroker(t)
+			lost := make(chan error, 1)
+			o := NewClientOptions().AddBroker(b.addr).SetAutoReconnect(false).
+				SetConnectionLostHandler(func(_ Client, err error) { lost <- err })
+			tt.opts(o)
+			c := NewClient(o)
+			if token := c.Connect(); token.Wait() && token.Error() != nil {
+				t.Fatalf("unexpected error: %v", token.Error())
+			}
+			defer c.Disconnect(0)
+
+			b.sendRaw(tt.raw)
+			select {
+			case err := <-lost:
+				var pe *packets.ProtocolError
+				if !errors.As(err, &pe) || !errors.Is(err, tt.err) {
+					t.Fatalf("expected ProtocolError wrapping %v, got %v", tt.err, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("connection not closed")
+			}
+			if c.IsConnectionOpen() {
+				t.Fatalf("connection should be closed")
+			}
+		})
+	}
+}
+
+func Test_InboundProtocolNotStrict(t *testing.T) {
+	if NewClientOptions().StrictProtocol {
+		t.Fatalf("strict protocol validation should be opt-in")
+	}
+	b := startTestBroker(t)
+	received := make(chan Message, 1)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetDefaultPublishHandler(func(_ Client, m Message) { received <- m })
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	b.sendRaw([]byte{0x38, 4, 0, 1, 'a', 'x'}) // DUP set on a QoS 0 message
+	select {
+	case m := <-received:
+		if m.Topic() != "a" || string(m.Payload()) != "x" {
+			t.Fatalf("unexpected message %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+}
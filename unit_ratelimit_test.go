@@ -0,0 +1,149 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter_Reject(t *testing.T) {
+	o := NewClientOptions().
+		SetRateLimit(RateLimit{Messages: 10, MessageBurst: 2}).
+		SetTopicRateLimit("bulk/#", RateLimit{Bytes: 100}).
+		SetRateLimitMode(RateLimitReject)
+	l := newRateLimiter(o)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i, expected := range []error{nil, nil, ErrRateLimited} {
+		if err := l.wait("a", 10, 0, nil); !errors.Is(err, expected) {
+			t.Fatalf("message %d: expected %v, got %v", i, expected, err)
+		}
+	}
+	now = now.Add(100 * time.Millisecond)
+	if err := l.wait("a", 10, 0, nil); err != nil {
+		t.Fatalf("expected message to be allowed after refill, got %v", err)
+	}
+
+	// A message larger than the byte bucket is permitted when the bucket is full
+	now = now.Add(time.Second)
+	if err := l.wait("bulk/1", 150, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(500 * time.Millisecond) // 50 bytes available
+	if err := l.wait("bulk/2", 60, 0, nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if err := l.wait("other", 60, 0, nil); err != nil {
+		t.Fatalf("expected topic limit not to apply, got %v", err)
+	}
+
+	stats := l.stats()
+	if len(stats) != 2 || stats[0].Filter != "" || stats[1].Filter != "bulk/#" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats[0].Allowed != 5 || stats[0].Rejected != 1 || !math.IsInf(stats[0].ByteTokens, 1) {
+		t.Fatalf("unexpected global stats %+v", stats[0])
+	}
+	if stats[1].Allowed != 1 || stats[1].Rejected != 1 || stats[1].ByteTokens != 50 {
+		t.Fatalf("unexpected topic stats %+v", stats[1])
+	}
+}
+
+func Test_RateLimiter_Block(t *testing.T) {
+	l := newRateLimiter(NewClientOptions().SetRateLimit(RateLimit{Messages: 100, MessageBurst: 1}))
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.wait("a", 0, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 45*time.Millisecond {
+		t.Fatalf("expected publishing to be delayed, took %v", d)
+	}
+	if s := l.stats()[0]; s.Allowed != 6 || s.Delayed != 5 || s.Waited == 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if newRateLimiter(NewClientOptions()) != nil {
+		t.Fatalf("expected no limiter without limits")
+	}
+}
+
+func Test_RateLimiter_BlockStopped(t *testing.T) {
+	l := newRateLimiter(NewClientOptions().SetRateLimit(RateLimit{Messages: 0.1, MessageBurst: 1}))
+	stop := make(chan struct{})
+	if err := l.wait("a", 0, 0, stop); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	start := time.Now()
+	if err := l.wait("a", 0, 0, stop); !errors.Is(err, ErrRateLimitStopped) {
+		t.Fatalf("expected ErrRateLimitStopped, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected wait to end when stopped, took %v", d)
+	}
+	// The token taken by the abandoned message is refunded
+	if s := l.stats()[0]; s.Allowed != 1 || s.Abandoned != 1 || s.Waited != 0 || s.MessageTokens > 0.01 || s.MessageTokens < -0.01 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func Test_RateLimiter_BlockTimeout(t *testing.T) {
+	l := newRateLimiter(NewClientOptions().SetRateLimit(RateLimit{Messages: 0.1, MessageBurst: 1}))
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	if err := l.wait("a", 0, time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := l.wait("a", 0, time.Second, nil); !errors.Is(err, ErrRateLimitTimeout) { // would wait 10s
+		t.Fatalf("expected ErrRateLimitTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected immediate failure, took %v", d)
+	}
+	if s := l.stats()[0]; s.Allowed != 1 || s.Abandoned != 1 || s.MessageTokens != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	now = now.Add(10 * time.Second) // The bucket is full again as the abandoned message was refunded
+	if err := l.wait("a", 0, time.Second, nil); err != nil {
+		t.Fatalf("expected message to be sent without delay: %v", err)
+	}
+}
+
+func Test_RateLimit_Publish(t *testing.T) {
+	b := startTestBroker(t)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetRateLimit(RateLimit{Messages: 1}).
+		SetRateLimitMode(RateLimitReject)
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if token := c.Publish("a", 1, false, "x"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if token := c.Publish("a", 1, false, "x"); token.Wait() && !errors.Is(token.Error(), ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", token.Error())
+	}
+	if s := c.(RateLimitReporter).RateLimitStats(); len(s) != 1 || s[0].Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
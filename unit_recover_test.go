@@ -0,0 +1,194 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_HandlerFailurePolicy(t *testing.T) {
+	b := startTestBroker(t)
+
+	panics := make(chan *HandlerPanicError, 10)
+	policy := &HandlerFailurePolicy{
+		OnPanic:       func(_ Client, _ Message, err *HandlerPanicError) { panics <- err },
+		MaxRetries:    2,
+		RetryInterval: time.Millisecond,
+		DeadLetter:    DeadLetterTopic{Prefix: "dead/"},
+	}
+	o := NewClientOptions().AddBroker(b.addr).SetHandlerFailurePolicy(policy)
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	// Succeeds on the final retry
+	var calls atomic.Int32
+	done := make(chan struct{})
+	if token := c.Subscribe("flaky", 1, func(Client, Message) {
+		if calls.Add(1) < 3 {
+			panic(errors.New("not yet"))
+		}
+		close(done)
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	// Always fails
+	if token := c.Subscribe("broken", 1, func(Client, Message) { panic("broken") }); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	deadLetters := make(chan Message, 1)
+	if token := c.Subscribe("dead/#", 1, func(_ Client, m Message) { deadLetters <- m }); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+
+	c.Publish("flaky", 1, false, "x")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("handler did not succeed")
+	}
+	for i := 1; i <= 2; i++ {
+		err := <-panics
+		if err.Attempt != i || err.Topic != "flaky" || err.Unwrap() == nil || !bytes.Contains(err.Stack, []byte("panic")) {
+			t.Fatalf("unexpected panic error %+v", err)
+		}
+	}
+
+	c.Publish("broken", 1, false, "payload")
+	select {
+	case m := <-deadLetters:
+		if m.Topic() != "dead/broken" || string(m.Payload()) != "payload" {
+			t.Fatalf("unexpected dead letter %s: %s", m.Topic(), m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not dead lettered")
+	}
+	if len(panics) != 3 {
+		t.Fatalf("expected 3 panics, got %d", len(panics))
+	}
+}
+
+func Test_DeadLetterStore(t *testing.T) {
+	s := NewMemoryStore()
+	s.Open()
+	d := &DeadLetterStore{Store: s}
+	m := &message{topic: "a", qos: 1, payload: []byte("p")}
+	if err := d.DeadLetter(nil, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := s.All()
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %v", keys)
+	}
+	pub, ok := s.Get(keys[0]).(*packets.PublishPacket)
+	if !ok || pub.TopicName != "a" || pub.Qos != 1 || string(pub.Payload) != "p" {
+		t.Fatalf("unexpected stored packet %v", s.Get(keys[0]))
+	}
+}
+
+func Test_HandlerFailurePolicyAutoAckDisabled(t *testing.T) {
+	c := &client{logger: noopSLogger}
+	c.options.AutoAckDisabled = true
+	c.options.HandlerFailurePolicy = &HandlerFailurePolicy{Ack: AckOnFailure}
+	acked := false
+	m := &message{topic: "a", ack: func() { acked = true }}
+	c.callHandler(func(Client, Message) { panic("failed") }, newHandlerGroup(m, 1))
+	if acked {
+		t.Fatalf("message acknowledged although AutoAckDisabled is set")
+	}
+}
+
+func Test_HandlerFailurePolicyMultipleHandlers(t *testing.T) {
+	ok := func(Client, Message) {}
+	fail := func(Client, Message) { panic("failed") }
+	tests := []struct {
+		name     string
+		ack      FailureAck
+		dlErr    error
+		handlers []MessageHandler
+		acked    bool
+	}{
+		{"all succeed", NoAckOnFailure, nil, []MessageHandler{ok, ok}, true},
+		{"one fails, no ack", NoAckOnFailure, nil, []MessageHandler{fail, ok}, false},
+		{"one fails (last), no ack", NoAckOnFailure, nil, []MessageHandler{ok, fail}, false},
+		{"dead letter failed", AckIfDeadLettered, errors.New("full"), []MessageHandler{ok, fail}, false},
+		{"dead lettered", AckIfDeadLettered, nil, []MessageHandler{fail, fail, ok}, true},
+		{"ack on failure", AckOnFailure, nil, []MessageHandler{fail, ok}, true},
+	}
+	for _, tt := range tests {
+		var deadLetters, acks atomic.Int32
+		c := &client{logger: noopSLogger}
+		c.options.HandlerFailurePolicy = &HandlerFailurePolicy{
+			Ack: tt.ack,
+			DeadLetter: DeadLetterFunc(func(Client, Message, error) error {
+				deadLetters.Add(1)
+				return tt.dlErr
+			}),
+		}
+		m := &message{topic: "a", ack: func() { acks.Add(1) }}
+		g := newHandlerGroup(m, len(tt.handlers))
+		for i, h := range tt.handlers {
+			c.callHandler(h, g)
+			if i < len(tt.handlers)-1 && acks.Load() != 0 {
+				t.Fatalf("%s: message acknowledged before all handlers returned", tt.name)
+			}
+		}
+		if (acks.Load() == 1) != tt.acked {
+			t.Fatalf("%s: expected acked=%t, got %d acks", tt.name, tt.acked, acks.Load())
+		}
+		failed := tt.name != "all succeed"
+		if failed && deadLetters.Load() != 1 || !failed && deadLetters.Load() != 0 {
+			t.Fatalf("%s: message dead lettered %d times", tt.name, deadLetters.Load())
+		}
+	}
+}
+
+func Test_HandlerFailurePolicyRetryStopped(t *testing.T) {
+	var attempts, deadLetters atomic.Int32
+	c := &client{logger: noopSLogger}
+	c.options.HandlerFailurePolicy = &HandlerFailurePolicy{
+		MaxRetries:    5,
+		RetryInterval: time.Hour,
+		DeadLetter: DeadLetterFunc(func(Client, Message, error) error {
+			deadLetters.Add(1)
+			return nil
+		}),
+	}
+	stop := make(chan struct{})
+	g := newHandlerGroup(&message{topic: "a", ack: func() {}}, 1)
+	g.stop = stop
+	done := make(chan struct{})
+	go func() {
+		c.callHandler(func(Client, Message) { attempts.Add(1); panic("failed") }, g)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("retries not abandoned when the connection closed")
+	}
+	if attempts.Load() != 1 || deadLetters.Load() != 1 {
+		t.Fatalf("expected 1 attempt and the message dead lettered, got %d and %d", attempts.Load(), deadLetters.Load())
+	}
+}
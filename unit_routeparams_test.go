@@ -0,0 +1,139 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseRoutePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		err     error
+	}{
+		{"a/b", "a/b", nil},
+		{"devices/{id}/telemetry/{rest...}", "devices/+/telemetry/#", nil},
+		{"$share/g/{site}/{id}", "$share/g/+/+", nil},
+		{"a/{x}y/z{", "a/{x}y/z{", nil}, // not parameters
+		{"a/{}", "", ErrInvalidRoutePattern},
+		{"a/{rest...}/b", "", ErrInvalidRoutePattern},
+		{"a/{...}", "", ErrInvalidRoutePattern},
+		{"{id}/{id}", "", ErrInvalidRoutePattern},
+	}
+	for _, tt := range tests {
+		filter, _, err := parseRoutePattern(tt.pattern)
+		if filter != tt.filter || !errors.Is(err, tt.err) {
+			t.Errorf("parseRoutePattern(%q) = %q, %v", tt.pattern, filter, err)
+		}
+	}
+
+	_, params, _ := parseRoutePattern("$share/g/devices/{id}/telemetry/{rest...}")
+	for topic, expected := range map[string]map[string]string{
+		"devices/d1/telemetry/a/b": {"id": "d1", "rest": "a/b"},
+		"devices/d2/telemetry":     {"id": "d2", "rest": ""},
+	} {
+		if got := extractParams(params, topic); !reflect.DeepEqual(got, expected) {
+			t.Errorf("extractParams(%q) = %v, expected %v", topic, got, expected)
+		}
+	}
+}
+
+// unwrappingMessage emulates a message wrapped by middleware
+type unwrappingMessage struct{ Message }
+
+func (m unwrappingMessage) Unwrap() Message { return m.Message }
+
+func Test_RoutePatterns(t *testing.T) {
+	b := startTestBroker(t)
+	o := NewClientOptions().AddBroker(b.addr).SetRoutePatterns(true).UseInbound(func(next MessageHandler) MessageHandler {
+		return func(c Client, m Message) { next(c, unwrappingMessage{m}) }
+	})
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	params := make(chan map[string]string, 1)
+	if token := c.Subscribe("devices/{id}/telemetry/{rest...}", 1, func(_ Client, m Message) {
+		params <- Params(m)
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if token := c.Subscribe("a/{x...}/b", 1, nil); token.Wait() && !errors.Is(token.Error(), ErrInvalidRoutePattern) {
+		t.Fatalf("expected ErrInvalidRoutePattern, got %v", token.Error())
+	}
+	if s := c.(SubscriptionLister).Subscriptions(); len(s) != 1 || s[0].Filter != "devices/+/telemetry/#" {
+		t.Fatalf("unexpected subscriptions %+v", s)
+	}
+
+	c.Publish("devices/d7/telemetry/temp/1", 1, false, "x")
+	select {
+	case p := <-params:
+		if expected := map[string]string{"id": "d7", "rest": "temp/1"}; !reflect.DeepEqual(p, expected) {
+			t.Fatalf("expected %v, got %v", expected, p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+
+	if token := c.Unsubscribe("devices/{id}/telemetry/{rest...}"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if s := c.(SubscriptionLister).Subscriptions(); len(s) != 0 {
+		t.Fatalf("expected no subscriptions, got %+v", s)
+	}
+	if Params(&message{}) != nil || Param(&message{}, "id") != "" {
+		t.Fatalf("expected no params for message without pattern")
+	}
+}
+
+func Test_RoutePatternsDisabled(t *testing.T) {
+	b := startTestBroker(t)
+	c := NewClient(NewClientOptions().AddBroker(b.addr))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	received := make(chan string, 2)
+	if token := c.Subscribe("devices/{id}/state", 1, func(_ Client, m Message) {
+		received <- m.Topic()
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if s := c.(SubscriptionLister).Subscriptions(); len(s) != 1 || s[0].Filter != "devices/{id}/state" {
+		t.Fatalf("unexpected subscriptions %+v", s)
+	}
+
+	c.Publish("devices/d1/state", 1, false, "x").Wait()
+	c.Publish("devices/{id}/state", 1, false, "x").Wait()
+	select {
+	case topic := <-received:
+		if topic != "devices/{id}/state" {
+			t.Fatalf("literal filter matched %q", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+	select {
+	case topic := <-received:
+		t.Fatalf("unexpected message on %q", topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -356,6 +356,51 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 
 }
 
+func Test_SharedSubscription_Coexist(t *testing.T) {
+	called := make(chan string, 10)
+	handler := func(name string) MessageHandler {
+		return func(Client, Message) { called <- name }
+	}
+
+	router := newRouter(noopSLogger)
+	router.addRoute("$share/g1/a/+", handler("g1"))
+	router.addRoute("$share/g2/a/+", handler("g2"))
+	router.addRoute("$queue/a/#", handler("queue"))
+	router.addRoute("a/b", handler("normal"))
+	router.setDefaultHandler(handler("default"))
+	if router.routes.Len() != 4 {
+		t.Fatalf("expected 4 routes, got %d", router.routes.Len())
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	msgs <- pub
+	close(msgs)
+
+	got := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case name := <-called:
+			got[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timeout; handlers called: %v", got)
+		}
+	}
+	if !got["g1"] || !got["g2"] || !got["queue"] || !got["normal"] {
+		t.Fatalf("unexpected handlers called: %v", got)
+	}
+
+	router.deleteRoute("$share/g1/a/+")
+	if router.routes.Len() != 3 {
+		t.Fatalf("expected only the g1 route to be removed")
+	}
+	if routeIncludesTopic("$sharex/a", "a") {
+		t.Fatalf("$sharex is not a shared subscription prefix")
+	}
+}
+
 func Benchmark_MatchAndDispatch(b *testing.B) {
 	calledback := make(chan bool, 1)
 
@@ -399,3 +444,15 @@ func Benchmark_MatchAndDispatch(b *testing.B) {
 		b.Errorf("matchAndDispatch should have exited")
 	}
 }
+
+func Test_RouteLister(t *testing.T) {
+	c := NewClient(NewClientOptions())
+	h := func(Client, Message) {}
+	c.AddRoute("a", h)
+	c.AddRoute("b/+", h)
+	c.AddRoute("a", h) // replaces the existing route
+	rl := c.(RouteLister)
+	if r := rl.Routes(); len(r) != 2 || r[0] != "a" || r[1] != "b/+" {
+		t.Fatalf("unexpected routes %v", r)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// nextStateChange returns the next change from ch (failing the test if none is received)
+func nextStateChange(t *testing.T, ch <-chan StateChange) StateChange {
+	t.Helper()
+	select {
+	case sc, ok := <-ch:
+		if !ok {
+			t.Fatalf("channel closed unexpectedly")
+		}
+		return sc
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for state change")
+	}
+	return StateChange{}
+}
+
+func Test_WatchState_NoServers(t *testing.T) {
+	c := NewClient(NewClientOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := c.(StateWatcher).WatchState(ctx)
+
+	if sc := nextStateChange(t, ch); sc.State != StateDisconnected || sc.Previous != StateDisconnected {
+		t.Fatalf("unexpected initial state %+v", sc)
+	}
+	token := c.Connect()
+	token.Wait()
+	if sc := nextStateChange(t, ch); sc.State != StateConnecting || sc.Previous != StateDisconnected || sc.Cause != nil {
+		t.Fatalf("unexpected state change %+v", sc)
+	}
+	sc := nextStateChange(t, ch)
+	if sc.State != StateDisconnected || sc.Previous != StateConnecting {
+		t.Fatalf("unexpected state change %+v", sc)
+	}
+	if sc.Cause == nil || sc.Cause.Error() != token.Error().Error() {
+		t.Fatalf("unexpected cause %v", sc.Cause)
+	}
+	if sc.Since.IsZero() || sc.Time.Before(sc.Since) {
+		t.Fatalf("unexpected timestamps %+v", sc)
+	}
+	if s := c.(StateWatcher).State(); s != StateDisconnected || s.String() != "disconnected" {
+		t.Fatalf("unexpected state %v", s)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("channel not closed")
+	}
+}
+
+func Test_WatchState_Transitions(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	ch := c.WatchState(context.Background())
+	nextStateChange(t, ch) // initial state
+
+	broker, _ := url.Parse("tcp://127.0.0.1:1883")
+	c.stateNotifier.setBroker(broker)
+	connDone, err := c.status.Connecting()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = connDone(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lostErr := errors.New("connection reset")
+	c.stateNotifier.setCause(lostErr)
+	lostDone, err := c.status.ConnectionLost(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reconnDone, err := lostDone(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = reconnDone(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []struct {
+		state ConnectionState
+		cause error
+	}{
+		{StateConnecting, nil},
+		{StateConnected, nil},
+		{StateDisconnecting, lostErr},
+		{StateReconnecting, lostErr},
+		{StateConnected, lostErr},
+	}
+	prev := StateDisconnected
+	for _, e := range expected {
+		sc := nextStateChange(t, ch)
+		if sc.State != e.state || sc.Previous != prev || sc.Cause != e.cause || sc.Broker != broker {
+			t.Fatalf("expected %v (cause %v) got %+v", e.state, e.cause, sc)
+		}
+		prev = sc.State
+	}
+
+	// A late watcher receives the current state
+	late := c.WatchState(context.Background())
+	if sc := nextStateChange(t, late); sc.State != StateConnected || sc.Cause != nil {
+		t.Fatalf("unexpected initial state %+v", sc)
+	}
+}
+
+func Test_WatchState_LostCause(t *testing.T) {
+	c := NewClient(NewClientOptions().SetAutoReconnect(false)).(*client)
+	ch := c.WatchState(context.Background())
+	nextStateChange(t, ch) // initial state
+
+	connDone, err := c.status.Connecting()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = connDone(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nextStateChange(t, ch) // connecting
+	nextStateChange(t, ch) // connected
+
+	// As with gracefulReconnect; the broker closing the connection first must not replace the cause
+	reason := ErrCertificateRenewal
+	c.lostCause.Store(&reason)
+	c.internalConnLost(io.EOF)
+	c.internalConnLost(errors.New("late")) // Already handled
+	if sc := nextStateChange(t, ch); sc.State != StateDisconnecting || sc.Cause != ErrCertificateRenewal {
+		t.Fatalf("unexpected state change %+v", sc)
+	}
+	if sc := nextStateChange(t, ch); sc.State != StateDisconnected || sc.Cause != ErrCertificateRenewal {
+		t.Fatalf("unexpected state change %+v", sc)
+	}
+	if p, _ := c.lostCause.Load().(*error); p != nil {
+		t.Fatalf("cause not consumed")
+	}
+}
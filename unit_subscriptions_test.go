@@ -0,0 +1,229 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForSubscriptions waits until the client's registry holds the expected (non-pending) subscriptions
+func waitForSubscriptions(t *testing.T, c Client, expected []Subscription) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		subs := c.(SubscriptionLister).Subscriptions()
+		if reflect.DeepEqual(subs, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected subscriptions %+v, got %+v", expected, subs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Subscriptions_Resubscribe(t *testing.T) {
+	b := startTestBroker(t)
+	b.SubackCode = func(filter string, qos byte) byte {
+		if filter == "rejected" {
+			return subackFailure
+		}
+		return qos
+	}
+
+	resubscribed := make(chan map[string]error, 1)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetAutoResubscribe(true).
+		SetOnResubscribeHandler(func(_ Client, failures map[string]error) { resubscribed <- failures })
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if token := c.SubscribeMultiple(map[string]byte{"a/#": 1, "rejected": 0}, nil); token.Wait() && !errors.Is(token.Error(), ErrSubscriptionRejected) {
+		t.Fatalf("expected rejection, got: %v", token.Error())
+	}
+	if token := c.Subscribe("b", 2, nil); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if token := c.Subscribe("c", 0, nil); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if token := c.Unsubscribe("c"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	waitForSubscriptions(t, c, []Subscription{{Filter: "a/#", QoS: 1, Granted: 1}, {Filter: "b", QoS: 2, Granted: 2}})
+
+	// Following a reconnection (no session present) the subscriptions should be restored
+	b.mu.Lock()
+	b.SubackCode = func(filter string, qos byte) byte {
+		if filter == "b" {
+			return subackFailure
+		}
+		return 0 // downgrade
+	}
+	b.mu.Unlock()
+	for len(b.subscribes) > 0 {
+		<-b.subscribes
+	}
+	b.dropConnections()
+
+	select {
+	case failures := <-resubscribed:
+		if len(failures) != 1 || !errors.Is(failures["b"], ErrSubscriptionRejected) {
+			t.Fatalf("unexpected failures %v", failures)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for resubscribe")
+	}
+	sub := <-b.subscribes
+	if !reflect.DeepEqual(sub.Topics, []string{"a/#", "b"}) || !reflect.DeepEqual(sub.Qoss, []byte{1, 2}) {
+		t.Fatalf("unexpected resubscribe %v %v", sub.Topics, sub.Qoss)
+	}
+	waitForSubscriptions(t, c, []Subscription{{Filter: "a/#", QoS: 1, Granted: 0}})
+}
+
+func Test_Subscriptions_ResubscribeStopped(t *testing.T) {
+	called := make(chan struct{}, 1)
+	c := NewClient(NewClientOptions().
+		SetOnResubscribeHandler(func(Client, map[string]error) { called <- struct{}{} })).(*client)
+
+	// Nothing reads from oboundP so resubscribe blocks until stopped
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.resubscribe([]*subscriptionEntry{{Subscription: Subscription{Filter: "a", QoS: 1}}}, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("resubscribe did not exit when stopped")
+	}
+	select {
+	case <-called:
+		t.Fatalf("OnResubscribe called after stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if c.startWorker(func(<-chan struct{}) { t.Errorf("worker started whilst not connected") }) {
+		t.Fatalf("expected startWorker to fail whilst not connected")
+	}
+}
+
+func Test_Subscriptions_SubackErrors(t *testing.T) {
+	b := startTestBroker(t)
+	b.SubackCode = func(filter string, qos byte) byte {
+		switch filter {
+		case "rejected":
+			return subackFailure
+		case "downgraded":
+			return 0
+		}
+		return qos
+	}
+
+	events := make(chan *SubscriptionError, 10)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetQoSDowngradeIsError(true).
+		SetSubscriptionErrorHandler(func(_ Client, err *SubscriptionError) { events <- err })
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	handler := func(Client, Message) {}
+	token := c.SubscribeMultiple(map[string]byte{"ok": 1, "rejected": 1, "downgraded": 2}, handler)
+	token.Wait()
+	err := token.Error()
+	if !errors.Is(err, ErrSubscriptionRejected) || !errors.Is(err, ErrQoSDowngraded) {
+		t.Fatalf("expected rejection and downgrade errors, got: %v", err)
+	}
+	var se *SubscriptionError
+	if !errors.As(err, &se) || se.Requested == se.Granted {
+		t.Fatalf("expected SubscriptionError, got: %v", err)
+	}
+	if r := token.(*SubscribeToken).Result(); r["ok"] != 1 || r["rejected"] != subackFailure || r["downgraded"] != 0 {
+		t.Fatalf("unexpected result %v", r)
+	}
+
+	got := map[string]*SubscriptionError{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			got[e.Filter] = e
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for subscription error event")
+		}
+	}
+	if !got["rejected"].Rejected() || got["downgraded"].Rejected() || got["downgraded"].Granted != 0 {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	// The route for the rejected filter should have been removed (others remain)
+	routes := map[string]bool{}
+	cl := c.(*client)
+	cl.msgRouter.RLock()
+	for e := cl.msgRouter.routes.Front(); e != nil; e = e.Next() {
+		routes[e.Value.(*route).topic] = true
+	}
+	cl.msgRouter.RUnlock()
+	if !routes["ok"] || !routes["downgraded"] || routes["rejected"] {
+		t.Fatalf("unexpected routes %v", routes)
+	}
+
+	// Without QoSDowngradeIsError a downgrade is not an error (but the event still fires)
+	cl.options.QoSDowngradeIsError = false
+	if token := c.Subscribe("downgraded", 1, handler); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	select {
+	case e := <-events:
+		if e.Filter != "downgraded" || e.Requested != 1 {
+			t.Fatalf("unexpected event %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for subscription error event")
+	}
+}
+
+func Test_SubscribeResultSharedSubscription(t *testing.T) {
+	b := startTestBroker(t)
+	c := NewClient(NewClientOptions().AddBroker(b.addr))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	// Both Subscribe and SubscribeMultiple key the result by the full filter
+	token := c.Subscribe("$share/g/a", 1, nil)
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if r := token.(*SubscribeToken).Result(); !reflect.DeepEqual(r, map[string]byte{"$share/g/a": 1}) {
+		t.Fatalf("unexpected Subscribe result %v", r)
+	}
+	token = c.SubscribeMultiple(map[string]byte{"$share/g/b": 1, "c": 0}, nil)
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if r := token.(*SubscribeToken).Result(); !reflect.DeepEqual(r, map[string]byte{"$share/g/b": 1, "c": 0}) {
+		t.Fatalf("unexpected SubscribeMultiple result %v", r)
+	}
+}
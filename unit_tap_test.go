@@ -0,0 +1,93 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_TapFramer(t *testing.T) {
+	var got [][]byte
+	tap := PacketTapFunc(func(dir TapDirection, _ time.Time, raw []byte) {
+		if dir != TapOutbound {
+			t.Errorf("unexpected direction %s", dir)
+		}
+		got = append(got, bytes.Clone(raw))
+	})
+	large := append([]byte{0x30, 0x80, 0x01}, make([]byte, 128)...) // Two byte remaining length
+	stream := append(append([]byte{0x40, 2, 0, 1, 0xd0, 0}, large...), 0xc0, 0)
+
+	for _, split := range []int{1, 2, 3, 7, len(stream)} {
+		got = nil
+		f := tapFramer{dir: TapOutbound}
+		for i := 0; i < len(stream); i += split {
+			f.feed(stream[i:min(i+split, len(stream))], tap)
+		}
+		if len(got) != 4 || !bytes.Equal(got[0], stream[:4]) || !bytes.Equal(got[2], large) || !bytes.Equal(got[3], []byte{0xc0, 0}) {
+			t.Fatalf("split %d: unexpected packets %v", split, got)
+		}
+		if len(f.buf) != 0 {
+			t.Fatalf("split %d: %d bytes left in buffer", split, len(f.buf))
+		}
+	}
+}
+
+func Test_PacketTap(t *testing.T) {
+	b := startTestBroker(t)
+
+	var mu sync.Mutex
+	var seen []string
+	tapAll := PacketTapFunc(func(dir TapDirection, _ time.Time, raw []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, fmt.Sprintf("%s %d", dir, raw[0]>>4))
+	})
+	var connect *packets.ConnectPacket
+	tap := PacketTapFunc(func(dir TapDirection, _ time.Time, raw []byte) {
+		if dir == TapOutbound && raw[0]>>4 == packets.Connect {
+			cp, err := packets.ReadPacket(bytes.NewReader(raw))
+			if err != nil {
+				t.Errorf("unable to decode CONNECT: %v", err)
+				return
+			}
+			connect = cp.(*packets.ConnectPacket)
+		}
+		tapAll.TapPacket(dir, time.Now(), raw)
+	})
+	c := NewClient(NewClientOptions().AddBroker(b.addr).SetUsername("user").SetPassword("secret").SetPacketTap(tap))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if token := c.Subscribe("a", 1, nil); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	c.Disconnect(250)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// CONNECT, CONNACK, SUBSCRIBE, SUBACK, DISCONNECT
+	expected := []string{"outbound 1", "inbound 2", "outbound 8", "inbound 9", "outbound 14"}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, seen)
+	}
+	if connect == nil || !connect.UsernameFlag || connect.Username != tapRedacted || string(connect.Password) != tapRedacted {
+		t.Fatalf("expected credentials to be redacted, got %v", connect)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startTLSServer starts a TLS server (certificate valid for "broker.test") that completes the handshake and then
+// waits for the client to close the connection. The CA pool needed to verify the server is returned.
+func startTLSServer(t *testing.T, nextProtos []string) (string, *x509.CertPool) {
+	t.Helper()
+	certPEM, keyPEM := testCertificate(t, "broker.test", time.Now().Add(time.Hour))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: nextProtos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return l.Addr().String(), pool
+}
+
+func Test_TLSProfile_ALPN(t *testing.T) {
+	addr, pool := startTLSServer(t, []string{"x-amzn-mqtt-ca"})
+	broker, _ := url.Parse("tls://" + addr)
+
+	o := NewClientOptions().
+		SetTLSConfig(&tls.Config{RootCAs: pool}).
+		SetTLSProfile(&TLSConnectionProfile{ServerName: "broker.test", ALPN: []string{"x-amzn-mqtt-ca"}})
+	profile := o.brokerTLSProfile(broker)
+	tlsCfg := profile.apply(o.TLSConfig)
+	if o.TLSConfig.ServerName != "" || o.TLSConfig.NextProtos != nil {
+		t.Fatalf("original tls.Config should not be modified")
+	}
+	conn, err := openConnection(broker, tlsCfg, time.Second, nil, nil, &net.Dialer{}, nil, profile.ALPN)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != "x-amzn-mqtt-ca" {
+		t.Fatalf("unexpected protocol negotiated: %q", p)
+	}
+	conn.Close()
+}
+
+func Test_TLSProfile_ALPNNotNegotiated(t *testing.T) {
+	addr, pool := startTLSServer(t, nil)
+	broker, _ := url.Parse("tls://" + addr)
+
+	o := NewClientOptions().
+		SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "broker.test"}).
+		SetTLSProfile(&TLSConnectionProfile{ALPN: []string{"x-amzn-mqtt-ca"}})
+	profile := o.brokerTLSProfile(broker)
+	_, err := openConnection(broker, profile.apply(o.TLSConfig), time.Second, nil, nil, &net.Dialer{}, nil, profile.ALPN)
+	var alpnErr *ALPNError
+	if !errors.As(err, &alpnErr) {
+		t.Fatalf("expected ALPNError, got %v", err)
+	}
+	if alpnErr.Negotiated != "" || len(alpnErr.Offered) != 1 {
+		t.Fatalf("unexpected error contents: %+v", alpnErr)
+	}
+
+	// Per broker override removes the profile
+	o.SetBrokerTLSProfile(addr, nil)
+	if p := o.brokerTLSProfile(broker); p != nil {
+		t.Fatalf("expected nil profile, got %+v", p)
+	}
+	if _, err = openConnection(broker, o.TLSConfig, time.Second, nil, nil, &net.Dialer{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_TLSProfile_ALPNIgnoredWithoutTLS(t *testing.T) {
+	addr := startEcho(t)
+	broker, _ := url.Parse("tcp://" + addr)
+	conn, err := openConnection(broker, nil, time.Second, nil, nil, &net.Dialer{}, nil, []string{"mqtt"})
+	if err != nil {
+		t.Fatalf("ALPN should be ignored on tcp connection: %v", err)
+	}
+	conn.Close()
+
+	// A profile applies to TLS connections only so must not prevent connection to a tcp:// broker
+	b := startTestBroker(t)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetTLSProfile(&TLSConnectionProfile{ServerName: "broker.test", ALPN: []string{"x-amzn-mqtt-ca"}})
+	c := NewClient(o)
+	if token := c.Connect(); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if !c.IsConnected() {
+		t.Fatalf("expected client to be connected")
+	}
+	c.Disconnect(0)
+}
@@ -0,0 +1,163 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate generates a self-signed certificate (returned in PEM format) expiring at notAfter
+func testCertificate(t *testing.T, cn string, notAfter time.Time) (certPEM []byte, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func Test_TLSReloader_Files(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "c.pem"), filepath.Join(dir, "k.pem"), filepath.Join(dir, "ca.pem")
+	write := func(cn string, notAfter time.Time) {
+		c, k := testCertificate(t, cn, notAfter)
+		for f, b := range map[string][]byte{certFile: c, keyFile: k, caFile: c} {
+			if err := os.WriteFile(f, b, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	firstExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	write("first", firstExpiry)
+
+	r, err := NewFileTLSReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var reloads int
+	r.OnReload = func(err error) {
+		if err != nil {
+			t.Errorf("unexpected reload error: %v", err)
+		}
+		reloads++
+	}
+	if !r.NotAfter().Equal(firstExpiry) {
+		t.Fatalf("expected expiry %v, got %v", firstExpiry, r.NotAfter())
+	}
+
+	cfg := r.TLSConfig(&tls.Config{ServerName: "broker", Certificates: []tls.Certificate{{}}})
+	if cfg.ServerName != "broker" {
+		t.Fatalf("base config not retained")
+	}
+	if cfg.Certificates != nil {
+		t.Fatalf("Certificates in base should be cleared when the reloader holds a certificate")
+	}
+	if cfg.RootCAs == nil {
+		t.Fatalf("RootCAs not set")
+	}
+	cert, err := cfg.GetClientCertificate(nil)
+	if err != nil || cert.Leaf == nil || cert.Leaf.Subject.CommonName != "first" {
+		t.Fatalf("unexpected client certificate: %v, %v", cert, err)
+	}
+
+	// Reload without change should not call OnReload
+	if err = r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reloads != 0 {
+		t.Fatalf("expected no reload notification, got %d", reloads)
+	}
+
+	changed := r.changedChan()
+	write("second", firstExpiry.Add(time.Hour))
+	if err = r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reloads != 1 {
+		t.Fatalf("expected one reload notification, got %d", reloads)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("change channel not closed")
+	}
+	// The previously returned config must pick up the new certificate
+	if cert, _ = cfg.GetClientCertificate(nil); cert.Leaf.Subject.CommonName != "second" {
+		t.Fatalf("expected renewed certificate, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// A failed load leaves the current certificate in place
+	r.OnReload = nil
+	if err = os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reload(); err == nil {
+		t.Fatalf("expected error when key file missing")
+	}
+	if cert, _ = cfg.GetClientCertificate(nil); cert.Leaf.Subject.CommonName != "second" {
+		t.Fatalf("certificate should be retained following failed reload")
+	}
+}
+
+func Test_TLSReloader_Source(t *testing.T) {
+	if _, err := NewTLSReloader(nil); err == nil {
+		t.Fatalf("expected error with nil source")
+	}
+	r, err := NewTLSReloader(func() (*tls.Certificate, *x509.CertPool, error) { return nil, nil, nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.NotAfter().IsZero() {
+		t.Fatalf("expected zero expiry with no certificate")
+	}
+	base := &tls.Config{RootCAs: x509.NewCertPool(), Certificates: []tls.Certificate{{Certificate: [][]byte{{1}}}}}
+	cfg := r.TLSConfig(base)
+	if cfg.RootCAs != base.RootCAs {
+		t.Fatalf("RootCAs should be retained when the source provides none")
+	}
+	if len(cfg.Certificates) != 1 || cfg.GetClientCertificate != nil {
+		t.Fatalf("client certificate in base should be retained when the source provides none")
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testChain returns a CA certificate and a leaf certificate issued by it (along with the CA key)
+func testChain(t *testing.T) (ca *x509.Certificate, caKey *ecdsa.PrivateKey, leaf *x509.Certificate) {
+	t.Helper()
+	var err error
+	if caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"broker.test"},
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, leafTmpl, ca, &leafKey.PublicKey, caKey); err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return ca, caKey, leaf
+}
+
+func Test_ParseSPKIPin(t *testing.T) {
+	_, _, leaf := testChain(t)
+	pin := SPKIPinFromCertificate(leaf)
+	for _, s := range []string{pin.String(), pin.String()[len("sha256/"):]} {
+		p, err := ParseSPKIPin(s)
+		if err != nil || p != pin {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+	}
+	if _, err := ParseSPKIPin("sha256/invalid"); err == nil {
+		t.Fatalf("expected error parsing invalid pin")
+	}
+}
+
+func Test_TLSVerifier_Pins(t *testing.T) {
+	ca, _, leaf := testChain(t)
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	v, err := NewPinningVerifier(SPKIPinFromCertificate(ca).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = v.VerifyConnection(cs); err != nil {
+		t.Fatalf("expected CA pin to match: %v", err)
+	}
+
+	// Rotation - the current set has expired and the next set does not include our key
+	now := time.Now()
+	v = &TLSVerifier{
+		PinSets: []PinSet{
+			{Name: "current", Pins: []SPKIPin{SPKIPinFromCertificate(leaf)}, NotAfter: now.Add(-time.Minute)},
+			{Name: "next", Pins: []SPKIPin{{1, 2, 3}}, NotBefore: now.Add(-time.Minute)},
+		},
+	}
+	var pinErr *PinMismatchError
+	if err = v.VerifyConnection(cs); !errors.As(err, &pinErr) {
+		t.Fatalf("expected PinMismatchError, got %v", err)
+	}
+	if len(pinErr.Presented) != 2 || pinErr.Presented[0] != SPKIPinFromCertificate(leaf) {
+		t.Fatalf("unexpected presented pins: %v", pinErr.Presented)
+	}
+
+	v.Now = func() time.Time { return now.Add(-time.Hour) } // Only the current set is active
+	if err = v.VerifyConnection(cs); err != nil {
+		t.Fatalf("expected pin to match prior to rotation: %v", err)
+	}
+
+	v.PinSets = v.PinSets[:1]
+	v.Now = nil
+	if err = v.VerifyConnection(cs); !errors.Is(err, ErrNoActivePins) {
+		t.Fatalf("expected ErrNoActivePins, got %v", err)
+	}
+}
+
+func Test_TLSVerifier_PinsForgedChain(t *testing.T) {
+	ca, _, _ := testChain(t)
+	forgedCA, _, forgedLeaf := testChain(t)
+	v, err := NewPinningVerifier(SPKIPinFromCertificate(ca).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Without a verified chain the pinned CA must have signed the chain presented
+	for _, chain := range [][]*x509.Certificate{{forgedLeaf, ca}, {forgedLeaf, forgedCA, ca}} {
+		var pinErr *PinMismatchError
+		if err = v.VerifyConnection(tls.ConnectionState{PeerCertificates: chain}); !errors.As(err, &pinErr) {
+			t.Fatalf("expected PinMismatchError for forged chain of %d certificates, got %v", len(chain), err)
+		}
+	}
+	// Once verified the chain is trusted
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{forgedLeaf},
+		VerifiedChains:   [][]*x509.Certificate{{forgedLeaf, ca}},
+	}
+	if err = v.VerifyConnection(cs); err != nil {
+		t.Fatalf("expected verified chain to match: %v", err)
+	}
+}
+
+func Test_TLSVerifier_OCSP(t *testing.T) {
+	ca, caKey, leaf := testChain(t)
+	staple := func(status int) []byte {
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, ca},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, ca}},
+	}
+
+	v := &TLSVerifier{OCSP: OCSPIfStapled}
+	if err := v.VerifyConnection(cs); err != nil {
+		t.Fatalf("missing staple should be accepted: %v", err)
+	}
+	cs.OCSPResponse = staple(ocsp.Good)
+	if err := v.VerifyConnection(cs); err != nil {
+		t.Fatalf("good staple should be accepted: %v", err)
+	}
+	cs.OCSPResponse = staple(ocsp.Revoked)
+	var revoked *CertificateRevokedError
+	if err := v.VerifyConnection(cs); !errors.As(err, &revoked) {
+		t.Fatalf("expected CertificateRevokedError, got %v", err)
+	}
+	if revoked.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatalf("unexpected serial number %v", revoked.SerialNumber)
+	}
+	cs.OCSPResponse = []byte("garbage")
+	var ocspErr *OCSPError
+	if err := v.VerifyConnection(cs); !errors.As(err, &ocspErr) {
+		t.Fatalf("expected OCSPError, got %v", err)
+	}
+
+	v.OCSP = OCSPRequireGood
+	cs.OCSPResponse = nil
+	if err := v.VerifyConnection(cs); !errors.As(err, &ocspErr) {
+		t.Fatalf("expected OCSPError when staple missing, got %v", err)
+	}
+	cs.OCSPResponse = staple(ocsp.Unknown)
+	if err := v.VerifyConnection(cs); !errors.As(err, &ocspErr) {
+		t.Fatalf("expected OCSPError when status unknown, got %v", err)
+	}
+
+	// Without a verified chain the issuer presented by the broker cannot be trusted to vouch for the leaf
+	forgedCA, forgedKey, _ := testChain(t)
+	forged, err := ocsp.CreateResponse(forgedCA, forgedCA, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, forgedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs = tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, forgedCA}, OCSPResponse: forged}
+	if err = v.VerifyConnection(cs); !errors.As(err, &ocspErr) {
+		t.Fatalf("expected OCSPError without a verified chain, got %v", err)
+	}
+	v.OCSP = OCSPIfStapled
+	cs.OCSPResponse = staple(ocsp.Revoked)
+	if err = v.VerifyConnection(cs); err != nil {
+		t.Fatalf("expected unverifiable staple to be ignored, got %v", err)
+	}
+}
+
+func Test_TLSVerifier_Handshake(t *testing.T) {
+	addr, pool := startTLSServer(t, nil)
+	broker, _ := url.Parse("tls://" + addr)
+	v := &TLSVerifier{PinSets: []PinSet{{Pins: []SPKIPin{{1}}}}}
+	tlsCfg := v.TLSConfig(&tls.Config{RootCAs: pool, ServerName: "broker.test"})
+	_, err := openConnection(broker, tlsCfg, time.Second, nil, nil, &net.Dialer{}, nil, nil)
+	var pinErr *PinMismatchError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("expected PinMismatchError, got %v", err)
+	}
+}
@@ -49,3 +49,44 @@ func Test_ValidateTopicAndQos_H(t *testing.T) {
 		t.Fatalf("invalid error for bad multilevel topic filter")
 	}
 }
+
+func Test_ValidateTopicAndQos_Shared(t *testing.T) {
+	valid := []string{"$share/g1/a/b", "$share/g1/#", "$queue/a/+", "$shared/a"}
+	for _, topic := range valid {
+		if e := validateTopicAndQos(topic, 1); e != nil {
+			t.Fatalf("unexpected error for %q: %v", topic, e)
+		}
+	}
+	invalid := map[string]error{
+		"$share/g1":      ErrInvalidSharedSubscription,
+		"$share//a":      ErrInvalidSharedSubscription,
+		"$share/g+/a":    ErrInvalidSharedSubscription,
+		"$share/#/a":     ErrInvalidSharedSubscription,
+		"$queue/":        ErrInvalidSharedSubscription,
+		"$share/g/a/#/b": ErrInvalidTopicMultilevel,
+	}
+	for topic, expected := range invalid {
+		if e := validateTopicAndQos(topic, 1); e != expected {
+			t.Fatalf("expected %v for %q, got %v", expected, topic, e)
+		}
+	}
+}
+
+func Test_TopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/#", "a", true},
+		{"$share/g/a/#", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/c", false},
+	}
+	for _, tt := range tests {
+		if got := TopicMatches(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("TopicMatches(%q, %q) = %v", tt.filter, tt.topic, got)
+		}
+	}
+}
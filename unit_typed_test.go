@@ -0,0 +1,111 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type typedReading struct {
+	Sensor string
+	Value  int
+}
+
+// upperCodec stores strings in upper case (used to check per-topic codec selection)
+type upperCodec struct{}
+
+func (upperCodec) Name() string { return "upper" }
+func (upperCodec) Marshal(v any) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+func (upperCodec) Unmarshal(data []byte, v any) error {
+	*(v.(*string)) = string(data)
+	return nil
+}
+
+func Test_Typed(t *testing.T) {
+	b := startTestBroker(t)
+
+	decodeErrors := make(chan error, 1)
+	o := NewClientOptions().AddBroker(b.addr).
+		SetTopicCodec("upper/#", upperCodec{}).
+		SetDecodeErrorHandler(func(_ Client, _ Message, err error) { decodeErrors <- err })
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	readings := make(chan typedReading, 1)
+	if token := SubscribeTyped(c, "readings", 1, func(_ Client, r typedReading, _ Message) {
+		readings <- r
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	strs := make(chan string, 1)
+	if token := SubscribeTyped(c, "upper/#", 1, func(_ Client, s string, _ Message) {
+		strs <- s
+	}); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+
+	in := typedReading{Sensor: "temp", Value: 21}
+	if token := PublishTyped(c, "readings", 1, false, in); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	select {
+	case r := <-readings:
+		if r != in {
+			t.Fatalf("expected %+v, got %+v", in, r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+
+	if token := PublishTyped(c, "upper/a", 1, false, "hello"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	select {
+	case s := <-strs:
+		if s != "HELLO" {
+			t.Fatalf("expected HELLO, got %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+
+	// Payloads that cannot be decoded go to the error handler rather than the typed handler
+	if token := c.Publish("readings", 1, false, "not json"); token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	select {
+	case err := <-decodeErrors:
+		var de *DecodeError
+		if !errors.As(err, &de) || de.Topic != "readings" || de.Codec != "json" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case r := <-readings:
+		t.Fatalf("unexpected reading %+v", r)
+	case <-time.After(time.Second):
+		t.Fatalf("decode error not reported")
+	}
+
+	// Encoding failures are returned via the token
+	if token := PublishTyped(c, "readings", 1, false, make(chan int)); token.Wait() && token.Error() == nil {
+		t.Fatalf("expected encoding error")
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWebsocketEcho starts a WebSocket server that echos binary messages; the handshake requests received are
+// sent to the returned channel.
+func startWebsocketEcho(t *testing.T) (string, <-chan *http.Request) {
+	t.Helper()
+	reqs := make(chan *http.Request, 10)
+	upgrader := websocket.Upgrader{
+		Subprotocols:      []string{"mqtt", "mqttv3.1"},
+		EnableCompression: true,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- r
+		hdr := http.Header{}
+		hdr.Add("X-Gateway", "gw1")
+		hdr.Add("Set-Cookie", "session=abc")
+		ws, err := upgrader.Upgrade(w, r, hdr)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = ws.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), reqs
+}
+
+func Test_Websocket_Options(t *testing.T) {
+	wsURL, reqs := startWebsocketEcho(t)
+	jar, _ := cookiejar.New(nil)
+	var resp *http.Response
+	options := &WebsocketOptions{
+		EnableCompression:   true,
+		Subprotocols:        []string{"mqttv3.1"},
+		Jar:                 jar,
+		Transport:           &http.Transport{}, // No proxy
+		OnHandshakeResponse: func(r *http.Response) { resp = r },
+	}
+	conn, err := NewWebsocket(wsURL, nil, time.Second, nil, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-reqs
+	if p := req.Header.Get("Sec-WebSocket-Protocol"); p != "mqttv3.1" {
+		t.Fatalf("unexpected subprotocol requested %q", p)
+	}
+	if ext := req.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not requested (%q)", ext)
+	}
+	if resp == nil || resp.Header.Get("X-Gateway") != "gw1" {
+		t.Fatalf("handshake response not available")
+	}
+	u, _ := url.Parse(strings.Replace(wsURL, "ws", "http", 1))
+	if cookies := jar.Cookies(u); len(cookies) != 1 || cookies[0].Value != "abc" {
+		t.Fatalf("expected cookie to be stored, got %v", cookies)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+
+	// Cookie should be sent on the next connection
+	conn2, err := NewWebsocket(wsURL, nil, time.Second, nil, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn2.Close()
+	if c := (<-reqs).Header.Get("Cookie"); c != "session=abc" {
+		t.Fatalf("expected cookie in request, got %q", c)
+	}
+}
+
+// testWebsocketDialer is a WebsocketDialer that records the config passed to it
+type testWebsocketDialer struct {
+	url string
+	cfg *WebsocketConfig
+}
+
+func (d *testWebsocketDialer) DialWebsocket(_ context.Context, url string, cfg *WebsocketConfig) (net.Conn, *http.Response, error) {
+	d.url, d.cfg = url, cfg
+	return nil, &http.Response{StatusCode: http.StatusForbidden, Body: http.NoBody}, errors.New("forbidden")
+}
+
+func Test_Websocket_CustomDialer(t *testing.T) {
+	d := &testWebsocketDialer{}
+	var resp *http.Response
+	options := &WebsocketOptions{Dialer: d, OnHandshakeResponse: func(r *http.Response) { resp = r }}
+	broker, _ := url.Parse("ws://user:pass@127.0.0.1:1/mqtt")
+	hdr := http.Header{"X-Test": []string{"1"}}
+	if _, err := openConnection(broker, nil, time.Second, hdr, options, &net.Dialer{}, nil, nil); err == nil {
+		t.Fatalf("expected error from dialer")
+	}
+	if d.url != "ws://127.0.0.1:1/mqtt" {
+		t.Fatalf("unexpected url %q", d.url)
+	}
+	if d.cfg.RequestHeader.Get("X-Test") != "1" || d.cfg.Timeout != time.Second || d.cfg.NetDial != nil {
+		t.Fatalf("unexpected config %+v", d.cfg)
+	}
+	if p := d.cfg.subprotocols(); len(p) != 1 || p[0] != "mqtt" {
+		t.Fatalf("unexpected default subprotocols %v", p)
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("OnHandshakeResponse not called")
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper that is not an *http.Transport
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func Test_Websocket_HTTPClient(t *testing.T) {
+	wsURL, reqs := startWebsocketEcho(t)
+	jar, _ := cookiejar.New(nil)
+	var proxied []string
+	client := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{Proxy: func(r *http.Request) (*url.URL, error) {
+			proxied = append(proxied, r.URL.Host)
+			return nil, nil // Connect directly
+		}},
+	}
+	conn, err := NewWebsocket(wsURL, nil, time.Second, nil, &WebsocketOptions{HTTPClient: client})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.Close()
+	<-reqs
+	u, _ := url.Parse(strings.Replace(wsURL, "ws", "http", 1))
+	if len(proxied) != 1 || proxied[0] != u.Host {
+		t.Fatalf("expected client proxy function to be called, got %v", proxied)
+	}
+	if cookies := jar.Cookies(u); len(cookies) != 1 {
+		t.Fatalf("expected cookie to be stored in client jar, got %v", cookies)
+	}
+
+	client = &http.Client{Transport: roundTripperFunc(http.DefaultTransport.RoundTrip)}
+	if _, err = NewWebsocket(wsURL, nil, time.Second, nil, &WebsocketOptions{HTTPClient: client}); err == nil {
+		t.Fatalf("expected error for unsupported transport")
+	}
+}
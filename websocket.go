@@ -14,6 +14,7 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -31,12 +32,133 @@ type WebsocketOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	Proxy           ProxyFunction
+
+	// Dialer establishes the WebSocket connection; if nil GorillaWebsocketDialer is used
+	Dialer WebsocketDialer
+
+	// EnableCompression requests permessage-deflate compression (RFC 7692); the broker may decline this
+	EnableCompression bool
+
+	// Subprotocols lists the subprotocols offered in the handshake; if empty only "mqtt" is offered
+	Subprotocols []string
+
+	// Jar (if not nil) is used to add cookies to the handshake request and store any cookies set in the response
+	Jar http.CookieJar
+
+	// Transport allows HTTP settings to be shared with an existing http.Client (e.g. one configured for a corporate
+	// gateway). If set, its Proxy, DialContext, DialTLSContext and TLSClientConfig are used unless overridden
+	// (by Proxy, ClientOptions.SetProxy or ClientOptions.SetTLSConfig respectively).
+	Transport *http.Transport
+
+	// HTTPClient allows an existing http.Client to be reused; its Jar is used if Jar is nil and its Transport
+	// (http.DefaultTransport if nil) is used if Transport is nil. The WebSocket upgrade requires direct access to
+	// the connection so the client's Transport must be an *http.Transport (wrapping RoundTrippers are rejected).
+	HTTPClient *http.Client
+
+	// OnHandshakeResponse (if not nil) is called with the broker's response to the opening handshake, whether or
+	// not the connection is successful. This provides access to the response headers (e.g. those set by a gateway).
+	// The response body must not be read or closed.
+	OnHandshakeResponse func(resp *http.Response)
 }
 
 type ProxyFunction func(req *http.Request) (*url.URL, error)
 
-// NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
+// WebsocketConfig holds the settings passed to a WebsocketDialer
+type WebsocketConfig struct {
+	TLSConfig     *tls.Config   // nil for ws:// connections
+	RequestHeader http.Header   // Additional headers to be sent in the opening handshake (may be nil)
+	Timeout       time.Duration // Maximum time allowed for the handshake
+	Options       *WebsocketOptions
+
+	// NetDial, if not nil, must be used to establish the underlying network connection; it will be set when a
+	// proxy has been configured via ClientOptions.SetProxy (so proxy settings within Options must be ignored).
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// subprotocols returns the subprotocols to be offered in the handshake
+func (c *WebsocketConfig) subprotocols() []string {
+	if len(c.Options.Subprotocols) > 0 {
+		return c.Options.Subprotocols
+	}
+	return []string{"mqtt"}
+}
+
+// WebsocketDialer is implemented by types that can establish WebSocket connections. The returned net.Conn must
+// send each Write as a binary message and return the content of received binary messages from Read.
+// If the broker responds to the handshake then that response should be returned (even if err != nil).
+//
+// A custom implementation may be provided via WebsocketOptions.Dialer; GorillaWebsocketDialer is the default.
+type WebsocketDialer interface {
+	DialWebsocket(ctx context.Context, url string, cfg *WebsocketConfig) (net.Conn, *http.Response, error)
+}
+
+// GorillaWebsocketDialer is a WebsocketDialer that uses the github.com/gorilla/websocket package
+type GorillaWebsocketDialer struct{}
+
+// DialWebsocket establishes a WebSocket connection using gorilla/websocket
+func (GorillaWebsocketDialer) DialWebsocket(ctx context.Context, url string, cfg *WebsocketConfig) (net.Conn, *http.Response, error) {
+	options := cfg.Options
+	transport, jar := options.Transport, options.Jar
+	if c := options.HTTPClient; c != nil {
+		if jar == nil {
+			jar = c.Jar
+		}
+		if transport == nil {
+			rt := c.Transport
+			if rt == nil {
+				rt = http.DefaultTransport
+			}
+			t, ok := rt.(*http.Transport)
+			if !ok {
+				return nil, nil, fmt.Errorf("websocket HTTPClient.Transport must be an *http.Transport (got %T)", rt)
+			}
+			transport = t
+		}
+	}
+	dialer := &websocket.Dialer{
+		Proxy:             options.Proxy,
+		HandshakeTimeout:  cfg.Timeout,
+		EnableCompression: options.EnableCompression,
+		TLSClientConfig:   cfg.TLSConfig,
+		Subprotocols:      cfg.subprotocols(),
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		Jar:               jar,
+	}
+	if t := transport; t != nil {
+		if dialer.Proxy == nil {
+			dialer.Proxy = t.Proxy
+		}
+		if dialer.TLSClientConfig == nil {
+			dialer.TLSClientConfig = t.TLSClientConfig
+		}
+		dialer.NetDialContext = t.DialContext
+		dialer.NetDialTLSContext = t.DialTLSContext
+	} else if dialer.Proxy == nil {
+		dialer.Proxy = http.ProxyFromEnvironment
+	}
+	if cfg.NetDial != nil { // NetDial handles any proxy
+		dialer.Proxy = nil
+		dialer.NetDialContext = cfg.NetDial
+		dialer.NetDialTLSContext = nil
+	}
+
+	ws, resp, err := dialer.DialContext(ctx, url, cfg.RequestHeader)
+	if err != nil {
+		return nil, resp, err
+	}
+	return &websocketConnector{Conn: ws}, resp, nil
+}
+
+// NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the dialer specified in
+// options (gorilla/websocket by default)
 func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions) (net.Conn, error) {
+	return newWebsocket(host, tlsc, timeout, requestHeader, options, nil)
+}
+
+// newWebsocket implements NewWebsocket; if netDial is not nil it is used to establish the underlying network
+// connection (and the proxy from options/the environment is ignored).
+func newWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions, netDial dialContextFunc) (net.Conn, error) {
 	if timeout == 0 {
 		timeout = 10 * time.Second
 	}
@@ -45,32 +167,31 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		// Apply default options
 		options = &WebsocketOptions{}
 	}
-	if options.Proxy == nil {
-		options.Proxy = http.ProxyFromEnvironment
+	var dialer WebsocketDialer = GorillaWebsocketDialer{}
+	if options.Dialer != nil {
+		dialer = options.Dialer
 	}
-	dialer := &websocket.Dialer{
-		Proxy:             options.Proxy,
-		HandshakeTimeout:  timeout,
-		EnableCompression: false,
-		TLSClientConfig:   tlsc,
-		Subprotocols:      []string{"mqtt"},
-		ReadBufferSize:    options.ReadBufferSize,
-		WriteBufferSize:   options.WriteBufferSize,
+	cfg := &WebsocketConfig{
+		TLSConfig:     tlsc,
+		RequestHeader: requestHeader,
+		Timeout:       timeout,
+		Options:       options,
+		NetDial:       netDial,
 	}
 
-	ws, resp, err := dialer.Dial(host, requestHeader)
-
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, resp, err := dialer.DialWebsocket(ctx, host, cfg)
+	if resp != nil && options.OnHandshakeResponse != nil {
+		options.OnHandshakeResponse(resp)
+	}
 	if err != nil {
 		if resp != nil {
 			WARN.Println(CLI, fmt.Sprintf("Websocket handshake failure. StatusCode: %d. Body: %s", resp.StatusCode, resp.Body))
 		}
 		return nil, err
 	}
-
-	wrapper := &websocketConnector{
-		Conn: ws,
-	}
-	return wrapper, err
+	return conn, nil
 }
 
 // websocketConnector is a websocket wrapper so it satisfies the net.Conn interface so it is a